@@ -0,0 +1,199 @@
+package nprotoo
+
+import (
+	"sync"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+)
+
+const (
+	DefaultAckRetryInterval = time.Second
+	DefaultAckMaxRetries    = 3
+
+	ackDedupeSize = 1024
+	anySubscriber = "*"
+)
+
+// AckOptions configures the acknowledged notification mode of a Broadcaster.
+type AckOptions struct {
+	// Subscribers returns the node IDs expected to ack every notification, e.g. the nodes
+	// known through discovery.ServiceWatcher. If it is nil or returns no node, one ack of
+	// any subscriber is enough. Subscribers ack with their NodeID, which is random unless
+	// Config.NodeID or SetNodeID set it to the ID returned here.
+	Subscribers func() []string
+	// RetryInterval is the time to wait for acks before sending the notification again.
+	RetryInterval time.Duration
+	// MaxRetries is the number of times a notification is sent again before it is reported
+	// through the "undelivered" event of the Broadcaster.
+	MaxRetries int
+}
+
+// Undelivered is emitted as "undelivered" by a Broadcaster when expected subscribers did
+// not ack a notification within the retry budget.
+type Undelivered struct {
+	Subject string
+	Method  string
+	Data    RawMessage
+	// Pending lists the node IDs that did not ack, "*" if no subscriber acked at all.
+	Pending []string
+}
+
+// ackTracker follows the acks of one notification.
+type ackTracker struct {
+	mutex   sync.Mutex
+	pending map[string]struct{}
+	done    chan struct{}
+}
+
+func newAckTracker(subscribers []string) *ackTracker {
+	t := &ackTracker{pending: make(map[string]struct{}), done: make(chan struct{})}
+	for _, s := range subscribers {
+		t.pending[s] = struct{}{}
+	}
+	if len(t.pending) == 0 {
+		t.pending[anySubscriber] = struct{}{}
+	}
+	return t
+}
+
+func (t *ackTracker) ack(node string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.pending) == 0 {
+		return
+	}
+	delete(t.pending, node)
+	delete(t.pending, anySubscriber)
+	if len(t.pending) == 0 {
+		close(t.done)
+	}
+}
+
+func (t *ackTracker) remaining() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	pending := make([]string, 0, len(t.pending))
+	for node := range t.pending {
+		pending = append(pending, node)
+	}
+	return pending
+}
+
+// dedupe remembers the last seen keys to suppress notifications sent again by a retry.
+type dedupe struct {
+	mutex sync.Mutex
+	seen  map[string]struct{}
+	order []string
+	size  int
+}
+
+func newDedupe(size int) *dedupe {
+	return &dedupe{seen: make(map[string]struct{}, size), size: size}
+}
+
+// seenBefore records key and reports whether it was recorded already.
+func (d *dedupe) seenBefore(key string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, found := d.seen[key]; found {
+		return true
+	}
+	if len(d.order) >= d.size {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.seen[key] = struct{}{}
+	d.order = append(d.order, key)
+	return false
+}
+
+// WithAck switches the broadcaster to acknowledged notifications.
+func (bc *Broadcaster) WithAck(opts AckOptions) *Broadcaster {
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DefaultAckRetryInterval
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultAckMaxRetries
+	}
+	bc.ack = &opts
+	return bc
+}
+
+// sayAcked sends payload until every expected subscriber acked it or the retry budget ran out.
+func (bc *Broadcaster) sayAcked(notification *Notification) {
+	var subscribers []string
+	if bc.ack.Subscribers != nil {
+		subscribers = bc.ack.Subscribers()
+	}
+	payload, header, err := bc.encode(notification)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	id := notification.ID
+	tracker := newAckTracker(subscribers)
+	bc.np.acksMutex.Lock()
+	bc.np.acks[id] = tracker
+	bc.np.acksMutex.Unlock()
+
+	reply := bc.np.replySubject(id)
+	bc.np.send(payload, bc.subj, reply, header)
+
+	go func() {
+		defer func() {
+			bc.np.acksMutex.Lock()
+			delete(bc.np.acks, id)
+			bc.np.acksMutex.Unlock()
+		}()
+		for retry := 0; ; retry++ {
+			select {
+			case <-tracker.done:
+				return
+			case <-time.After(bc.ack.RetryInterval):
+			}
+			if retry >= bc.ack.MaxRetries {
+				break
+			}
+			logger.Debugf("Resend notification [%s] id[%d] pending %v", notification.Method, id, tracker.remaining())
+			bc.np.send(payload, bc.subj, reply, header)
+		}
+		undelivered := Undelivered{
+			Subject: bc.subj,
+			Method:  notification.Method,
+			Data:    notification.Data,
+			Pending: tracker.remaining(),
+		}
+		logger.Warnf("Notification [%s] id[%d] undelivered to %v", undelivered.Method, id, undelivered.Pending)
+		notificationsUndelivered.WithLabelValues(undelivered.Method).Inc()
+		bc.Emit("undelivered", undelivered)
+	}()
+}
+
+// handleAck records the ack of node for notification id.
+func (np *NatsProtoo) handleAck(id int, node string) {
+	np.acksMutex.Lock()
+	tracker, found := np.acks[id]
+	np.acksMutex.Unlock()
+	if !found {
+		logger.Debugf("received ack does not match any pending notification [id:%d]", id)
+		return
+	}
+	tracker.ack(node)
+}
+
+// sendAck acks the notification id received with reply.
+func (np *NatsProtoo) sendAck(id int, reply string) {
+	ack := &PeerMsg{
+		AckData:    AckData{Ack: true, Node: np.NodeID()},
+		CommonData: CommonData{ID: id},
+	}
+	payload, _, err := np.encode(ack, &ack.CommonData)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	np.Reply(payload, reply)
+}
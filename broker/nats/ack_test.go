@@ -0,0 +1,112 @@
+package nprotoo
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAckTracker(t *testing.T) {
+	tracker := newAckTracker([]string{"n1", "n2"})
+	tracker.ack("n1")
+	assert.Equal(t, []string{"n2"}, tracker.remaining())
+	tracker.ack("n2")
+	tracker.ack("n2")
+	assert.Empty(t, tracker.remaining())
+	<-tracker.done
+
+	tracker = newAckTracker(nil)
+	assert.Equal(t, []string{anySubscriber}, tracker.remaining())
+	tracker.ack("n1")
+	<-tracker.done
+}
+
+func TestDedupe(t *testing.T) {
+	d := newDedupe(2)
+	assert.False(t, d.seenBefore("a"))
+	assert.True(t, d.seenBefore("a"))
+	assert.False(t, d.seenBefore("b"))
+	assert.False(t, d.seenBefore("c"))
+	assert.False(t, d.seenBefore("a"))
+}
+
+func TestAckedBroadcast(t *testing.T) {
+	s := runJetStreamServer(t)
+	pub := newTestProtoo(t, s)
+	defer pub.Close()
+	config := NewConfig(s.ClientURL())
+	config.NodeID = "n2"
+	sub, err := NewNatsProtooWithConfig(config)
+	require.NoError(t, err)
+	defer sub.Close()
+	assert.Equal(t, "n2", sub.NodeID())
+
+	var delivered int32
+	sub.OnBroadcast("room.acked", func(notification Notification, subj string) { atomic.AddInt32(&delivered, 1) })
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	sent, err := nc.SubscribeSync("room.acked")
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	bc := pub.NewBroadcaster("room.acked").WithAck(AckOptions{
+		Subscribers:   func() []string { return []string{"n2", "n3"} },
+		RetryInterval: 50 * time.Millisecond,
+		MaxRetries:    2,
+	})
+	undelivered := make(chan Undelivered, 1)
+	bc.On("undelivered", func(u Undelivered) { undelivered <- u })
+	bc.Say("typing", nil)
+
+	select {
+	case u := <-undelivered:
+		assert.Equal(t, []string{"n3"}, u.Pending, "only the node which never acked is pending")
+		assert.Equal(t, "typing", u.Method)
+	case <-time.After(5 * time.Second):
+		t.Fatal("undelivered not emitted")
+	}
+	for i := 0; i < 3; i++ {
+		_, err := sent.NextMsg(time.Second)
+		require.NoError(t, err, "the notification is sent once and retried twice")
+	}
+	_, err = sent.NextMsg(100 * time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&delivered), "retries are delivered once")
+
+	acked := pub.NewBroadcaster("room.acked").WithAck(AckOptions{
+		Subscribers:   func() []string { return []string{"n2"} },
+		RetryInterval: 50 * time.Millisecond,
+	})
+	acked.On("undelivered", func(u Undelivered) { undelivered <- u })
+	acked.Say("typing", nil)
+	select {
+	case u := <-undelivered:
+		t.Fatalf("acked notification reported undelivered to %v", u.Pending)
+	case <-time.After(300 * time.Millisecond):
+	}
+	_, err = sent.NextMsg(time.Second)
+	require.NoError(t, err)
+	_, err = sent.NextMsg(100 * time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err, "acked notifications are not sent again")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&delivered))
+}
+
+func TestAckedBroadcastEncodeFailure(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	np.SetVersionAdapter(1, VersionAdapter{Downgrade: func(msg *PeerMsg) error { return errors.New("no legacy form") }})
+	bc, err := np.NewBroadcaster("room.acked").WithProtocolVersion(1)
+	require.NoError(t, err)
+	bc.WithAck(AckOptions{}).Say("typing", nil)
+
+	np.acksMutex.Lock()
+	defer np.acksMutex.Unlock()
+	assert.Empty(t, np.acks, "notifications which could not be encoded are not tracked")
+}
@@ -1,15 +1,41 @@
 package nprotoo
 
+import "github.com/mj23978/chat-backend-x/utils"
+
 // Error .
 type Error struct {
 	Code   int
 	Reason string
+
+	detailed *utils.DetailedError
+}
+
+func newError(data ResponseErrData) *Error {
+	return &Error{Code: data.ErrorCode, Reason: data.ErrorReason, detailed: data.ToError()}
 }
 
 func (e Error) Error() string {
 	return e.Reason
 }
 
+// StatusCode implements utils.StatusCodeCarrier.
+func (e Error) StatusCode() int {
+	return e.Code
+}
+
+// Detailed returns the error with every detail sent by the remote peer.
+func (e Error) Detailed() *utils.DetailedError {
+	if e.detailed == nil {
+		return utils.NewDetailedError(e.Code, e.Reason)
+	}
+	return e.detailed
+}
+
+// Unwrap exposes the detailed error to errors.As and utils.ToDetailedError.
+func (e Error) Unwrap() error {
+	return e.Detailed()
+}
+
 // Future .
 type Future struct {
 	c      chan struct{}
@@ -0,0 +1,105 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// AsyncAPIVersion is the version of the AsyncAPI specification documents are generated for.
+const AsyncAPIVersion = "2.0.0"
+
+// AsyncAPIDocument is an AsyncAPI document of the channels of one or more services.
+type AsyncAPIDocument struct {
+	AsyncAPI string                      `json:"asyncapi"`
+	Info     AsyncAPIInfo                `json:"info"`
+	Channels map[string]*AsyncAPIChannel `json:"channels"`
+}
+
+type AsyncAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// AsyncAPIChannel follows the AsyncAPI semantics: Publish lists the messages services receive
+// on the channel, Subscribe the messages services send on it.
+type AsyncAPIChannel struct {
+	Publish   *AsyncAPIOperation `json:"publish,omitempty"`
+	Subscribe *AsyncAPIOperation `json:"subscribe,omitempty"`
+}
+
+type AsyncAPIOperation struct {
+	Message AsyncAPIMessages `json:"message"`
+	// Kind is ChannelRequest for channels answering requests, ChannelBroadcast or ChannelPublish otherwise.
+	Kind     string   `json:"x-kind"`
+	Services []string `json:"x-services"`
+}
+
+type AsyncAPIMessages struct {
+	OneOf []AsyncAPIMessage `json:"oneOf"`
+}
+
+// AsyncAPIMessage describes a method. Payload is the schema of the data of the envelope,
+// Response the schema of the data of the response of a request.
+type AsyncAPIMessage struct {
+	Name     string          `json:"name"`
+	Summary  string          `json:"summary,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Response json.RawMessage `json:"x-response,omitempty"`
+}
+
+// NewAsyncAPIDocument merges the descriptions of services, e.g. returned by DescribeAll,
+// into one AsyncAPI document.
+func NewAsyncAPIDocument(title string, version string, services ...ServiceDescription) *AsyncAPIDocument {
+	doc := &AsyncAPIDocument{
+		AsyncAPI: AsyncAPIVersion,
+		Info:     AsyncAPIInfo{Title: title, Version: version},
+		Channels: make(map[string]*AsyncAPIChannel),
+	}
+	for _, service := range services {
+		for _, channel := range service.Channels {
+			c, found := doc.Channels[channel.Name]
+			if !found {
+				c = &AsyncAPIChannel{}
+				doc.Channels[channel.Name] = c
+			}
+			operation := &c.Publish
+			if channel.Kind == ChannelPublish {
+				operation = &c.Subscribe
+			}
+			if *operation == nil {
+				*operation = &AsyncAPIOperation{Kind: channel.Kind, Message: AsyncAPIMessages{OneOf: []AsyncAPIMessage{}}}
+			}
+			(*operation).merge(service.Service, channel)
+		}
+	}
+	return doc
+}
+
+func (o *AsyncAPIOperation) merge(service string, channel ChannelDescription) {
+	if channel.Kind == ChannelRequest {
+		o.Kind = ChannelRequest
+	}
+	if i := sort.SearchStrings(o.Services, service); i == len(o.Services) || o.Services[i] != service {
+		o.Services = append(o.Services, service)
+		sort.Strings(o.Services)
+	}
+
+	for _, method := range channel.Methods {
+		i := sort.Search(len(o.Message.OneOf), func(i int) bool { return o.Message.OneOf[i].Name >= method.Name })
+		if i == len(o.Message.OneOf) || o.Message.OneOf[i].Name != method.Name {
+			o.Message.OneOf = append(o.Message.OneOf, AsyncAPIMessage{})
+			copy(o.Message.OneOf[i+1:], o.Message.OneOf[i:])
+			o.Message.OneOf[i] = AsyncAPIMessage{Name: method.Name}
+		}
+		message := &o.Message.OneOf[i]
+		if message.Summary == "" {
+			message.Summary = method.Summary
+		}
+		if len(message.Payload) == 0 {
+			message.Payload = method.Request
+		}
+		if len(message.Response) == 0 {
+			message.Response = method.Response
+		}
+	}
+}
@@ -11,14 +11,20 @@ import (
 // Broadcaster .
 type Broadcaster struct {
 	emission.Emitter
-	subj string
-	np   *NatsProtoo
+	subj      string
+	namespace string
+	np        *NatsProtoo
+	ack       *AckOptions
+	stream    bool
+	sequenced bool
+	version   int
 }
 
 func newBroadcaster(subj string, np *NatsProtoo, nc *nats.Conn) *Broadcaster {
 	var bc Broadcaster
 	bc.Emitter = *emission.NewEmitter()
 	bc.subj = subj
+	bc.namespace = np.namespace
 	bc.np = np
 	bc.np.On("close", func(code int, err string) {
 		logger.Infof("Transport closed [%d] %s", code, err)
@@ -33,6 +39,11 @@ func newBroadcaster(subj string, np *NatsProtoo, nc *nats.Conn) *Broadcaster {
 
 // Say .
 func (bc *Broadcaster) Say(method string, data interface{}) {
+	bc.SayWithMetadata(nil, method, data)
+}
+
+// SayWithMetadata sends a notification carrying md to every listener.
+func (bc *Broadcaster) SayWithMetadata(md Metadata, method string, data interface{}) {
 	dataStr, err := json.Marshal(data)
 	if err != nil {
 		logger.Errorf("Marshal data %v", err)
@@ -43,15 +54,37 @@ func (bc *Broadcaster) Say(method string, data interface{}) {
 			Notification: true,
 		},
 		CommonData: CommonData{
-			Method: method,
-			Data:   dataStr,
+			Method:   method,
+			Data:     dataStr,
+			Metadata: bc.np.fromNamespace(bc.namespace, md),
 		},
 	}
-	str, err := json.Marshal(notification)
+	if bc.sequenced && !bc.stream {
+		// The notification is sent before the next one is stamped, so they are published in sequence.
+		seq := bc.np.sequencer(bc.subj)
+		seq.mutex.Lock()
+		defer seq.mutex.Unlock()
+		seq.last++
+		notification.Seq = seq.last
+		notification.Source = bc.np.sequenceSource(seq)
+	}
+	if bc.stream {
+		logger.Debugf("Send persisted notification [%s]", method)
+		bc.sayPersisted(notification)
+		return
+	}
+	if bc.ack != nil {
+		notification.ID = bc.np.transcations.nextID()
+		notification.AckRequired = true
+		logger.Debugf("Send acked notification [%s]", method)
+		bc.sayAcked(notification)
+		return
+	}
+	str, header, err := bc.encode(notification)
 	if err != nil {
 		logger.Errorf("Marshal %v", err)
 		return
 	}
 	logger.Debugf("Send notification [%s]", method)
-	bc.np.Send(str, bc.subj, _EMPTY_)
+	bc.np.send(str, bc.subj, _EMPTY_, header)
 }
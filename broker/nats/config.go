@@ -0,0 +1,348 @@
+package nprotoo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	nats "github.com/nats-io/nats.go"
+
+	viperx "github.com/mj23978/chat-backend-x/viper"
+)
+
+const (
+	DefaultConnectionName      = "NATS Protoo"
+	DefaultReconnectWait       = time.Second
+	DefaultMaxReconnects       = 600
+	DefaultPingInterval        = 2 * time.Minute
+	DefaultMaxPingsOutstanding = 2
+	DefaultConnectTimeout      = 2 * time.Second
+	DefaultBufferMessages      = 4096
+	DefaultBufferBytes         = 8 * 1024 * 1024
+	DefaultBufferTTL           = 30 * time.Second
+	DefaultRoomNamespace       = "rooms"
+
+	// OverflowDropOldest drops the oldest buffered message to make room for a new one.
+	OverflowDropOldest = "drop_oldest"
+	// OverflowReject rejects new messages while the buffer is full.
+	OverflowReject = "reject"
+)
+
+// Config defines parameters for the NATS connection used by NatsProtoo.
+type Config struct {
+	// Name is the connection name reported to the NATS server.
+	Name string `json:"name"`
+	// URL is the primary server URL.
+	URL string `json:"url"`
+	// Cluster lists additional server URLs used for the initial connect and failover.
+	Cluster []string `json:"cluster"`
+
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	// NKeySeedFile is the path to a file holding an NKey seed.
+	NKeySeedFile string `json:"nkey_seed_file"`
+	// CredsFile is the path to a chained credentials (JWT + seed) file.
+	CredsFile string `json:"creds_file"`
+
+	TLS       TLSConfig       `json:"tls"`
+	Reconnect ReconnectConfig `json:"reconnect"`
+	Buffer    BufferConfig    `json:"buffer"`
+
+	ConnectTimeout      Duration `json:"connect_timeout"`
+	PingInterval        Duration `json:"ping_interval"`
+	MaxPingsOutstanding int      `json:"max_pings_outstanding"`
+
+	// DeadLetterSubject receives messages that could not be handled. Empty disables dead letters.
+	DeadLetterSubject string `json:"dead_letter_subject"`
+	// DeadLetterCredentials keeps the credentials of dead letters, e.g. to Redrive authorized
+	// requests. They are recorded as TapRedacted by default.
+	DeadLetterCredentials bool `json:"dead_letter_credentials"`
+	// RoomNamespace prefixes the subjects of rooms, DefaultRoomNamespace if empty.
+	RoomNamespace string `json:"room_namespace"`
+	// NodeID is the ID this NatsProtoo acks notifications and reports in descriptions with,
+	// e.g. the ID of its discovery node. A random ID is used if empty.
+	NodeID string `json:"node_id"`
+	// Namespace prefixes every subject, e.g. Namespace(env, tenant). NatsProtoos of different
+	// namespaces do not receive each others requests and broadcasts.
+	Namespace string `json:"namespace"`
+	// PermittedNamespaces lists the namespaces every channel of may be called, see PermitNamespace.
+	PermittedNamespaces []string `json:"permitted_namespaces"`
+	// AcceptedNamespaces lists the namespaces every channel accepts calls from, see AcceptNamespace.
+	AcceptedNamespaces []string `json:"accepted_namespaces"`
+
+	Tap TapConfig `json:"tap"`
+}
+
+// TapConfig enables the tap mode recording every message of the NatsProtoo, see Tap.
+type TapConfig struct {
+	// File is the JSONL file the records are appended to.
+	File string `json:"file"`
+	// Subject is the mirror subject the records are published to, used if File is empty.
+	Subject string `json:"subject"`
+}
+
+// TLSConfig defines the TLS parameters of the NATS connection.
+type TLSConfig struct {
+	Enabled bool `json:"enabled"`
+	// CertFile and KeyFile hold the client certificate used for mutual TLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CAFile holds the certificate authorities used to verify the server.
+	CAFile             string `json:"ca_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// ReconnectConfig defines how the connection recovers from a lost server.
+type ReconnectConfig struct {
+	Wait        Duration `json:"wait"`
+	MaxAttempts int      `json:"max_attempts"`
+	Jitter      Duration `json:"jitter"`
+	JitterTLS   Duration `json:"jitter_tls"`
+	// BufSize is the size of the client side buffer used while reconnecting.
+	BufSize int `json:"buf_size"`
+}
+
+// BufferConfig defines the outbound buffer holding the messages sent while the connection
+// is reconnecting. They are sent in order once it reconnected. The buffer is disabled by
+// default. Once enabled, it replaces the reconnect buffer of the NATS client, so
+// Reconnect.BufSize is ignored and request timers are paused while reconnecting.
+type BufferConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxMessages and MaxBytes bound the buffer, 0 means unbounded.
+	MaxMessages int `json:"max_messages"`
+	MaxBytes    int `json:"max_bytes"`
+	// TTL is the time a message is kept in the buffer before it is dropped, 0 keeps it until
+	// the connection closes.
+	TTL Duration `json:"ttl"`
+	// Overflow is OverflowDropOldest or OverflowReject.
+	Overflow string `json:"overflow"`
+}
+
+// Duration is a time.Duration read from JSON as a string like "5s", as in the config
+// schema, or as a number of nanoseconds.
+type Duration time.Duration
+
+// Duration returns d as a time.Duration.
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+// MarshalJSON encodes d as a string like "5s".
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a string like "5s" or a number of nanoseconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		*d = Duration(value)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid duration %q", value)
+		}
+		*d = Duration(parsed)
+	default:
+		return errors.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+// NewConfig returns a Config for server with every other value set to its default.
+func NewConfig(server string) *Config {
+	return &Config{
+		Name:                DefaultConnectionName,
+		URL:                 server,
+		ConnectTimeout:      Duration(DefaultConnectTimeout),
+		PingInterval:        Duration(DefaultPingInterval),
+		MaxPingsOutstanding: DefaultMaxPingsOutstanding,
+		Reconnect: ReconnectConfig{
+			Wait:        Duration(DefaultReconnectWait),
+			MaxAttempts: DefaultMaxReconnects,
+		},
+		Buffer: BufferConfig{
+			MaxMessages: DefaultBufferMessages,
+			MaxBytes:    DefaultBufferBytes,
+			TTL:         Duration(DefaultBufferTTL),
+			Overflow:    OverflowDropOldest,
+		},
+	}
+}
+
+// NewConfigFromViper loads a Config from the viper keys below prefix, e.g. "nats".
+func NewConfigFromViper(prefix string) *Config {
+	k := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	return &Config{
+		Name:         viperx.GetString(k("name"), DefaultConnectionName),
+		URL:          viperx.GetString(k("url"), DefaultNatsURL),
+		Cluster:      viperx.GetStringSlice(k("cluster"), nil),
+		User:         viperx.GetString(k("user"), ""),
+		Password:     viperx.GetString(k("password"), ""),
+		Token:        viperx.GetString(k("token"), ""),
+		NKeySeedFile: viperx.GetString(k("nkey_seed_file"), ""),
+		CredsFile:    viperx.GetString(k("creds_file"), ""),
+		TLS: TLSConfig{
+			Enabled:            viperx.GetBool(k("tls.enabled"), false),
+			CertFile:           viperx.GetString(k("tls.cert_file"), ""),
+			KeyFile:            viperx.GetString(k("tls.key_file"), ""),
+			CAFile:             viperx.GetString(k("tls.ca_file"), ""),
+			ServerName:         viperx.GetString(k("tls.server_name"), ""),
+			InsecureSkipVerify: viperx.GetBool(k("tls.insecure_skip_verify"), false),
+		},
+		Reconnect: ReconnectConfig{
+			Wait:        Duration(viperx.GetDuration(k("reconnect.wait"), DefaultReconnectWait)),
+			MaxAttempts: viperx.GetInt(k("reconnect.max_attempts"), DefaultMaxReconnects),
+			Jitter:      Duration(viperx.GetDuration(k("reconnect.jitter"), 0)),
+			JitterTLS:   Duration(viperx.GetDuration(k("reconnect.jitter_tls"), 0)),
+			BufSize:     viperx.GetInt(k("reconnect.buf_size"), 0),
+		},
+		Buffer: BufferConfig{
+			Enabled:     viperx.GetBool(k("buffer.enabled"), false),
+			MaxMessages: viperx.GetInt(k("buffer.max_messages"), DefaultBufferMessages),
+			MaxBytes:    viperx.GetInt(k("buffer.max_bytes"), DefaultBufferBytes),
+			TTL:         Duration(viperx.GetDuration(k("buffer.ttl"), DefaultBufferTTL)),
+			Overflow:    viperx.GetString(k("buffer.overflow"), OverflowDropOldest),
+		},
+		ConnectTimeout:        Duration(viperx.GetDuration(k("connect_timeout"), DefaultConnectTimeout)),
+		PingInterval:          Duration(viperx.GetDuration(k("ping_interval"), DefaultPingInterval)),
+		MaxPingsOutstanding:   viperx.GetInt(k("max_pings_outstanding"), DefaultMaxPingsOutstanding),
+		DeadLetterSubject:     viperx.GetString(k("dead_letter_subject"), ""),
+		DeadLetterCredentials: viperx.GetBool(k("dead_letter_credentials"), false),
+		RoomNamespace:         viperx.GetString(k("room_namespace"), DefaultRoomNamespace),
+		NodeID:                viperx.GetString(k("node_id"), ""),
+		Namespace:             viperx.GetString(k("namespace"), ""),
+		PermittedNamespaces:   viperx.GetStringSlice(k("permitted_namespaces"), nil),
+		AcceptedNamespaces:    viperx.GetStringSlice(k("accepted_namespaces"), nil),
+		Tap: TapConfig{
+			File:    viperx.GetString(k("tap.file"), ""),
+			Subject: viperx.GetString(k("tap.subject"), ""),
+		},
+	}
+}
+
+// Servers returns the comma separated server list passed to nats.Connect.
+func (c *Config) Servers() string {
+	servers := make([]string, 0, len(c.Cluster)+1)
+	if c.URL != "" {
+		servers = append(servers, c.URL)
+	}
+	servers = append(servers, c.Cluster...)
+	if len(servers) == 0 {
+		return DefaultNatsURL
+	}
+	return strings.Join(servers, ",")
+}
+
+// Options translates the config into nats connection options.
+func (c *Config) Options() ([]nats.Option, error) {
+	name := c.Name
+	if name == "" {
+		name = DefaultConnectionName
+	}
+	opts := []nats.Option{nats.Name(name)}
+
+	if c.ConnectTimeout > 0 {
+		opts = append(opts, nats.Timeout(c.ConnectTimeout.Duration()))
+	}
+	if c.PingInterval > 0 {
+		opts = append(opts, nats.PingInterval(c.PingInterval.Duration()))
+	}
+	if c.MaxPingsOutstanding > 0 {
+		opts = append(opts, nats.MaxPingsOutstanding(c.MaxPingsOutstanding))
+	}
+
+	if c.Reconnect.Wait > 0 {
+		opts = append(opts, nats.ReconnectWait(c.Reconnect.Wait.Duration()))
+	}
+	if c.Reconnect.MaxAttempts != 0 {
+		opts = append(opts, nats.MaxReconnects(c.Reconnect.MaxAttempts))
+	}
+	if c.Reconnect.Jitter > 0 || c.Reconnect.JitterTLS > 0 {
+		opts = append(opts, nats.ReconnectJitter(c.Reconnect.Jitter.Duration(), c.Reconnect.JitterTLS.Duration()))
+	}
+	if c.Buffer.Enabled {
+		// Publishes fail fast while reconnecting and are held by the buffer of NatsProtoo.
+		opts = append(opts, nats.ReconnectBufSize(-1))
+	} else if c.Reconnect.BufSize != 0 {
+		opts = append(opts, nats.ReconnectBufSize(c.Reconnect.BufSize))
+	}
+
+	if c.User != "" {
+		opts = append(opts, nats.UserInfo(c.User, c.Password))
+	}
+	if c.Token != "" {
+		opts = append(opts, nats.Token(c.Token))
+	}
+	if c.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(c.CredsFile))
+	}
+	if c.NKeySeedFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(c.NKeySeedFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load nkey seed from %s", c.NKeySeedFile)
+		}
+		opts = append(opts, opt)
+	}
+
+	if c.TLS.enabled() {
+		tlsConfig, err := c.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	return opts, nil
+}
+
+func (t TLSConfig) enabled() bool {
+	return t.Enabled || t.CertFile != "" || t.CAFile != ""
+}
+
+// Config builds the *tls.Config described by t.
+func (t TLSConfig) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load nats client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read nats certificate authority")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
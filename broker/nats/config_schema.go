@@ -0,0 +1,199 @@
+package nprotoo
+
+// ConfigSchemaID is the $id of ConfigSchema. Service schemas can $ref it for their nats section.
+const ConfigSchemaID = "https://github.com/mj23978/chat-backend-x/broker/nats/config.schema.json"
+
+// ConfigSchema is the JSON schema of Config as loaded by NewConfigFromViper.
+const ConfigSchema = `{
+  "$id": "https://github.com/mj23978/chat-backend-x/broker/nats/config.schema.json",
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "nats",
+  "type": "object",
+  "additionalProperties": false,
+  "definitions": {
+    "duration": {
+      "type": "string",
+      "pattern": "^([0-9]+(\\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$"
+    },
+    "file": {
+      "type": "string",
+      "minLength": 1
+    }
+  },
+  "properties": {
+    "name": {
+      "type": "string",
+      "default": "NATS Protoo"
+    },
+    "url": {
+      "type": "string",
+      "format": "uri",
+      "default": "nats://127.0.0.1:4222"
+    },
+    "cluster": {
+      "type": "array",
+      "items": {
+        "type": "string",
+        "format": "uri"
+      }
+    },
+    "user": {
+      "type": "string"
+    },
+    "password": {
+      "type": "string"
+    },
+    "token": {
+      "type": "string"
+    },
+    "nkey_seed_file": {
+      "$ref": "#/definitions/file"
+    },
+    "creds_file": {
+      "$ref": "#/definitions/file"
+    },
+    "tls": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "enabled": {
+          "type": "boolean",
+          "default": false
+        },
+        "cert_file": {
+          "$ref": "#/definitions/file"
+        },
+        "key_file": {
+          "$ref": "#/definitions/file"
+        },
+        "ca_file": {
+          "$ref": "#/definitions/file"
+        },
+        "server_name": {
+          "type": "string"
+        },
+        "insecure_skip_verify": {
+          "type": "boolean",
+          "default": false
+        }
+      },
+      "dependencies": {
+        "cert_file": ["key_file"],
+        "key_file": ["cert_file"]
+      }
+    },
+    "reconnect": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "wait": {
+          "$ref": "#/definitions/duration",
+          "default": "1s"
+        },
+        "max_attempts": {
+          "type": "integer",
+          "minimum": -1,
+          "default": 600
+        },
+        "jitter": {
+          "$ref": "#/definitions/duration"
+        },
+        "jitter_tls": {
+          "$ref": "#/definitions/duration"
+        },
+        "buf_size": {
+          "type": "integer",
+          "minimum": -1
+        }
+      }
+    },
+    "buffer": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "enabled": {
+          "type": "boolean",
+          "default": false
+        },
+        "max_messages": {
+          "type": "integer",
+          "minimum": 0,
+          "default": 4096
+        },
+        "max_bytes": {
+          "type": "integer",
+          "minimum": 0,
+          "default": 8388608
+        },
+        "ttl": {
+          "$ref": "#/definitions/duration",
+          "default": "30s"
+        },
+        "overflow": {
+          "type": "string",
+          "enum": ["drop_oldest", "reject"],
+          "default": "drop_oldest"
+        }
+      }
+    },
+    "connect_timeout": {
+      "$ref": "#/definitions/duration",
+      "default": "2s"
+    },
+    "ping_interval": {
+      "$ref": "#/definitions/duration",
+      "default": "2m"
+    },
+    "max_pings_outstanding": {
+      "type": "integer",
+      "minimum": 1,
+      "default": 2
+    },
+    "dead_letter_subject": {
+      "type": "string"
+    },
+    "dead_letter_credentials": {
+      "type": "boolean",
+      "default": false
+    },
+    "room_namespace": {
+      "type": "string",
+      "pattern": "^[^\\s*>]+$",
+      "default": "rooms"
+    },
+    "node_id": {
+      "type": "string"
+    },
+    "namespace": {
+      "type": "string",
+      "pattern": "^([^\\s.*>]+(\\.[^\\s.*>]+)*)?$"
+    },
+    "permitted_namespaces": {
+      "type": "array",
+      "items": {
+        "type": "string",
+        "pattern": "^[^\\s.*>]+(\\.[^\\s.*>]+)*$"
+      }
+    },
+    "accepted_namespaces": {
+      "type": "array",
+      "items": {
+        "type": "string",
+        "pattern": "^[^\\s.*>]+(\\.[^\\s.*>]+)*$"
+      }
+    },
+    "tap": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "file": {
+          "type": "string"
+        },
+        "subject": {
+          "type": "string",
+          "pattern": "^[^\\s*>]+$"
+        }
+      }
+    }
+  }
+}`
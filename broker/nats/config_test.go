@@ -0,0 +1,142 @@
+package nprotoo
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/ory/jsonschema/v3"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigServers(t *testing.T) {
+	assert.Equal(t, DefaultNatsURL, (&Config{}).Servers())
+	assert.Equal(t, "nats://a:4222", NewConfig("nats://a:4222").Servers())
+	assert.Equal(t, "nats://a:4222,nats://b:4222,nats://c:4222", (&Config{
+		URL:     "nats://a:4222",
+		Cluster: []string{"nats://b:4222", "nats://c:4222"},
+	}).Servers())
+}
+
+// applyOptions returns the nats options c configures.
+func applyOptions(t *testing.T, c *Config) nats.Options {
+	opts, err := c.Options()
+	require.NoError(t, err)
+	o := nats.GetDefaultOptions()
+	for _, opt := range opts {
+		require.NoError(t, opt(&o))
+	}
+	return o
+}
+
+func TestConfigOptions(t *testing.T) {
+	t.Run("case=defaults", func(t *testing.T) {
+		o := applyOptions(t, NewConfig(DefaultNatsURL))
+		assert.Equal(t, DefaultConnectionName, o.Name)
+		assert.Equal(t, DefaultConnectTimeout, o.Timeout)
+		assert.Equal(t, DefaultPingInterval, o.PingInterval)
+		assert.Equal(t, DefaultMaxPingsOutstanding, o.MaxPingsOut)
+		assert.Equal(t, DefaultReconnectWait, o.ReconnectWait)
+		assert.Equal(t, DefaultMaxReconnects, o.MaxReconnect)
+		assert.Nil(t, o.TLSConfig)
+	})
+
+	t.Run("case=credentials", func(t *testing.T) {
+		o := applyOptions(t, &Config{User: "foo", Password: "bar", Token: "baz"})
+		assert.Equal(t, "foo", o.User)
+		assert.Equal(t, "bar", o.Password)
+		assert.Equal(t, "baz", o.Token)
+	})
+
+	t.Run("case=missing nkey seed", func(t *testing.T) {
+		_, err := (&Config{NKeySeedFile: "./stub/does-not-exist.nk"}).Options()
+		require.Error(t, err)
+	})
+
+	t.Run("case=missing client certificate", func(t *testing.T) {
+		_, err := (&Config{TLS: TLSConfig{CertFile: "./stub/does-not-exist.crt", KeyFile: "./stub/does-not-exist.key"}}).Options()
+		require.Error(t, err)
+	})
+
+	t.Run("case=tls without files", func(t *testing.T) {
+		c, err := TLSConfig{Enabled: true, ServerName: "nats.local"}.Config()
+		require.NoError(t, err)
+		assert.Equal(t, "nats.local", c.ServerName)
+		assert.Nil(t, c.RootCAs)
+	})
+}
+
+func TestConfigJSON(t *testing.T) {
+	var c Config
+	require.NoError(t, json.Unmarshal([]byte(`{"connect_timeout":"5s","reconnect":{"wait":"250ms","jitter":1000},"buffer":{"ttl":"1m"}}`), &c))
+	assert.Equal(t, 5*time.Second, c.ConnectTimeout.Duration())
+	assert.Equal(t, 250*time.Millisecond, c.Reconnect.Wait.Duration())
+	assert.Equal(t, time.Microsecond, c.Reconnect.Jitter.Duration())
+	assert.Equal(t, time.Minute, c.Buffer.TTL.Duration())
+	require.Error(t, json.Unmarshal([]byte(`{"ping_interval":"two seconds"}`), &c))
+
+	encoded, err := json.Marshal(&Config{PingInterval: Duration(10 * time.Second)})
+	require.NoError(t, err)
+	assert.Contains(t, string(encoded), `"ping_interval":"10s"`)
+}
+
+func TestNewConfigFromViper(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("nats.url", "tls://nats:4222")
+	viper.Set("nats.cluster", "tls://nats-1:4222,tls://nats-2:4222")
+	viper.Set("nats.token", "secret")
+	viper.Set("nats.tls.ca_file", "/etc/nats/ca.pem")
+	viper.Set("nats.reconnect.wait", "5s")
+	viper.Set("nats.ping_interval", "10s")
+	viper.Set("nats.buffer.overflow", OverflowReject)
+
+	c := NewConfigFromViper("nats")
+	assert.Equal(t, "tls://nats:4222", c.URL)
+	assert.Equal(t, []string{"tls://nats-1:4222", "tls://nats-2:4222"}, c.Cluster)
+	assert.Equal(t, "secret", c.Token)
+	assert.Equal(t, "/etc/nats/ca.pem", c.TLS.CAFile)
+	assert.Equal(t, 5*time.Second, c.Reconnect.Wait.Duration())
+	assert.Equal(t, DefaultMaxReconnects, c.Reconnect.MaxAttempts)
+	assert.Equal(t, 10*time.Second, c.PingInterval.Duration())
+	assert.Equal(t, DefaultConnectionName, c.Name)
+	assert.False(t, c.Buffer.Enabled)
+	assert.Equal(t, DefaultBufferTTL, c.Buffer.TTL.Duration())
+	assert.Equal(t, OverflowReject, c.Buffer.Overflow)
+	assert.Equal(t, DefaultRoomNamespace, c.RoomNamespace)
+	assert.Empty(t, c.Namespace)
+	assert.Empty(t, c.NodeID)
+	assert.Equal(t, TapConfig{}, c.Tap)
+}
+
+func TestConfigSchema(t *testing.T) {
+	c := jsonschema.NewCompiler()
+	require.NoError(t, c.AddResource(ConfigSchemaID, bytes.NewBufferString(ConfigSchema)))
+	s, err := c.Compile(ConfigSchemaID)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Validate(bytes.NewBufferString(`{"url":"nats://127.0.0.1:4222","reconnect":{"wait":"2s"},"tls":{"cert_file":"a.crt","key_file":"a.key"}}`)))
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"reconnect":{"wait":"two seconds"}}`)))
+	for _, d := range []string{"1m30s", "1.5s", "250µs", "2h45m0.5s"} {
+		require.NoError(t, s.Validate(bytes.NewBufferString(`{"reconnect":{"wait":"`+d+`"}}`)), d)
+	}
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"reconnect":{"wait":"1.s"}}`)))
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"tls":{"cert_file":"a.crt"}}`)))
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"buffer":{"overflow":"block"}}`)))
+	require.NoError(t, s.Validate(bytes.NewBufferString(`{"room_namespace":"chat.rooms"}`)))
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"room_namespace":"chat.>"}`)))
+	require.NoError(t, s.Validate(bytes.NewBufferString(`{"namespace":"staging.acme","permitted_namespaces":["staging.shared"]}`)))
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"namespace":"staging.*"}`)))
+	require.NoError(t, s.Validate(bytes.NewBufferString(`{"node_id":"chat-1"}`)))
+	require.NoError(t, s.Validate(bytes.NewBufferString(`{"dead_letter_subject":"dlq","dead_letter_credentials":true}`)))
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"permitted_namespaces":[""]}`)))
+	require.NoError(t, s.Validate(bytes.NewBufferString(`{"accepted_namespaces":["staging.acme"]}`)))
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"accepted_namespaces":["staging.>"]}`)))
+	require.NoError(t, s.Validate(bytes.NewBufferString(`{"tap":{"file":"tap.jsonl","subject":"_NPROTOO.tap"}}`)))
+	require.Error(t, s.Validate(bytes.NewBufferString(`{"tap":{"subject":"taps.>"}}`)))
+}
@@ -0,0 +1,132 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	nats "github.com/nats-io/nats.go"
+)
+
+// Reasons a message is sent to the dead-letter subject.
+const (
+	DeadLetterUnmarshal  = "unmarshal"
+	DeadLetterNoListener = "no_listener"
+	DeadLetterPanic      = "panic"
+	// DeadLetterUnsupportedVersion is a message sent with a protocol version which is not supported.
+	DeadLetterUnsupportedVersion = "unsupported_version"
+	// DeadLetterNamespaceNotAccepted is a broadcast from a namespace which was not accepted.
+	DeadLetterNamespaceNotAccepted = "namespace_not_accepted"
+)
+
+// DeadLetter is published to the dead-letter subject for a message that could not be handled.
+// The credentials in its headers and metadata are redacted unless Config.DeadLetterCredentials.
+type DeadLetter struct {
+	// Reason is one of the DeadLetter* reasons, Error describes the failure.
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+	// Subject, Reply, Header and Data are the original message.
+	Subject string      `json:"subject"`
+	Reply   string      `json:"reply,omitempty"`
+	Header  nats.Header `json:"header,omitempty"`
+	Data    []byte      `json:"data"`
+	// Timestamp is the time the message failed, ServiceID the node ID of the NatsProtoo it failed on.
+	Timestamp time.Time `json:"timestamp"`
+	ServiceID string    `json:"service_id"`
+}
+
+// SetDeadLetterSubject sets the subject messages that could not be handled are republished to.
+// An empty subject disables dead letters.
+func (np *NatsProtoo) SetDeadLetterSubject(subj string) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.deadLetterSubject = subj
+}
+
+// DeadLetterSubject returns the subject set by SetDeadLetterSubject.
+func (np *NatsProtoo) DeadLetterSubject() string {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	return np.deadLetterSubject
+}
+
+// deadLetter republishes the message to the dead-letter subject, if any.
+func (np *NatsProtoo) deadLetter(reason string, cause string, msg *nats.Msg) {
+	deadLettersTotal.WithLabelValues(reason).Inc()
+	deadLetterSubject := np.DeadLetterSubject()
+	if deadLetterSubject == _EMPTY_ {
+		return
+	}
+	header, data := msg.Header, msg.Data
+	if !np.deadLetterCreds {
+		header = redactHeader(header)
+		var envelope struct {
+			Metadata Metadata `json:"metadata"`
+		}
+		if json.Unmarshal(data, &envelope) == nil {
+			data = redactMetadata(data, envelope.Metadata)
+		}
+	}
+	payload, err := json.Marshal(&DeadLetter{
+		Reason:    reason,
+		Error:     cause,
+		Subject:   msg.Subject,
+		Reply:     msg.Reply,
+		Header:    header,
+		Data:      data,
+		Timestamp: time.Now().UTC(),
+		ServiceID: np.NodeID(),
+	})
+	if err != nil {
+		logger.Errorf("Marshal dead letter %v", err)
+		return
+	}
+	logger.Warnf("Dead letter [%s] of %s: %s", reason, msg.Subject, cause)
+	np.send(payload, np.subject(deadLetterSubject), _EMPTY_, nil)
+}
+
+// DeadLetters reads the messages published to a dead-letter subject.
+type DeadLetters struct {
+	np  *NatsProtoo
+	sub *nats.Subscription
+}
+
+// SubscribeDeadLetters starts buffering the messages published to the dead-letter subject
+// of np. Messages published before the subscription are not received.
+func (np *NatsProtoo) SubscribeDeadLetters() (*DeadLetters, error) {
+	deadLetterSubject := np.DeadLetterSubject()
+	if deadLetterSubject == _EMPTY_ {
+		return nil, errors.New("dead letters are disabled")
+	}
+	sub, err := np.nc.SubscribeSync(np.subject(deadLetterSubject))
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetters{np: np, sub: sub}, np.nc.Flush()
+}
+
+// Next waits up to timeout for the next dead letter. It returns nats.ErrTimeout if none arrived.
+func (d *DeadLetters) Next(timeout time.Duration) (*DeadLetter, error) {
+	msg, err := d.sub.NextMsg(timeout)
+	if err != nil {
+		return nil, err
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal(msg.Data, &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// Redrive publishes the original message of dl to its original subject again. Its redacted
+// credentials are sent as TapRedacted, see Config.DeadLetterCredentials.
+func (d *DeadLetters) Redrive(dl *DeadLetter) error {
+	logger.Infof("Redrive dead letter [%s] of %s", dl.Reason, dl.Subject)
+	return d.np.send(dl.Data, dl.Subject, dl.Reply, dl.Header)
+}
+
+// Close stops receiving dead letters.
+func (d *DeadLetters) Close() error {
+	return d.sub.Unsubscribe()
+}
@@ -0,0 +1,72 @@
+package nprotoo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetters(t *testing.T) {
+	s := runJetStreamServer(t)
+	config := NewConfig(s.ClientURL())
+	config.DeadLetterSubject = "nprotoo.deadletter"
+	np, err := NewNatsProtooWithConfig(config)
+	require.NoError(t, err)
+	defer np.Close()
+
+	deadLetters, err := np.SubscribeDeadLetters()
+	require.NoError(t, err)
+	defer deadLetters.Close()
+
+	np.OnRequest("svc.*", func(request Request, accept RespondFunc, reject RejectFunc) { accept(nil) })
+	require.NoError(t, np.Send([]byte("{not json"), "svc.*", "reply.1"))
+
+	dl, err := deadLetters.Next(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterUnmarshal, dl.Reason)
+	assert.Equal(t, "svc.*", dl.Subject)
+	assert.Equal(t, "reply.1", dl.Reply)
+	assert.Equal(t, []byte("{not json"), dl.Data)
+	assert.Equal(t, np.NodeID(), dl.ServiceID)
+	assert.False(t, dl.Timestamp.IsZero())
+
+	require.NoError(t, deadLetters.Redrive(dl))
+	dl, err = deadLetters.Next(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterUnmarshal, dl.Reason)
+
+	_, rerr := np.NewRequestor("svc.unknown").SyncRequest("ping", nil)
+	require.NotNil(t, rerr)
+	assert.Equal(t, ErrorCodeNoListener, rerr.Code)
+	dl, err = deadLetters.Next(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterNoListener, dl.Reason)
+	assert.Equal(t, "svc.unknown", dl.Subject)
+
+	ctx := NewMetadataContext(context.Background(), Metadata{AuthorizationMetadata: "Bearer secret", PeerSubjectMetadata: "alice", "trace": "t-1"})
+	_, rerr = np.NewRequestor("svc.unknown").SyncRequestContext(ctx, "ping", nil)
+	require.NotNil(t, rerr)
+	dl, err = deadLetters.Next(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, TapRedacted, dl.Header.Get(AuthorizationMetadata), "credentials are not republished")
+	assert.Equal(t, TapRedacted, dl.Header.Get(PeerSubjectMetadata))
+	assert.Equal(t, "t-1", dl.Header.Get("trace"))
+
+	config.DeadLetterCredentials = true
+	kept, err := NewNatsProtooWithConfig(config)
+	require.NoError(t, err)
+	defer kept.Close()
+	kept.OnRequest("kept.*", func(request Request, accept RespondFunc, reject RejectFunc) { accept(nil) })
+	_, rerr = kept.NewRequestor("kept.unknown").SyncRequestContext(ctx, "ping", nil)
+	require.NotNil(t, rerr)
+	dl, err = deadLetters.Next(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer secret", dl.Header.Get(AuthorizationMetadata), "credentials are kept if configured")
+
+	np.SetDeadLetterSubject("")
+	_, err = np.SubscribeDeadLetters()
+	require.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	// DescribeMethod is the reserved method every NatsProtoo answers with its ServiceDescription,
+	// on each channel it serves requests on and on DescribeSubject.
+	DescribeMethod = "$describe"
+	// DescribeSubject is subscribed by every NatsProtoo without queue group, so a request
+	// sent to it by DescribeAll is answered by every running service.
+	DescribeSubject = "_NPROTOO.describe"
+)
+
+// Kinds of channels in a ServiceDescription.
+const (
+	// ChannelRequest is a channel the service answers requests on.
+	ChannelRequest = "request"
+	// ChannelBroadcast is a channel the service receives notifications on.
+	ChannelBroadcast = "broadcast"
+	// ChannelPublish is a channel the service sends notifications on.
+	ChannelPublish = "publish"
+)
+
+// MethodDescription documents a method of a channel.
+type MethodDescription struct {
+	Name    string `json:"name"`
+	Summary string `json:"summary,omitempty"`
+	// Request and Response are the JSON schemas of the payloads, if known.
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// ChannelDescription describes a channel a service uses.
+type ChannelDescription struct {
+	Name string `json:"name"`
+	// Kind is ChannelRequest, ChannelBroadcast or ChannelPublish.
+	Kind string `json:"kind"`
+	// QueueGroup is the queue group the channel is subscribed with, if any.
+	QueueGroup string `json:"queue_group,omitempty"`
+	// Durable is the durable consumer name of a persisted broadcast channel.
+	Durable string              `json:"durable,omitempty"`
+	Methods []MethodDescription `json:"methods,omitempty"`
+}
+
+// ServiceDescription is the answer to DescribeMethod.
+type ServiceDescription struct {
+	Service  string               `json:"service"`
+	Version  string               `json:"version,omitempty"`
+	NodeID   string               `json:"node_id"`
+	Channels []ChannelDescription `json:"channels"`
+}
+
+// SetVersion sets the version reported in the ServiceDescription. The service name is
+// the connection name of the Config.
+func (np *NatsProtoo) SetVersion(version string) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.version = version
+}
+
+// RegisterMethod documents a method of channel. Registering a method twice replaces it.
+func (np *NatsProtoo) RegisterMethod(channel string, method MethodDescription) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	methods := np.methods[channel]
+	for i := range methods {
+		if methods[i].Name == method.Name {
+			methods[i] = method
+			return
+		}
+	}
+	np.methods[channel] = append(methods, method)
+}
+
+// registerChannel records a channel for the ServiceDescription. np.mutex must be held.
+func (np *NatsProtoo) registerChannel(kind string, channel string, queue string, durable string) {
+	np.channels[kind+" "+channel] = ChannelDescription{Name: channel, Kind: kind, QueueGroup: queue, Durable: durable}
+}
+
+// Describe returns the channels and methods served by np.
+func (np *NatsProtoo) Describe() ServiceDescription {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	description := ServiceDescription{
+		Service:  np.service,
+		Version:  np.version,
+		NodeID:   np.nodeID,
+		Channels: make([]ChannelDescription, 0, len(np.channels)),
+	}
+	for _, channel := range np.channels {
+		channel.Methods = append([]MethodDescription(nil), np.methods[channel.Name]...)
+		description.Channels = append(description.Channels, channel)
+	}
+	sort.Slice(description.Channels, func(i, j int) bool {
+		a, b := description.Channels[i], description.Channels[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Kind < b.Kind
+	})
+	return description
+}
+
+// DescribeAll asks every running service for its ServiceDescription and returns the
+// answers received within timeout.
+func (np *NatsProtoo) DescribeAll(timeout time.Duration) ([]ServiceDescription, error) {
+	request := &Request{
+		RequestData: RequestData{Request: true},
+		CommonData:  CommonData{Method: DescribeMethod, Data: RawMessage("null")},
+	}
+	now := time.Now()
+	request.setTimeout(now, now.Add(timeout))
+	payload, _, err := np.encode(request, &request.CommonData)
+	if err != nil {
+		return nil, err
+	}
+	inbox := np.subject(nats.NewInbox())
+	sub, err := np.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := np.send(payload, np.subject(DescribeSubject), inbox, nil); err != nil {
+		return nil, err
+	}
+
+	var descriptions []ServiceDescription
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err == nats.ErrTimeout {
+			return descriptions, nil
+		} else if err != nil {
+			return descriptions, err
+		}
+		var response Response
+		if err := json.Unmarshal(msg.Data, &response); err != nil || !response.Ok {
+			logger.Warnf("DescribeAll: invalid answer %s", string(msg.Data))
+			continue
+		}
+		var description ServiceDescription
+		if err := json.Unmarshal(response.Data, &description); err != nil {
+			logger.Warnf("DescribeAll: invalid description %v", err)
+			continue
+		}
+		descriptions = append(descriptions, description)
+	}
+}
@@ -0,0 +1,80 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribe(t *testing.T) {
+	s := runJetStreamServer(t)
+	newService := func(name string) *NatsProtoo {
+		config := NewConfig(s.ClientURL())
+		config.Name = name
+		np, err := NewNatsProtooWithConfig(config)
+		require.NoError(t, err)
+		return np
+	}
+
+	chat := newService("chat")
+	defer chat.Close()
+	chat.SetVersion("1.2.0")
+	chat.OnRequest("chat.rpc", func(request Request, accept RespondFunc, reject RejectFunc) { accept(nil) })
+	chat.RegisterMethod("chat.rpc", MethodDescription{
+		Name:     "send",
+		Summary:  "Sends a message to a room",
+		Request:  json.RawMessage(`{"type":"object"}`),
+		Response: json.RawMessage(`{"type":"string"}`),
+	})
+	chat.NewBroadcaster("room.events")
+	chat.RegisterMethod("room.events", MethodDescription{Name: "join"})
+
+	presence := newService("presence")
+	defer presence.Close()
+	presence.OnBroadcast("room.events", func(notification Notification, subj string) {})
+
+	result, rerr := presence.NewRequestor("chat.rpc").SyncRequest(DescribeMethod, nil)
+	require.Nil(t, rerr)
+	var description ServiceDescription
+	require.NoError(t, json.Unmarshal(result, &description))
+	assert.Equal(t, "chat", description.Service)
+	assert.Equal(t, "1.2.0", description.Version)
+	assert.Equal(t, chat.NodeID(), description.NodeID)
+	require.Len(t, description.Channels, 2)
+	assert.Equal(t, ChannelDescription{Name: "chat.rpc", Kind: ChannelRequest, Methods: []MethodDescription{{
+		Name:     "send",
+		Summary:  "Sends a message to a room",
+		Request:  json.RawMessage(`{"type":"object"}`),
+		Response: json.RawMessage(`{"type":"string"}`),
+	}}}, description.Channels[0])
+	assert.Equal(t, ChannelPublish, description.Channels[1].Kind)
+
+	descriptions, err := chat.DescribeAll(500 * time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, descriptions, 2)
+	sort.Slice(descriptions, func(i, j int) bool { return descriptions[i].Service < descriptions[j].Service })
+	assert.Equal(t, "presence", descriptions[1].Service)
+
+	doc := NewAsyncAPIDocument("Chat", "1.0.0", descriptions...)
+	assert.Equal(t, AsyncAPIVersion, doc.AsyncAPI)
+	require.Len(t, doc.Channels, 2)
+	rpc := doc.Channels["chat.rpc"]
+	require.NotNil(t, rpc.Publish)
+	assert.Nil(t, rpc.Subscribe)
+	assert.Equal(t, ChannelRequest, rpc.Publish.Kind)
+	assert.Equal(t, []AsyncAPIMessage{{
+		Name:     "send",
+		Summary:  "Sends a message to a room",
+		Payload:  json.RawMessage(`{"type":"object"}`),
+		Response: json.RawMessage(`{"type":"string"}`),
+	}}, rpc.Publish.Message.OneOf)
+
+	events := doc.Channels["room.events"]
+	assert.Equal(t, []string{"presence"}, events.Publish.Services)
+	assert.Equal(t, []string{"chat"}, events.Subscribe.Services)
+	assert.Equal(t, "join", events.Subscribe.Message.OneOf[0].Name)
+}
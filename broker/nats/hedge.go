@@ -0,0 +1,225 @@
+package nprotoo
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+)
+
+const (
+	DefaultHedgePercentile = 0.95
+	DefaultHedgeDelay      = 50 * time.Millisecond
+	DefaultHedgeMinDelay   = time.Millisecond
+	// hedgeWindow is the number of recent latencies the hedge delay is computed from.
+	hedgeWindow = 128
+	// hedgeMinSamples is the number of latencies required before the percentile is used.
+	hedgeMinSamples = 16
+)
+
+// HedgeOptions configure hedged requests. A hedged request is sent again to another node
+// if it has not been answered once the percentile of the recent latencies passed. The
+// first successful response wins, and the other attempts are canceled. Failed attempts
+// are not retried, the request fails once every attempt sent failed.
+type HedgeOptions struct {
+	// Methods lists the idempotent methods which are hedged. No method is hedged if empty.
+	Methods []string
+	// Percentile of the latencies after which another attempt is sent, DefaultHedgePercentile if 0.
+	Percentile float64
+	// Delay is used until enough latencies were observed, DefaultHedgeDelay if 0.
+	Delay time.Duration
+	// MinDelay and MaxDelay bound the delay computed from the latencies.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MaxHedges is the number of attempts sent after the first one, 1 if 0.
+	MaxHedges int
+	// Targets returns the channels of the nodes serving the channel of the requestor, e.g.
+	// their rpc channels found by discovery. Each attempt is sent to a different target.
+	// Every attempt is sent to the channel of the requestor if it is nil or returns none.
+	// The targets are channels of the namespace of the requestor.
+	Targets func() []string
+}
+
+// hedge is the hedging state of a requestor.
+type hedge struct {
+	opts      HedgeOptions
+	methods   map[string]bool
+	mutex     sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// WithHedging switches the requests of the hedged methods to hedged requests.
+func (req *Requestor) WithHedging(opts HedgeOptions) *Requestor {
+	if opts.Percentile <= 0 || opts.Percentile > 1 {
+		opts.Percentile = DefaultHedgePercentile
+	}
+	if opts.Delay <= 0 {
+		opts.Delay = DefaultHedgeDelay
+	}
+	if opts.MinDelay <= 0 {
+		opts.MinDelay = DefaultHedgeMinDelay
+	}
+	if opts.MaxHedges <= 0 {
+		opts.MaxHedges = 1
+	}
+	h := &hedge{opts: opts, methods: make(map[string]bool, len(opts.Methods))}
+	for _, method := range opts.Methods {
+		h.methods[method] = true
+	}
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	req.hedge = h
+	return req
+}
+
+// hedged returns the hedging state if method is hedged.
+func (req *Requestor) hedged(method string) *hedge {
+	req.mutex.Lock()
+	h := req.hedge
+	req.mutex.Unlock()
+	if h == nil || !h.methods[method] {
+		return nil
+	}
+	return h
+}
+
+// label returns the metric label of method, otherMethod unless it was listed in the options.
+func (h *hedge) label(method string) string {
+	if h.methods[method] {
+		return method
+	}
+	return otherMethod
+}
+
+func (h *hedge) observe(latency time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.latencies) < hedgeWindow {
+		h.latencies = append(h.latencies, latency)
+		return
+	}
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % hedgeWindow
+}
+
+// delay returns how long an attempt is waited for before the next one is sent.
+func (h *hedge) delay() time.Duration {
+	h.mutex.Lock()
+	if len(h.latencies) < hedgeMinSamples {
+		h.mutex.Unlock()
+		return h.opts.Delay
+	}
+	latencies := append([]time.Duration(nil), h.latencies...)
+	h.mutex.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	delay := latencies[int(h.opts.Percentile*float64(len(latencies)-1))]
+	if delay < h.opts.MinDelay {
+		delay = h.opts.MinDelay
+	}
+	if h.opts.MaxDelay > 0 && delay > h.opts.MaxDelay {
+		delay = h.opts.MaxDelay
+	}
+	return delay
+}
+
+// targets returns the channels of the attempts, distinct nodes in random order if known.
+func (h *hedge) targets(channel string) []string {
+	var targets []string
+	if h.opts.Targets != nil {
+		targets = h.opts.Targets()
+	}
+	if len(targets) == 0 {
+		targets = make([]string, h.opts.MaxHedges+1)
+		for i := range targets {
+			targets[i] = channel
+		}
+		return targets
+	}
+	targets = append([]string(nil), targets...)
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > h.opts.MaxHedges+1 {
+		targets = targets[:h.opts.MaxHedges+1]
+	}
+	return targets
+}
+
+type hedgeResult struct {
+	attempt int
+	data    RawMessage
+	err     *Error
+}
+
+// hedgedRequest sends the attempts of a hedged request and resolves future with the first
+// successful response, or the error of the last attempt once every attempt sent failed.
+func (req *Requestor) hedgedRequest(ctx context.Context, h *hedge, method string, data interface{}, future *Future) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	targets := h.targets(req.channel)
+	results := make(chan hedgeResult, len(targets))
+	cancels := make([]context.CancelFunc, 0, len(targets))
+	attempt := func(i int) {
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+		cancels = append(cancels, cancelAttempt)
+		requestor := newRequestor(req.namespace, targets[i], req.np)
+		requestor.SetRequestTimeout(req.requestTimeout())
+		req.mutex.Lock()
+		requestor.version = req.version
+		req.mutex.Unlock()
+		start := time.Now()
+		requestor.AsyncRequestContext(attemptCtx, method, data).Then(
+			func(result RawMessage) {
+				h.observe(time.Since(start))
+				results <- hedgeResult{attempt: i, data: result}
+			},
+			func(err *Error) {
+				results <- hedgeResult{attempt: i, err: err}
+			})
+	}
+
+	attempt(0)
+	pending := 1
+	timer := time.NewTimer(h.delay())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if len(cancels) < len(targets) {
+				logger.Debugf("Hedge request [%s] to %s", method, targets[len(cancels)])
+				requestsHedged.WithLabelValues(h.label(method), "sent").Inc()
+				attempt(len(cancels))
+				pending++
+				timer.Reset(h.delay())
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if result.attempt > 0 {
+					requestsHedged.WithLabelValues(h.label(method), "won").Inc()
+				}
+				for i, cancelAttempt := range cancels {
+					if i != result.attempt {
+						cancelAttempt()
+					}
+				}
+				future.resolve(result.data)
+				return
+			}
+			if pending == 0 {
+				future.reject(result.err)
+				return
+			}
+		}
+	}
+}
+
+func (req *Requestor) requestTimeout() time.Duration {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	return req.timeout
+}
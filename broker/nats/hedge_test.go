@@ -0,0 +1,106 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgedRequest(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+
+	canceled := make(chan struct{}, 10)
+	np.OnRequest("node-slow", func(request Request, accept RespondFunc, reject RejectFunc) {
+		go func() {
+			select {
+			case <-time.After(2 * time.Second):
+				accept("slow")
+			case <-request.Context().Done():
+				canceled <- struct{}{}
+			}
+		}()
+	})
+	np.OnRequest("node-fast", func(request Request, accept RespondFunc, reject RejectFunc) {
+		accept("fast")
+	})
+
+	req := np.NewRequestor("lookup").WithHedging(HedgeOptions{
+		Methods: []string{"get"},
+		Delay:   20 * time.Millisecond,
+		Targets: func() []string { return []string{"node-slow", "node-fast"} },
+	})
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		result, err := req.SyncRequest("get", nil)
+		require.Nil(t, err)
+		var node string
+		require.NoError(t, json.Unmarshal(result, &node))
+		assert.Equal(t, "fast", node)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second), "the slow node is hedged")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the losing attempt must be canceled")
+	}
+
+	attempts := make(chan string, 10)
+	for _, node := range []string{"node-failing-1", "node-failing-2"} {
+		node := node
+		np.OnRequest(node, func(request Request, accept RespondFunc, reject RejectFunc) {
+			attempts <- node
+			reject(500, "boom")
+		})
+	}
+	failing := np.NewRequestor("lookup").WithHedging(HedgeOptions{
+		Methods: []string{"get"},
+		Delay:   time.Second,
+		Targets: func() []string { return []string{"node-failing-1", "node-failing-2"} },
+	})
+	start := time.Now()
+	_, err := failing.SyncRequest("get", nil)
+	require.NotNil(t, err)
+	assert.Equal(t, 500, err.Code)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "a failed attempt is not retried")
+	assert.Len(t, attempts, 1)
+
+	_, err = np.NewRequestor("node-fast").WithHedging(HedgeOptions{Methods: []string{"get"}}).SyncRequest("set", nil)
+	assert.Nil(t, err, "methods which are not hedged are sent once")
+	_, err = np.NewRequestor("node-fast").WithHedging(HedgeOptions{Targets: func() []string { return []string{"node-failing-1"} }}).SyncRequest("get", nil)
+	assert.Nil(t, err, "no method is hedged without Methods")
+}
+
+func TestHedgedRequestVersion(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	versions := make(chan int, 1)
+	_, err = nc.Subscribe("node-v1", func(msg *nats.Msg) {
+		var request PeerMsg
+		require.NoError(t, json.Unmarshal(msg.Data, &request))
+		versions <- request.Version
+		nc.Publish(msg.Reply, []byte(fmt.Sprintf(`{"response":true,"ok":true,"id":%d,"data":null}`, request.ID)))
+	})
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	req := np.NewRequestor("lookup").WithHedging(HedgeOptions{
+		Methods: []string{"get"},
+		Targets: func() []string { return []string{"node-v1"} },
+	})
+	require.NoError(t, req.SetProtocolVersion(legacyVersion))
+	_, rerr := req.SyncRequest("get", nil)
+	require.Nil(t, rerr)
+	assert.Equal(t, legacyVersion, <-versions, "attempts are sent with the negotiated version")
+}
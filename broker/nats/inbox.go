@@ -0,0 +1,244 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"github.com/mj23978/chat-backend-x/utils"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	transcationShards = 32
+
+	statusHeader       = "Status"
+	noRespondersStatus = "503"
+)
+
+// transcationTable holds the pending transcations of every requestor of a connection.
+// It is sharded by transcation id to keep lock contention low.
+type transcationTable struct {
+	next   uint64
+	shards [transcationShards]transcationShard
+}
+
+type transcationShard struct {
+	sync.Mutex
+	transcations map[int]*Transcation
+}
+
+func newTranscationTable() *transcationTable {
+	t := &transcationTable{}
+	for i := range t.shards {
+		t.shards[i].transcations = make(map[int]*Transcation)
+	}
+	return t
+}
+
+// nextID returns a connection unique transcation id.
+func (t *transcationTable) nextID() int {
+	return int(atomic.AddUint64(&t.next, 1) & (1<<31 - 1))
+}
+
+func (t *transcationTable) shard(id int) *transcationShard {
+	return &t.shards[uint(id)%transcationShards]
+}
+
+func (t *transcationTable) add(transcation *Transcation) {
+	s := t.shard(transcation.id)
+	s.Lock()
+	s.transcations[transcation.id] = transcation
+	s.Unlock()
+}
+
+// addWithTimeout adds transcation and starts its timer calling onTimeout. The timer is
+// started once the transcation was added, so onTimeout always finds it with take.
+func (t *transcationTable) addWithTimeout(transcation *Transcation, timeout time.Duration, onTimeout func()) {
+	s := t.shard(transcation.id)
+	s.Lock()
+	defer s.Unlock()
+	s.transcations[transcation.id] = transcation
+	transcation.deadline = time.Now().Add(timeout)
+	transcation.timer = time.AfterFunc(timeout, onTimeout)
+}
+
+// take removes the transcation with id and stops its timer. It returns nil if the
+// transcation already finished.
+func (t *transcationTable) take(id int) *Transcation {
+	s := t.shard(id)
+	s.Lock()
+	transcation, found := s.transcations[id]
+	delete(s.transcations, id)
+	s.Unlock()
+	if !found {
+		return nil
+	}
+	transcation.finish()
+	return transcation
+}
+
+// drain removes and returns every pending transcation.
+func (t *transcationTable) drain() []*Transcation {
+	var pending []*Transcation
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		for id, transcation := range s.transcations {
+			delete(s.transcations, id)
+			pending = append(pending, transcation)
+		}
+		s.Unlock()
+	}
+	for _, transcation := range pending {
+		transcation.finish()
+	}
+	return pending
+}
+
+// pause stops the timer of the pending transcation id until resumeAll.
+func (t *transcationTable) pause(id int) {
+	s := t.shard(id)
+	s.Lock()
+	if transcation, found := s.transcations[id]; found {
+		transcation.pause()
+	}
+	s.Unlock()
+}
+
+// pauseAll stops the timers of every pending transcation until resumeAll.
+func (t *transcationTable) pauseAll() {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		for _, transcation := range s.transcations {
+			transcation.pause()
+		}
+		s.Unlock()
+	}
+}
+
+// resumeAll restarts the paused timers with the time they had left.
+func (t *transcationTable) resumeAll() {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		for _, transcation := range s.transcations {
+			transcation.resume()
+		}
+		s.Unlock()
+	}
+}
+
+// deadline returns the time the timer of the pending transcation id fires.
+func (t *transcationTable) deadline(id int) (time.Time, bool) {
+	s := t.shard(id)
+	s.Lock()
+	defer s.Unlock()
+	transcation, found := s.transcations[id]
+	if !found || transcation.deadline.IsZero() {
+		return time.Time{}, false
+	}
+	return transcation.deadline, true
+}
+
+func (t *Transcation) pause() {
+	if t.paused || t.timer == nil || !t.timer.Stop() {
+		return
+	}
+	t.paused = true
+	t.remaining = time.Until(t.deadline)
+}
+
+func (t *Transcation) resume() {
+	if !t.paused {
+		return
+	}
+	t.paused = false
+	t.deadline = time.Now().Add(t.remaining)
+	t.timer.Reset(t.remaining)
+}
+
+func (t *Transcation) finish() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	close(t.done)
+}
+
+// subscribeInbox subscribes the single wildcard reply inbox of the connection.
+func (np *NatsProtoo) subscribeInbox() error {
+	np.inbox = np.subject(nats.NewInbox())
+	_, err := np.nc.Subscribe(np.inbox+".*", np.onReply)
+	return err
+}
+
+// replySubject returns the inbox subject the response of transcation id is sent to.
+func (np *NatsProtoo) replySubject(id int) string {
+	return np.inbox + "." + strconv.Itoa(id)
+}
+
+func (np *NatsProtoo) onReply(msg *nats.Msg) {
+	logger.Debugf("Got response [subj:%s, reply:%s]: %s", msg.Subject, msg.Reply, string(msg.Data))
+	np.record(TapInbound, msg)
+	id, err := strconv.Atoi(strings.TrimPrefix(msg.Subject, np.inbox+"."))
+	if err != nil {
+		logger.Errorf("received response on unknown inbox %s", msg.Subject)
+		return
+	}
+
+	if len(msg.Data) == 0 && msg.Header.Get(statusHeader) == noRespondersStatus {
+		if transcation := np.transcations.take(id); transcation != nil {
+			transcation.failWith(NewResponseErrData(utils.ErrUnavailable.WithReason("no responders available for request")))
+		}
+		return
+	}
+
+	var peerMsg PeerMsg
+	if err := json.Unmarshal(msg.Data, &peerMsg); err != nil {
+		logger.Errorf("handleMessage Response Unmarshal %v", err)
+		return
+	}
+	if err := np.upgrade(&peerMsg); err != nil {
+		logger.Warnf("Drop response of %s: %v", msg.Subject, err)
+		unsupportedVersions.WithLabelValues(strconv.Itoa(peerVersion(&peerMsg))).Inc()
+		if transcation := np.transcations.take(id); transcation != nil {
+			transcation.failWith(NewResponseErrData(err))
+		}
+		return
+	}
+	if peerMsg.Ack {
+		np.handleAck(id, peerMsg.Node)
+	} else if peerMsg.Response {
+		np.handleResponse(id, Response{ResponseData: peerMsg.ResponseData, CommonData: peerMsg.CommonData})
+	}
+}
+
+func (np *NatsProtoo) handleResponse(id int, response Response) {
+	if response.ID != id {
+		logger.Errorf("received response [id:%d] on the inbox of request [id:%d]", response.ID, id)
+		return
+	}
+	transcation := np.transcations.take(id)
+	if transcation == nil {
+		logger.Errorf("received response does not match any sent request [id:%d]", response.ID)
+		return
+	}
+
+	if response.Ok {
+		transcation.accept(response.Data)
+	} else {
+		transcation.failWith(response.ResponseErrData)
+	}
+}
+
+// failPending rejects every pending transcation once the transport closed.
+func (np *NatsProtoo) failPending(reason string) {
+	for _, transcation := range np.transcations.drain() {
+		transcation.failWith(NewResponseErrData(utils.ErrUnavailable.WithReason(reason)))
+	}
+}
@@ -0,0 +1,68 @@
+package nprotoo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscationTable(t *testing.T) {
+	table := newTranscationTable()
+	newTranscation := func() *Transcation {
+		return &Transcation{id: table.nextID(), done: make(chan struct{}), timer: time.NewTimer(time.Hour)}
+	}
+
+	first, second := newTranscation(), newTranscation()
+	require.NotEqual(t, first.id, second.id)
+	table.add(first)
+	table.add(second)
+
+	assert.Equal(t, first, table.take(first.id))
+	assert.Nil(t, table.take(first.id), "a transcation must only be taken once")
+	select {
+	case <-first.done:
+	default:
+		t.Fatal("taking a transcation must finish it")
+	}
+
+	pending := table.drain()
+	assert.Equal(t, []*Transcation{second}, pending)
+	assert.Nil(t, table.take(second.id))
+	assert.Empty(t, table.drain())
+}
+
+func TestTranscationTableTimeout(t *testing.T) {
+	table := newTranscationTable()
+	transcation := &Transcation{id: table.nextID(), done: make(chan struct{})}
+	timedOut := make(chan *Transcation, 1)
+	table.addWithTimeout(transcation, 0, func() { timedOut <- table.take(transcation.id) })
+	select {
+	case taken := <-timedOut:
+		assert.Equal(t, transcation, taken, "a zero timeout must find the transcation")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout not fired")
+	}
+}
+
+func TestMismatchedResponse(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+
+	responses := make(chan RawMessage, 1)
+	id := np.transcations.nextID()
+	transcation := &Transcation{id: id, done: make(chan struct{}), accept: func(data RawMessage) { responses <- data }}
+	np.transcations.add(transcation)
+
+	np.handleResponse(id, Response{ResponseData: ResponseData{Response: true, Ok: true}, CommonData: CommonData{ID: id + 1}})
+	select {
+	case <-transcation.done:
+		t.Fatal("a mismatched response must not finish the transcation")
+	default:
+	}
+
+	np.handleResponse(id, Response{ResponseData: ResponseData{Response: true, Ok: true}, CommonData: CommonData{ID: id, Data: RawMessage(`"ok"`)}})
+	assert.Equal(t, RawMessage(`"ok"`), <-responses)
+}
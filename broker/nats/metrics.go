@@ -0,0 +1,115 @@
+package nprotoo
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// otherMethod is the method label of methods which are not known, so peers sending
+// arbitrary methods cannot grow the label set without bound.
+const otherMethod = "other"
+
+var (
+	requestsExpired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "requests_expired_total",
+			Help:      "Number of requests dropped because their deadline passed before they were handled.",
+		},
+		[]string{"method"},
+	)
+	notificationsUndelivered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "notifications_undelivered_total",
+			Help:      "Number of acknowledged notifications not acked by every expected subscriber within the retry budget.",
+		},
+		[]string{"method"},
+	)
+	deadLettersTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "dead_letters_total",
+			Help:      "Number of received messages that could not be handled, by reason.",
+		},
+		[]string{"reason"},
+	)
+	listenerPanics = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "listener_panics_total",
+			Help:      "Number of panics recovered from request handlers and broadcast listeners.",
+		},
+		[]string{"kind"},
+	)
+	offlineBuffered = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "nprotoo",
+			Name:      "offline_buffered_messages",
+			Help:      "Number of outbound messages buffered while the connection is reconnecting.",
+		},
+	)
+	outOfSequence = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "notifications_out_of_sequence_total",
+			Help:      "Number of sequenced notifications received after a gap, late or dropped as duplicates, by kind.",
+		},
+		[]string{"kind"},
+	)
+	requestsHedged = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "requests_hedged_total",
+			Help:      "Number of hedged attempts sent, and of hedged attempts which answered first, by method.",
+		},
+		[]string{"method", "outcome"},
+	)
+	unsupportedVersions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "unsupported_versions_total",
+			Help:      "Number of received messages dropped or rejected for their protocol version, by version.",
+		},
+		[]string{"version"},
+	)
+	transferChunks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "transfer_chunks_total",
+			Help:      "Number of transfer chunks sent, and of chunks sent again after they were missed, by kind.",
+		},
+		[]string{"kind"},
+	)
+	offlineDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nprotoo",
+			Name:      "offline_dropped_total",
+			Help:      "Number of buffered outbound messages dropped before they could be sent, by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestsExpired, notificationsUndelivered, deadLettersTotal, listenerPanics, offlineBuffered, offlineDropped, outOfSequence, requestsHedged, unsupportedVersions, transferChunks)
+}
+
+// methodLabel returns the label of a method received on channel: the method if it is
+// reserved or was documented with RegisterMethod, otherMethod otherwise.
+func (np *NatsProtoo) methodLabel(channel, method string) string {
+	switch method {
+	case DescribeMethod, CapabilitiesMethod, TransferMethod:
+		return method
+	}
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	for pattern, methods := range np.methods {
+		if !SubjectMatches(pattern, channel) {
+			continue
+		}
+		for _, m := range methods {
+			if m.Name == method {
+				return method
+			}
+		}
+	}
+	return otherMethod
+}
@@ -0,0 +1,199 @@
+package nprotoo
+
+import (
+	"errors"
+	"strings"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+)
+
+// NamespaceMetadata is the metadata the namespace of the caller is sent with on the requests
+// and broadcasts to another namespace, which the callee checks, see AcceptNamespace.
+const NamespaceMetadata = "Nprotoo-Namespace"
+
+var (
+	// ErrInvalidNamespace is returned for namespaces which are not a sequence of subject tokens.
+	ErrInvalidNamespace = errors.New("nprotoo: namespace must be subject tokens without wildcards")
+	// ErrNamespaceNotPermitted is returned for calls to a namespace that was not permitted.
+	ErrNamespaceNotPermitted = errors.New("nprotoo: calls to namespace are not permitted")
+)
+
+// Namespace joins parts, e.g. an environment and a tenant, to a namespace.
+// Empty parts are skipped.
+func Namespace(parts ...string) string {
+	tokens := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != _EMPTY_ {
+			tokens = append(tokens, part)
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+func validNamespace(namespace string) bool {
+	if namespace == _EMPTY_ {
+		return true
+	}
+	for _, token := range strings.Split(namespace, ".") {
+		if token == _EMPTY_ || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// namespaced returns the subject of channel in namespace.
+func namespaced(namespace string, channel string) string {
+	if namespace == _EMPTY_ {
+		return channel
+	}
+	return namespace + "." + channel
+}
+
+// Namespace returns the namespace prefixing every subject of this NatsProtoo.
+func (np *NatsProtoo) Namespace() string {
+	return np.namespace
+}
+
+// subject returns the subject of channel in the namespace of this NatsProtoo. Requests,
+// broadcasts, reply inboxes and streams are all namespaced, so NatsProtoos of different
+// namespaces sharing a NATS cluster do not see each others messages.
+func (np *NatsProtoo) subject(channel string) string {
+	return namespaced(np.namespace, channel)
+}
+
+// channelOf returns the channel of a subject received in the namespace of this NatsProtoo.
+func (np *NatsProtoo) channelOf(subject string) string {
+	if np.namespace == _EMPTY_ {
+		return subject
+	}
+	return strings.TrimPrefix(subject, np.namespace+".")
+}
+
+// PermitNamespace permits the requests and broadcasts to the channels of namespace
+// matching one of patterns, see SubjectMatches, or to every channel if none is given.
+// Calls across namespaces are rejected with ErrNamespaceNotPermitted until permitted.
+// The callee must accept them too, see AcceptNamespace.
+//
+// Namespaces only separate the NatsProtoos which follow them: any NATS client may publish
+// to the subjects of another namespace, without NamespaceMetadata. Isolating tenants needs
+// a NATS account, or publish and subscribe permissions on the namespace, per tenant.
+func (np *NatsProtoo) PermitNamespace(namespace string, patterns ...string) error {
+	if namespace == _EMPTY_ || !validNamespace(namespace) {
+		return ErrInvalidNamespace
+	}
+	if len(patterns) == 0 {
+		patterns = []string{">"}
+	}
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.permitted[namespace] = append(np.permitted[namespace], patterns...)
+	logger.Infof("Permit namespace %s => %s %v", np.namespace, namespace, patterns)
+	return nil
+}
+
+// RevokeNamespace revokes the calls to namespace permitted by PermitNamespace. Requestors
+// and broadcasters created before keep working.
+func (np *NatsProtoo) RevokeNamespace(namespace string) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	delete(np.permitted, namespace)
+}
+
+// AcceptNamespace accepts the requests and broadcasts from namespace to the channels matching
+// one of patterns, or to every channel if none is given. Calls from other namespaces are
+// rejected with utils.ErrForbidden, and their broadcasts dead-lettered, until accepted.
+// The caller namespace is the NamespaceMetadata it sends, see PermitNamespace on isolation.
+func (np *NatsProtoo) AcceptNamespace(namespace string, patterns ...string) error {
+	if namespace == _EMPTY_ || !validNamespace(namespace) {
+		return ErrInvalidNamespace
+	}
+	if len(patterns) == 0 {
+		patterns = []string{">"}
+	}
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.accepted[namespace] = append(np.accepted[namespace], patterns...)
+	logger.Infof("Accept namespace %s => %s %v", namespace, np.namespace, patterns)
+	return nil
+}
+
+// RefuseNamespace refuses the calls from namespace accepted by AcceptNamespace.
+func (np *NatsProtoo) RefuseNamespace(namespace string) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	delete(np.accepted, namespace)
+}
+
+// callerNamespace returns the namespace a message to channel was sent from, and whether
+// it is accepted. Messages without NamespaceMetadata are from the own namespace.
+func (np *NatsProtoo) callerNamespace(md Metadata, channel string) (string, bool) {
+	caller, found := md[NamespaceMetadata]
+	if !found || caller == np.namespace {
+		return caller, true
+	}
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	for _, pattern := range np.accepted[caller] {
+		if SubjectMatches(pattern, channel) {
+			return caller, true
+		}
+	}
+	return caller, false
+}
+
+// fromNamespace adds the NamespaceMetadata to md of a message sent to namespace, if it is
+// not the own namespace.
+func (np *NatsProtoo) fromNamespace(namespace string, md Metadata) Metadata {
+	if namespace == np.namespace {
+		return md
+	}
+	md = md.Clone()
+	if md == nil {
+		md = make(Metadata, 1)
+	}
+	md[NamespaceMetadata] = np.namespace
+	return md
+}
+
+// permits reports whether channel of namespace may be called.
+func (np *NatsProtoo) permits(namespace string, channel string) bool {
+	if namespace == np.namespace {
+		return true
+	}
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	for _, pattern := range np.permitted[namespace] {
+		if SubjectMatches(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRequestorIn returns a requestor of channel in namespace. The responses are received
+// on the inbox of this NatsProtoo, in its own namespace.
+func (np *NatsProtoo) NewRequestorIn(namespace string, channel string) (*Requestor, error) {
+	if !validNamespace(namespace) {
+		return nil, ErrInvalidNamespace
+	}
+	if !np.permits(namespace, channel) {
+		logger.Warnf("Request from namespace %s to %s of %s is not permitted", np.namespace, channel, namespace)
+		return nil, ErrNamespaceNotPermitted
+	}
+	return newRequestor(namespace, channel, np), nil
+}
+
+// NewBroadcasterIn returns a broadcaster of channel in namespace.
+func (np *NatsProtoo) NewBroadcasterIn(namespace string, channel string) (*Broadcaster, error) {
+	if !validNamespace(namespace) {
+		return nil, ErrInvalidNamespace
+	}
+	if !np.permits(namespace, channel) {
+		logger.Warnf("Broadcast from namespace %s to %s of %s is not permitted", np.namespace, channel, namespace)
+		return nil, ErrNamespaceNotPermitted
+	}
+	bc := newBroadcaster(namespaced(namespace, channel), np, np.nc)
+	bc.namespace = namespace
+	return bc, nil
+}
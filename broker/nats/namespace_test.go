@@ -0,0 +1,141 @@
+package nprotoo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mj23978/chat-backend-x/utils"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newNamespacedProtoo(t *testing.T, s *server.Server, namespace string) *NatsProtoo {
+	config := NewConfig(s.ClientURL())
+	config.Namespace = namespace
+	np, err := NewNatsProtooWithConfig(config)
+	require.NoError(t, err)
+	t.Cleanup(np.Close)
+	return np
+}
+
+func TestNamespace(t *testing.T) {
+	assert.Equal(t, "staging.acme", Namespace("staging", "", "acme"))
+	assert.True(t, validNamespace(""))
+	assert.True(t, validNamespace("staging.acme"))
+	assert.False(t, validNamespace("staging.*"))
+	assert.False(t, validNamespace("staging..acme"))
+
+	config := NewConfig(DefaultNatsURL)
+	config.Namespace = "prod.>"
+	_, err := NewNatsProtooWithConfig(config)
+	assert.Equal(t, ErrInvalidNamespace, err)
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	s := runJetStreamServer(t)
+	staging := newNamespacedProtoo(t, s, Namespace("staging", "acme"))
+	prod := newNamespacedProtoo(t, s, Namespace("prod", "acme"))
+	raw := newTestProtoo(t, s)
+	defer raw.Close()
+
+	serve := func(np *NatsProtoo) {
+		np.OnRequest("rpc-billing", func(request Request, accept RespondFunc, reject RejectFunc) {
+			accept(map[string]string{"namespace": np.Namespace()})
+		})
+	}
+	serve(staging)
+	serve(prod)
+
+	result, err := staging.NewRequestor("rpc-billing").SyncRequest("charge", nil)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"namespace":"staging.acme"}`, string(result))
+	result, err = prod.NewRequestor("rpc-billing").SyncRequest("charge", nil)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"namespace":"prod.acme"}`, string(result))
+
+	requestor := raw.NewRequestor("rpc-billing")
+	requestor.SetRequestTimeout(100 * time.Millisecond)
+	_, err = requestor.SyncRequest("charge", nil)
+	assert.NotNil(t, err, "un-namespaced requests do not reach namespaced listeners")
+
+	notifications := make(chan Notification, 10)
+	prod.OnBroadcast("room.1", func(notification Notification, subj string) {
+		assert.Equal(t, "room.1", subj)
+		notifications <- notification
+	})
+	staging.NewBroadcaster("room.1").Say("staging", nil)
+	prod.NewBroadcaster("room.1").Say("prod", nil)
+	received := receive(t, notifications, 1)
+	assert.Equal(t, "prod", received[0].Method)
+	select {
+	case notification := <-notifications:
+		t.Fatalf("crosstalk from %s", notification.Method)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCrossNamespace(t *testing.T) {
+	s := runJetStreamServer(t)
+	tenant := newNamespacedProtoo(t, s, "prod.acme")
+	shared := newNamespacedProtoo(t, s, "prod.shared")
+	shared.OnRequest("rpc-auth", func(request Request, accept RespondFunc, reject RejectFunc) {
+		accept(map[string]string{"ok": "yes"})
+	})
+	notifications := make(chan Notification, 1)
+	shared.OnBroadcast("audit", func(notification Notification, subj string) { notifications <- notification })
+
+	_, err := tenant.NewRequestorIn("prod.shared", "rpc-auth")
+	assert.Equal(t, ErrNamespaceNotPermitted, err)
+	_, err = tenant.NewBroadcasterIn("prod.shared", "audit")
+	assert.Equal(t, ErrNamespaceNotPermitted, err)
+
+	require.NoError(t, tenant.PermitNamespace("prod.shared", "rpc-auth"))
+	requestor, err := tenant.NewRequestorIn("prod.shared", "rpc-auth")
+	require.NoError(t, err)
+	_, rerr := requestor.SyncRequest("verify", nil)
+	require.NotNil(t, rerr)
+	assert.Equal(t, utils.CodeForbidden, rerr.Code, "the callee must accept the namespace too")
+
+	require.NoError(t, shared.AcceptNamespace("prod.acme", "rpc-auth", "audit"))
+	result, rerr := requestor.SyncRequest("verify", nil)
+	require.Nil(t, rerr)
+	assert.JSONEq(t, `{"ok":"yes"}`, string(result))
+	_, err = tenant.NewBroadcasterIn("prod.shared", "audit")
+	assert.Equal(t, ErrNamespaceNotPermitted, err, "only the permitted channels may be called")
+
+	require.NoError(t, tenant.PermitNamespace("prod.shared", "audit"))
+	bc, err := tenant.NewBroadcasterIn("prod.shared", "audit")
+	require.NoError(t, err)
+	bc.Say("login", nil)
+	assert.Equal(t, "login", receive(t, notifications, 1)[0].Method)
+
+	shared.SetDeadLetterSubject("nprotoo.deadletter")
+	deadLetters, err := shared.SubscribeDeadLetters()
+	require.NoError(t, err)
+	defer deadLetters.Close()
+	shared.RefuseNamespace("prod.acme")
+	bc.Say("logout", nil)
+	dl, err := deadLetters.Next(5 * time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterNamespaceNotAccepted, dl.Reason)
+	select {
+	case notification := <-notifications:
+		t.Fatalf("refused broadcast %s was delivered", notification.Method)
+	default:
+	}
+
+	raw := newTestProtoo(t, s)
+	defer raw.Close()
+	require.NoError(t, raw.PermitNamespace("prod.shared"))
+	requestor, err = raw.NewRequestorIn("prod.shared", "rpc-auth")
+	require.NoError(t, err)
+	_, rerr = requestor.SyncRequest("verify", nil)
+	require.NotNil(t, rerr)
+	assert.Equal(t, utils.CodeForbidden, rerr.Code, "calls from the root namespace are checked too")
+
+	tenant.RevokeNamespace("prod.shared")
+	_, err = tenant.NewRequestorIn("prod.shared", "rpc-auth")
+	assert.Equal(t, ErrNamespaceNotPermitted, err)
+	assert.Equal(t, ErrInvalidNamespace, tenant.PermitNamespace("prod.*"))
+}
@@ -0,0 +1,213 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"github.com/mj23978/chat-backend-x/utils"
+	nats "github.com/nats-io/nats.go"
+)
+
+// ErrBufferFull is returned when a message is sent while reconnecting and the outbound buffer is full.
+var ErrBufferFull = errors.New("nprotoo: offline buffer is full")
+
+type outboxEntry struct {
+	msg     *nats.Msg
+	expires time.Time
+}
+
+// outbox holds the messages sent while the connection is reconnecting. It is guarded by np.mutex.
+type outbox struct {
+	config  BufferConfig
+	entries []outboxEntry
+	bytes   int
+	offline bool
+}
+
+func newOutbox(config BufferConfig) *outbox {
+	if !config.Enabled {
+		return nil
+	}
+	return &outbox{config: config}
+}
+
+func (o *outbox) full(size int) bool {
+	return (o.config.MaxMessages > 0 && len(o.entries)+1 > o.config.MaxMessages) ||
+		(o.config.MaxBytes > 0 && o.bytes+size > o.config.MaxBytes)
+}
+
+func (o *outbox) push(msg *nats.Msg) {
+	entry := outboxEntry{msg: msg}
+	if o.config.TTL > 0 {
+		entry.expires = time.Now().Add(o.config.TTL.Duration())
+	}
+	o.entries = append(o.entries, entry)
+	o.bytes += len(msg.Data)
+}
+
+func (o *outbox) pop() *nats.Msg {
+	msg := o.entries[0].msg
+	o.entries[0] = outboxEntry{}
+	o.entries = o.entries[1:]
+	o.bytes -= len(msg.Data)
+	return msg
+}
+
+func (o *outbox) expired(now time.Time) bool {
+	return len(o.entries) > 0 && !o.entries[0].expires.IsZero() && now.After(o.entries[0].expires)
+}
+
+// publish sends msg, or buffers it while the connection is reconnecting. It returns the
+// transcations of requests dropped from the buffer, which are failed by the caller once
+// np.mutex is released. np.mutex must be held.
+func (np *NatsProtoo) publish(msg *nats.Msg) ([]*Transcation, error) {
+	if np.outbox != nil && np.outbox.offline {
+		return np.buffer(msg)
+	}
+	err := np.nc.PublishMsg(msg)
+	if err == nil {
+		return nil, nil
+	}
+	if np.outbox != nil && np.nc.IsReconnecting() {
+		np.goOffline()
+		return np.buffer(msg)
+	}
+	logger.Errorf("Publish to %s: %v", msg.Subject, err)
+	return nil, err
+}
+
+// buffer adds msg to the outbox, applying its TTL and overflow policy. np.mutex must be held.
+func (np *NatsProtoo) buffer(msg *nats.Msg) ([]*Transcation, error) {
+	o := np.outbox
+	var dropped []*Transcation
+	now := time.Now()
+	for o.expired(now) {
+		dropped = np.dropBuffered(dropped, o.pop(), "expired")
+	}
+	for o.full(len(msg.Data)) {
+		if o.config.Overflow == OverflowReject || len(o.entries) == 0 {
+			offlineBuffered.Set(float64(len(o.entries)))
+			return np.dropBuffered(dropped, msg, "overflow"), ErrBufferFull
+		}
+		dropped = np.dropBuffered(dropped, o.pop(), "overflow")
+	}
+	if id, ok := np.transcationID(msg); ok {
+		np.transcations.pause(id)
+	}
+	o.push(msg)
+	offlineBuffered.Set(float64(len(o.entries)))
+	logger.Debugf("Buffered message to %s while reconnecting (%d buffered)", msg.Subject, len(o.entries))
+	return dropped, nil
+}
+
+// dropBuffered counts msg as dropped and appends the transcation of the request it carries to dropped.
+func (np *NatsProtoo) dropBuffered(dropped []*Transcation, msg *nats.Msg, reason string) []*Transcation {
+	offlineDropped.WithLabelValues(reason).Inc()
+	logger.Warnf("Dropped buffered message to %s (%s)", msg.Subject, reason)
+	if id, ok := np.transcationID(msg); ok {
+		if transcation := np.transcations.take(id); transcation != nil {
+			dropped = append(dropped, transcation)
+		}
+	}
+	return dropped
+}
+
+// transcationID returns the id of the transcation waiting for the reply to msg.
+func (np *NatsProtoo) transcationID(msg *nats.Msg) (int, bool) {
+	if np.inbox == _EMPTY_ || !strings.HasPrefix(msg.Reply, np.inbox+".") {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(msg.Reply, np.inbox+"."))
+	return id, err == nil
+}
+
+// goOffline starts buffering and pauses the timers of pending requests. np.mutex must be held.
+func (np *NatsProtoo) goOffline() {
+	if np.outbox == nil || np.outbox.offline {
+		return
+	}
+	logger.Warnf("Buffering outbound messages until reconnected")
+	np.outbox.offline = true
+	np.transcations.pauseAll()
+}
+
+// flushOutbox sends the buffered messages in order once the connection reconnected.
+func (np *NatsProtoo) flushOutbox() {
+	np.mutex.Lock()
+	dropped, flushed := np.flushLocked()
+	np.mutex.Unlock()
+	np.failDropped(dropped)
+	if flushed > 0 {
+		logger.Infof("Flushed %d buffered messages", flushed)
+	}
+}
+
+func (np *NatsProtoo) flushLocked() ([]*Transcation, int) {
+	o := np.outbox
+	if o == nil || !o.offline {
+		return nil, 0
+	}
+	np.transcations.resumeAll()
+	var dropped []*Transcation
+	flushed := 0
+	for len(o.entries) > 0 {
+		if o.expired(time.Now()) {
+			dropped = np.dropBuffered(dropped, o.pop(), "expired")
+			continue
+		}
+		msg := np.refreshDeadline(o.entries[0].msg)
+		if err := np.nc.PublishMsg(msg); err != nil {
+			logger.Warnf("Flushing buffered messages stopped: %v", err)
+			np.transcations.pauseAll()
+			offlineBuffered.Set(float64(len(o.entries)))
+			return dropped, flushed
+		}
+		o.pop()
+		flushed++
+	}
+	o.offline = false
+	offlineBuffered.Set(0)
+	return dropped, flushed
+}
+
+// refreshDeadline moves the deadline of a buffered request to the deadline of its resumed
+// timer. Only the deadline keys of the envelope are patched, the others are sent as they
+// were encoded, e.g. by the Downgrade of a VersionAdapter.
+func (np *NatsProtoo) refreshDeadline(msg *nats.Msg) *nats.Msg {
+	id, ok := np.transcationID(msg)
+	if !ok {
+		return msg
+	}
+	deadline, ok := np.transcations.deadline(id)
+	if !ok {
+		return msg
+	}
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Data, &envelope); err != nil || string(envelope["request"]) != "true" {
+		return msg
+	}
+	var refreshed RequestData
+	refreshed.setTimeout(time.Now(), deadline)
+	if _, found := envelope["deadline"]; found {
+		envelope["deadline"], _ = json.Marshal(refreshed.Deadline)
+	}
+	if _, found := envelope["timeout"]; found {
+		envelope["timeout"], _ = json.Marshal(refreshed.Timeout)
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return msg
+	}
+	return &nats.Msg{Subject: msg.Subject, Reply: msg.Reply, Header: msg.Header, Data: payload}
+}
+
+// failDropped fails the requests dropped from the buffer. np.mutex must not be held.
+func (np *NatsProtoo) failDropped(dropped []*Transcation) {
+	for _, transcation := range dropped {
+		transcation.failWith(NewResponseErrData(utils.ErrUnavailable.WithReason("request was dropped from the offline buffer")))
+	}
+}
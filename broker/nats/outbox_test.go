@@ -0,0 +1,138 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mj23978/chat-backend-x/utils"
+	"github.com/nats-io/nats-server/v2/server"
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxOverflow(t *testing.T) {
+	newOfflineProtoo := func(config BufferConfig) *NatsProtoo {
+		config.Enabled = true
+		np := &NatsProtoo{outbox: newOutbox(config), transcations: newTranscationTable(), inbox: "_INBOX.test"}
+		np.outbox.offline = true
+		return np
+	}
+	subjects := func(np *NatsProtoo) []string {
+		var subjects []string
+		for _, entry := range np.outbox.entries {
+			subjects = append(subjects, entry.msg.Subject)
+		}
+		return subjects
+	}
+
+	t.Run("case=drop oldest", func(t *testing.T) {
+		np := newOfflineProtoo(BufferConfig{MaxMessages: 2, Overflow: OverflowDropOldest})
+		failed := make(chan ResponseErrData, 1)
+		transcation := &Transcation{id: 1, done: make(chan struct{}), fail: func(data ResponseErrData) { failed <- data }}
+		np.transcations.add(transcation)
+
+		for _, msg := range []*nats.Msg{{Subject: "a", Reply: np.replySubject(1)}, {Subject: "b"}, {Subject: "c"}} {
+			dropped, err := np.publish(msg)
+			require.NoError(t, err)
+			np.failDropped(dropped)
+		}
+		assert.Equal(t, []string{"b", "c"}, subjects(np))
+		assert.Equal(t, utils.CodeUnavailable, (<-failed).ErrorCode, "a request dropped from the buffer must fail")
+	})
+
+	t.Run("case=reject", func(t *testing.T) {
+		np := newOfflineProtoo(BufferConfig{MaxBytes: 4, Overflow: OverflowReject})
+		_, err := np.publish(&nats.Msg{Subject: "a", Data: []byte("abc")})
+		require.NoError(t, err)
+		_, err = np.publish(&nats.Msg{Subject: "b", Data: []byte("de")})
+		assert.Equal(t, ErrBufferFull, err)
+		assert.Equal(t, []string{"a"}, subjects(np))
+	})
+
+	t.Run("case=ttl", func(t *testing.T) {
+		np := newOfflineProtoo(BufferConfig{TTL: Duration(time.Millisecond)})
+		_, err := np.publish(&nats.Msg{Subject: "a"})
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+		_, err = np.publish(&nats.Msg{Subject: "b"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b"}, subjects(np))
+	})
+}
+
+func TestOutboxReconnect(t *testing.T) {
+	opts := &server.Options{Host: "127.0.0.1", Port: -1}
+	s, err := server.NewServer(opts)
+	require.NoError(t, err)
+	go s.Start()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+	opts.Port = s.Addr().(*net.TCPAddr).Port
+
+	config := NewConfig(s.ClientURL())
+	config.Reconnect.Wait = Duration(20 * time.Millisecond)
+	config.Buffer.Enabled = true
+	client, err := NewNatsProtooWithConfig(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Subscriptions are restored before the buffer is flushed, so the client answers itself.
+	notifications := make(chan string, 10)
+	client.OnBroadcast("room", func(notification Notification, subj string) { notifications <- notification.Method })
+	client.OnRequest("svc", func(request Request, accept RespondFunc, reject RejectFunc) { accept(request.Method) })
+
+	s.Shutdown()
+	require.Eventually(t, func() bool { return client.Status() != nats.CONNECTED }, 5*time.Second, 10*time.Millisecond)
+
+	bc := client.NewBroadcaster("room")
+	for _, method := range []string{"first", "second", "third"} {
+		bc.Say(method, nil)
+	}
+	requestor := client.NewRequestor("svc")
+	requestor.SetRequestTimeout(500 * time.Millisecond)
+	future := requestor.AsyncRequest("typing", nil)
+
+	// Outlast the request timeout while the connection is down.
+	time.Sleep(time.Second)
+	s, err = server.NewServer(opts)
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Shutdown()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	result, rerr := future.Await()
+	require.Nil(t, rerr)
+	assert.Equal(t, `"typing"`, string(result))
+	assert.Equal(t, []string{"first", "second", "third"}, receiveMethods(t, notifications, 3))
+}
+
+func TestRefreshDeadline(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	id := np.transcations.nextID()
+	np.transcations.addWithTimeout(&Transcation{id: id, done: make(chan struct{})}, time.Minute, func() {})
+	defer np.transcations.take(id)
+
+	msg := &nats.Msg{Subject: "svc", Reply: np.replySubject(id), Data: []byte(`{"request":true,"id":1,"method":"send","deadline":1,"legacy":{"kept":true}}`)}
+	var envelope map[string]interface{}
+	require.NoError(t, json.Unmarshal(np.refreshDeadline(msg).Data, &envelope))
+	assert.Equal(t, map[string]interface{}{"kept": true}, envelope["legacy"], "keys of adapters are kept")
+	assert.Greater(t, envelope["deadline"].(float64), float64(time.Now().UnixNano()/int64(time.Millisecond)))
+	assert.NotContains(t, envelope, "timeout", "keys missing from the envelope are not added")
+}
+
+func receiveMethods(t *testing.T, methods chan string, n int) []string {
+	received := make([]string, 0, n)
+	for len(received) < n {
+		select {
+		case method := <-methods:
+			received = append(received, method)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d messages", len(received), n)
+		}
+	}
+	return received
+}
@@ -1,17 +1,20 @@
 package nprotoo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"reflect"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/chuckpreslar/emission"
 	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"github.com/mj23978/chat-backend-x/utils"
 	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
 )
 
 const (
@@ -29,50 +32,170 @@ type NatsProtoo struct {
 	closed             bool
 	requestListener    map[string]RequestFunc
 	broadcastListeners map[string][]BroadCastFunc
+	broadcastSubs      map[string]*nats.Subscription
+	inflight           map[string]context.CancelFunc
+	inflightMutex      sync.Mutex
+	inbox              string
+	transcations       *transcationTable
+	nodeID             string
+	acks               map[int]*ackTracker
+	acksMutex          sync.Mutex
+	seenNotifications  *dedupe
+	js                 nats.JetStreamContext
+	deadLetterSubject  string
+	deadLetterCreds    bool
+	panicHook          PanicFunc
+	outbox             *outbox
+	service            string
+	version            string
+	channels           map[string]ChannelDescription
+	methods            map[string][]MethodDescription
+	roomNamespace      string
+	rooms              map[string]*Room
+	sequences          map[string]*sequencer
+	received           map[string]map[string]*sourceSequence
+	sequenceTTL        time.Duration
+	sequencesExpired   time.Time
+	roomsMutex         sync.Mutex
+	namespace          string
+	permitted          map[string][]string
+	accepted           map[string][]string
+	adapters           map[int]VersionAdapter
+	features           map[string]bool
+	tap                TapSink
+	tapMutex           sync.RWMutex
+	listening          map[*Requestor]bool
 }
 
 // NewNatsProtoo .
 func NewNatsProtoo(server string) *NatsProtoo {
+	np, err := NewNatsProtooWithConfig(NewConfig(server))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return np
+}
+
+// NewNatsProtooWithConfig connects to the servers described by config.
+func NewNatsProtooWithConfig(config *Config) (*NatsProtoo, error) {
 	var np NatsProtoo
 	np.closed = false
+	if !validNamespace(config.Namespace) {
+		return nil, ErrInvalidNamespace
+	}
+	np.namespace = config.Namespace
+	np.permitted = make(map[string][]string)
+	for _, namespace := range config.PermittedNamespaces {
+		if namespace == _EMPTY_ || !validNamespace(namespace) {
+			return nil, ErrInvalidNamespace
+		}
+		np.permitted[namespace] = []string{">"}
+	}
+	np.accepted = make(map[string][]string)
+	for _, namespace := range config.AcceptedNamespaces {
+		if namespace == _EMPTY_ || !validNamespace(namespace) {
+			return nil, ErrInvalidNamespace
+		}
+		np.accepted[namespace] = []string{">"}
+	}
 	// Connect Options.
-	opts := []nats.Option{nats.Name("NATS Protoo")}
-	opts = setupConnOptions(opts)
+	opts, err := config.Options()
+	if err != nil {
+		return nil, err
+	}
+	np.mutex = new(sync.Mutex)
+	np.outbox = newOutbox(config.Buffer)
+	opts = setupConnOptions(&np, opts, config)
 	// Connect to NATS
-	nc, err := nats.Connect(server, opts...)
+	nc, err := nats.Connect(config.Servers(), opts...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	np.nc = nc
+	np.Emitter = *emission.NewEmitter()
+	np.listening = make(map[*Requestor]bool)
+	np.On("close", func(code int, err string) { np.forwardTransport("close", code, err) })
+	np.On("error", func(code int, err string) { np.forwardTransport("error", code, err) })
 	np.nc.SetClosedHandler(func(nc *nats.Conn) {
-		logger.Warnf("%s [%v]", "nats nc closed", nc.LastError)
-		np.Emit("close", 0, nc.LastError().Error)
+		logger.Warnf("%s [%v]", "nats nc closed", nc.LastError())
+		np.Emit("close", 0, errorString(nc.LastError()))
+		np.mutex.Lock()
 		np.closed = true
+		np.mutex.Unlock()
+		np.failPending("nats connection closed")
 	})
-	np.Emitter = *emission.NewEmitter()
-	np.mutex = new(sync.Mutex)
 	np.requestListener = make(map[string]RequestFunc)
 	np.broadcastListeners = make(map[string][]BroadCastFunc)
-	logger.Infof("New Nats Protoo: nats => %s", server)
-	return &np
+	np.broadcastSubs = make(map[string]*nats.Subscription)
+	np.inflight = make(map[string]context.CancelFunc)
+	np.transcations = newTranscationTable()
+	np.acks = make(map[int]*ackTracker)
+	np.nodeID = config.NodeID
+	if np.nodeID == _EMPTY_ {
+		np.nodeID = nuid.Next()
+	}
+	np.seenNotifications = newDedupe(ackDedupeSize)
+	np.deadLetterSubject = config.DeadLetterSubject
+	np.deadLetterCreds = config.DeadLetterCredentials
+	np.service = config.Name
+	np.channels = make(map[string]ChannelDescription)
+	np.methods = make(map[string][]MethodDescription)
+	np.roomNamespace = config.RoomNamespace
+	if np.roomNamespace == _EMPTY_ {
+		np.roomNamespace = DefaultRoomNamespace
+	}
+	np.adapters = defaultVersionAdapters()
+	np.features = make(map[string]bool)
+	np.rooms = make(map[string]*Room)
+	np.sequences = make(map[string]*sequencer)
+	np.received = make(map[string]map[string]*sourceSequence)
+	np.sequenceTTL = sequenceTTL
+	if err := np.subscribeInbox(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if _, err := nc.Subscribe(np.subject(DescribeSubject), np.onRequest); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if _, err := nc.Subscribe(np.subject(CancelSubject), np.onRequest); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if config.Tap.File != _EMPTY_ {
+		sink, err := OpenTapFile(config.Tap.File)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		np.Tap(sink)
+	} else if config.Tap.Subject != _EMPTY_ {
+		np.Tap(NewSubjectTap(&np, config.Tap.Subject))
+	}
+	logger.Infof("New Nats Protoo: nats => %s, namespace => %q", config.Servers(), np.namespace)
+	return &np, nil
 }
 
 func (np *NatsProtoo) NewRequestor(channel string) *Requestor {
-	return newRequestor(channel, np, np.nc)
+	return newRequestor(np.namespace, channel, np)
 }
 
 func (np *NatsProtoo) OnRequest(channel string, listener RequestFunc) {
 	np.mutex.Lock()
 	defer np.mutex.Unlock()
 	if _, found := np.requestListener[channel]; !found {
-		np.nc.QueueSubscribe(channel, _EMPTY_, np.onRequest)
+		np.nc.QueueSubscribe(np.subject(channel), _EMPTY_, np.onRequest)
 		np.nc.Flush()
+		np.registerChannel(ChannelRequest, channel, _EMPTY_, _EMPTY_)
 	}
 	np.requestListener[channel] = listener
 }
 
 func (np *NatsProtoo) NewBroadcaster(channel string) *Broadcaster {
-	return newBroadcaster(channel, np, np.nc)
+	np.mutex.Lock()
+	np.registerChannel(ChannelPublish, channel, _EMPTY_, _EMPTY_)
+	np.mutex.Unlock()
+	return newBroadcaster(np.subject(channel), np, np.nc)
 }
 
 func (np *NatsProtoo) OnBroadcast(channel string, listener BroadCastFunc) {
@@ -80,9 +203,10 @@ func (np *NatsProtoo) OnBroadcast(channel string, listener BroadCastFunc) {
 	defer np.mutex.Unlock()
 
 	if _, found := np.broadcastListeners[channel]; !found {
-		np.nc.QueueSubscribe(channel, _EMPTY_, np.onRequest)
+		np.broadcastSubs[channel], _ = np.nc.QueueSubscribe(np.subject(channel), _EMPTY_, np.onRequest)
 		np.nc.Flush()
 		np.broadcastListeners[channel] = make([]BroadCastFunc, 0)
+		np.registerChannel(ChannelBroadcast, channel, _EMPTY_, _EMPTY_)
 	}
 
 	if !listenerIsContain(np.broadcastListeners[channel], listener) {
@@ -91,134 +215,352 @@ func (np *NatsProtoo) OnBroadcast(channel string, listener BroadCastFunc) {
 	}
 }
 
+// OffBroadcast removes listener from channel. The channel is unsubscribed with its last listener.
+func (np *NatsProtoo) OffBroadcast(channel string, listener BroadCastFunc) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+
+	listeners := np.broadcastListeners[channel]
+	for i, eachListener := range listeners {
+		if reflect.ValueOf(eachListener) == reflect.ValueOf(listener) {
+			listeners = append(listeners[:i:i], listeners[i+1:]...)
+			break
+		}
+	}
+	if len(listeners) > 0 {
+		np.broadcastListeners[channel] = listeners
+		return
+	}
+	if sub, found := np.broadcastSubs[channel]; found && sub != nil {
+		sub.Unsubscribe()
+	}
+	delete(np.broadcastSubs, channel)
+	delete(np.broadcastListeners, channel)
+	delete(np.channels, ChannelBroadcast+" "+channel)
+	delete(np.received, channel)
+	logger.Debugf("OffBroadcast: [channel:%s]", channel)
+}
+
 func (np *NatsProtoo) onRequest(msg *nats.Msg) {
 	logger.Debugf("Got request [subj:%s, reply:%s]: %s", msg.Subject, msg.Reply, string(msg.Data))
-	np.handleMessage(msg.Data, msg.Subject, msg.Reply)
+	np.record(TapInbound, msg)
+	np.handleMessage(msg)
 }
 
-func (np *NatsProtoo) handleMessage(message []byte, subj string, reply string) {
+func (np *NatsProtoo) handleMessage(raw *nats.Msg) {
+	received := time.Now()
 	var msg PeerMsg
-	if err := json.Unmarshal(message, &msg); err != nil {
+	if err := json.Unmarshal(raw.Data, &msg); err != nil {
 		logger.Errorf("np.handleMessage error => %v", err)
+		np.deadLetter(DeadLetterUnmarshal, err.Error(), raw)
 		return
 	}
-	if msg.Request {
-		np.handleRequest(msg.ToRequest(), subj, reply)
+	msg.Metadata = msg.Metadata.merge(raw.Header)
+	version := peerVersion(&msg)
+	if msg.Method != CapabilitiesMethod || !msg.Request {
+		if err := np.upgrade(&msg); err != nil {
+			np.rejectUnsupported(&msg, err, raw)
+			return
+		}
+	}
+	if msg.Cancel {
+		np.handleCancel(msg.ID, raw.Reply)
+	} else if msg.Request {
+		request := msg.ToRequest()
+		request.version = version
+		request.localDeadline(received)
+		np.handleRequest(request, raw)
 	} else if msg.Notification {
-		np.handleBroadcast(msg.ToNotification(), subj, reply)
+		np.handleBroadcast(msg.ToNotification(), raw)
 	}
 }
 
-func (np *NatsProtoo) handleRequest(msg Request, subj string, reply string) {
+func (np *NatsProtoo) handleRequest(msg Request, raw *nats.Msg) {
+	subj, reply := np.channelOf(raw.Subject), raw.Reply
 	logger.Debugf("Handle request [%s]", msg.Method)
-	accept := func(data interface{}) {
-		response, err := NewResponse(msg.ID, data)
-		if err != nil {
-			logger.Errorf("Error building response %v", err)
+	if msg.Expired() {
+		logger.Warnf("Drop expired request [%s] id[%d]", msg.Method, msg.ID)
+		requestsExpired.WithLabelValues(np.methodLabel(subj, msg.Method)).Inc()
+		return
+	}
+	msg, cancel := msg.withContext(context.Background())
+	key := inflightKey(reply, msg.ID)
+	np.inflightMutex.Lock()
+	if deadline, ok := msg.DeadlineTime(); ok {
+		// Requests never answered are forgotten once their deadline passed. The timer waits
+		// for inflightMutex, so it cannot fire before the request was added.
+		timer := time.AfterFunc(time.Until(deadline), func() { np.finishInflight(key) })
+		cancelContext := cancel
+		cancel = func() {
+			timer.Stop()
+			cancelContext()
+		}
+	}
+	np.inflight[key] = cancel
+	np.inflightMutex.Unlock()
+
+	respond := func(response *Response) {
+		expired := msg.Context().Err() != nil
+		if !np.finishInflight(key) || expired {
+			logger.Debugf("Suppress reply of canceled request [%s] id[%d]", msg.Method, msg.ID)
 			return
 		}
-		payload, err := json.Marshal(response)
+		payload, err := np.encodeResponse(response, msg.version)
 		if err != nil {
 			logger.Errorf("Marshal %v", err)
 			return
 		}
-		//send accept
-		logger.Debugf("Accept [%s] => (%s)", msg.Method, payload)
 		np.Reply(payload, reply)
 	}
 
-	reject := func(errorCode int, errorReason string) {
-		response := NewResponseErr(msg.ID, errorCode, errorReason)
-		payload, err := json.Marshal(response)
+	rejectErr := func(e error) {
+		response := NewResponseErrFromError(msg.ID, e)
+		//send reject
+		logger.Debugf("Reject [%s] => (errorCode:%d, errorReason:%s)", msg.Method, response.ErrorCode, response.ErrorReason)
+		respond(response)
+	}
+
+	accept := func(data interface{}) {
+		if e, ok := data.(error); ok {
+			rejectErr(e)
+			return
+		}
+		response, err := NewResponse(msg.ID, data)
 		if err != nil {
-			logger.Errorf("Marshal %v", err)
+			logger.Errorf("Error building response %v", err)
 			return
 		}
+		//send accept
+		logger.Debugf("Accept [%s] => (%s)", msg.Method, response.Data)
+		respond(response)
+	}
+
+	reject := func(errorCode int, errorReason string) {
+		response := NewResponseErr(msg.ID, errorCode, errorReason)
 		//send reject
 		logger.Debugf("Reject [%s] => (errorCode:%d, errorReason:%s)", msg.Method, errorCode, errorReason)
-		np.Reply(payload, reply)
+		respond(response)
 	}
 
-	if listener, found := np.requestListener[subj]; found {
-		listener(msg, accept, reject)
+	if caller, ok := np.callerNamespace(msg.Metadata, subj); !ok {
+		logger.Warnf("Reject request [%s] from namespace %q to %s, not accepted", msg.Method, caller, subj)
+		rejectErr(utils.ErrForbidden.WithReasonf("Requests from namespace %q to %s are not accepted", caller, subj))
+		return
+	}
+	np.mutex.Lock()
+	listener, found := np.requestListener[subj]
+	np.mutex.Unlock()
+	if msg.Method == DescribeMethod {
+		accept(np.Describe())
+	} else if msg.Method == CapabilitiesMethod {
+		accept(np.Capabilities())
+	} else if found {
+		panicked := np.safely(ListenerRequest, msg.Method, raw, func() {
+			listener(msg, accept, reject)
+		})
+		if panicked {
+			rejectErr(&utils.ErrInternalServerError)
+		}
 	} else {
-		reject(500, fmt.Sprintf("Not found listener for %s!", subj))
+		err := ErrNoListener.WithErrorf("Not found listener for %s!", subj)
+		np.deadLetter(DeadLetterNoListener, err.Error(), raw)
+		rejectErr(err)
 	}
 }
 
-func (np *NatsProtoo) handleBroadcast(data Notification, subj string, reply string) {
+// handleCancel cancels the context of the request id sent from reply and suppresses its response.
+func (np *NatsProtoo) handleCancel(id int, reply string) {
+	if np.finishInflight(inflightKey(reply, id)) {
+		logger.Debugf("Canceled request id[%d] from [%s]", id, reply)
+	}
+}
+
+// finishInflight cancels the context of an in-flight request and forgets it.
+// It returns false if the request was already finished or canceled.
+func (np *NatsProtoo) finishInflight(key string) bool {
+	np.inflightMutex.Lock()
+	cancel, found := np.inflight[key]
+	delete(np.inflight, key)
+	np.inflightMutex.Unlock()
+	if found {
+		cancel()
+	}
+	return found
+}
+
+func inflightKey(reply string, id int) string {
+	return reply + "#" + strconv.Itoa(id)
+}
+
+func (np *NatsProtoo) handleBroadcast(data Notification, raw *nats.Msg) {
+	subj, reply := np.channelOf(raw.Subject), raw.Reply
 	logger.Debugf("Handle broadcast [%s] %v", data.Method, string(data.Data))
-	if listeners, found := np.broadcastListeners[subj]; found {
+	if caller, ok := np.callerNamespace(data.Metadata, subj); !ok {
+		np.deadLetter(DeadLetterNamespaceNotAccepted, "broadcast from namespace "+strconv.Quote(caller)+" is not accepted", raw)
+		return
+	}
+	np.mutex.Lock()
+	listeners, found := np.broadcastListeners[subj]
+	np.mutex.Unlock()
+	if found {
+		if data.AckRequired && np.seenNotifications.seenBefore(reply) {
+			logger.Debugf("Ack duplicate notification [%s] id[%d]", data.Method, data.ID)
+			np.sendAck(data.ID, reply)
+			return
+		}
+		deliver, gap := np.checkSequence(subj, &data)
+		if !deliver {
+			logger.Debugf("Drop duplicate notification [%s] seq[%d] source[%s]", data.Method, data.Seq, data.Source)
+			if data.AckRequired {
+				np.sendAck(data.ID, reply)
+			}
+			return
+		}
+		if gap != nil {
+			logger.Warnf("Missed notifications %d-%d of %s on %s", gap.From, gap.To, gap.Source, subj)
+			np.Emit(GapEvent, *gap)
+			for _, listener := range listeners {
+				np.safely(ListenerBroadcast, GapMethod, raw, func() {
+					listener(gapNotification(gap), subj)
+				})
+			}
+		}
 		for _, listener := range listeners {
-			listener(data, subj)
+			np.safely(ListenerBroadcast, data.Method, raw, func() {
+				listener(data, subj)
+			})
+		}
+		if data.AckRequired {
+			np.sendAck(data.ID, reply)
 		}
 	} else {
 		logger.Warnf("handleBroadcast: Not found any callbacks!")
+		np.deadLetter(DeadLetterNoListener, "Not found any callbacks for "+subj, raw)
 	}
 }
 
+// NodeID returns the ID this NatsProtoo acks notifications with.
+func (np *NatsProtoo) NodeID() string {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	return np.nodeID
+}
+
+// SetNodeID sets the ID this NatsProtoo acks notifications with, e.g. the "id" of its
+// discovery node. It defaults to a random ID.
+func (np *NatsProtoo) SetNodeID(id string) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.nodeID = id
+}
+
 // Close .
 func (np *NatsProtoo) Close() {
+	np.Untap()
 	np.mutex.Lock()
 	defer np.mutex.Unlock()
 	if np.closed == false {
-		logger.Infof("Close nats nc now : ", np)
+		logger.Infof("Close nats nc now : %s", np.nc.ConnectedUrl())
 		np.nc.Close()
 		np.closed = true
 	} else {
-		logger.Warnf("Transport already closed :", np)
+		logger.Warnf("Transport already closed : %s", np.nc.ConnectedUrl())
 	}
 }
 
+// Closed reports whether the transport was closed.
+func (np *NatsProtoo) Closed() bool {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	return np.closed
+}
+
+// Status returns the state of the underlying nats connection.
+func (np *NatsProtoo) Status() nats.Status {
+	return np.nc.Status()
+}
+
+// RTT returns the round trip time to the connected nats server.
+func (np *NatsProtoo) RTT() (time.Duration, error) {
+	return np.nc.RTT()
+}
+
 // Send .
 func (np *NatsProtoo) Send(message []byte, subj string, reply string) error {
+	return np.send(message, subj, reply, nil)
+}
+
+func (np *NatsProtoo) send(message []byte, subj string, reply string, header nats.Header) error {
 	logger.Debugf("Send: %s", string(message))
+	return np.publishMsg(&nats.Msg{Subject: subj, Reply: reply, Data: message, Header: header})
+}
+
+func (np *NatsProtoo) publishMsg(msg *nats.Msg) error {
 	np.mutex.Lock()
-	defer np.mutex.Unlock()
 	if np.closed {
+		np.mutex.Unlock()
 		return errors.New("websocket: write closed")
 	}
-	err := np.nc.PublishRequest(subj, reply, message)
-	if err != nil {
-		if np.nc.LastError() != nil {
-			log.Fatalf("%v for request", np.nc.LastError())
-		}
-		log.Fatalf("%v for request", err)
-		return err
+	dropped, err := np.publish(msg)
+	np.mutex.Unlock()
+	np.failDropped(dropped)
+	if err == nil {
+		np.record(TapOutbound, msg)
+	}
+	return err
+}
+
+// encode marshals msg for sending. The metadata in common moves into NATS headers
+// when the server supports them, otherwise it stays in the envelope.
+func (np *NatsProtoo) encode(msg interface{}, common *CommonData) ([]byte, nats.Header, error) {
+	if common.Version == 0 {
+		common.Version = ProtocolVersion
+	}
+	var header nats.Header
+	if len(common.Metadata) > 0 && np.nc.HeadersSupported() {
+		header = common.Metadata.header()
+		md := common.Metadata
+		common.Metadata = nil
+		defer func() { common.Metadata = md }()
 	}
-	return nil
+	payload, err := json.Marshal(msg)
+	return payload, header, err
+}
+
+// encodeResponse encodes response for a requestor of version.
+func (np *NatsProtoo) encodeResponse(response *Response, version int) ([]byte, error) {
+	var payload []byte
+	var err error
+	if version < ProtocolVersion {
+		payload, _, err = np.encodeAt(&PeerMsg{ResponseData: response.ResponseData, CommonData: response.CommonData}, version)
+	} else {
+		payload, _, err = np.encode(response, &response.CommonData)
+	}
+	return payload, err
 }
 
 // Reply .
 func (np *NatsProtoo) Reply(message []byte, reply string) error {
 	logger.Debugf("Reply: %s", string(message))
-	np.mutex.Lock()
-	defer np.mutex.Unlock()
-	if np.closed {
-		return errors.New("websocket: write closed")
-	}
-	err := np.nc.Publish(reply, message)
-	if err != nil {
-		if np.nc.LastError() != nil {
-			log.Fatalf("%v for request", np.nc.LastError())
-		}
-		log.Fatalf("%v for request", err)
-		return err
-	}
-	return nil
+	return np.publishMsg(&nats.Msg{Subject: reply, Data: message})
 }
 
-func setupConnOptions(opts []nats.Option) []nats.Option {
-	totalWait := 10 * time.Minute
-	reconnectDelay := time.Second
+func setupConnOptions(np *NatsProtoo, opts []nats.Option, config *Config) []nats.Option {
+	reconnectDelay := config.Reconnect.Wait.Duration()
+	if reconnectDelay <= 0 {
+		reconnectDelay = DefaultReconnectWait
+	}
+	totalWait := time.Duration(config.Reconnect.MaxAttempts) * reconnectDelay
 
-	opts = append(opts, nats.ReconnectWait(reconnectDelay))
-	opts = append(opts, nats.MaxReconnects(int(totalWait/reconnectDelay)))
 	opts = append(opts, nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
 		log.Printf("Disconnected due to: %s, will attempt reconnects for %.0fm", err, totalWait.Minutes())
+		np.mutex.Lock()
+		np.goOffline()
+		np.mutex.Unlock()
 	}))
 	opts = append(opts, nats.ReconnectHandler(func(nc *nats.Conn) {
 		log.Printf("Reconnected [%s]", nc.ConnectedUrl())
+		np.flushOutbox()
 	}))
 	opts = append(opts, nats.ClosedHandler(func(nc *nats.Conn) {
 		log.Fatalf("Exiting: %v", nc.LastError())
@@ -227,6 +569,13 @@ func setupConnOptions(opts []nats.Option) []nats.Option {
 	return opts
 }
 
+func errorString(err error) string {
+	if err == nil {
+		return _EMPTY_
+	}
+	return err.Error()
+}
+
 func listenerIsContain(items []BroadCastFunc, item BroadCastFunc) bool {
 	for _, eachItem := range items {
 		if reflect.ValueOf(eachItem) == reflect.ValueOf(item) {
@@ -0,0 +1,52 @@
+package nprotoo
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	nats "github.com/nats-io/nats.go"
+)
+
+// Kinds of listeners a panic is recovered from.
+const (
+	ListenerRequest   = "request"
+	ListenerBroadcast = "broadcast"
+)
+
+// PanicFunc is called after a panic of a listener was recovered. kind is ListenerRequest or
+// ListenerBroadcast, recovered the value passed to panic and stack the stack of the listener.
+type PanicFunc func(kind string, subj string, method string, recovered interface{}, stack []byte)
+
+// OnPanic sets the hook called when a listener panics, e.g. to report the panic to an error
+// tracker. Panics are always recovered, logged and counted, with or without a hook.
+func (np *NatsProtoo) OnPanic(hook PanicFunc) *NatsProtoo {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.panicHook = hook
+	return np
+}
+
+// safely calls listener and recovers from its panic. It reports whether listener panicked.
+func (np *NatsProtoo) safely(kind string, method string, raw *nats.Msg, listener func()) (panicked bool) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		panicked = true
+		stack := debug.Stack()
+		logger.Errorf("Recovered panic in %s listener [%s] of %s: %v\n%s", kind, method, raw.Subject, recovered, stack)
+		listenerPanics.WithLabelValues(kind).Inc()
+		np.deadLetter(DeadLetterPanic, fmt.Sprint(recovered), raw)
+
+		np.mutex.Lock()
+		hook := np.panicHook
+		np.mutex.Unlock()
+		if hook != nil {
+			hook(kind, raw.Subject, method, recovered, stack)
+		}
+	}()
+	listener()
+	return false
+}
@@ -0,0 +1,49 @@
+package nprotoo
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mj23978/chat-backend-x/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerPanics(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+
+	var mutex sync.Mutex
+	var kinds []string
+	np.OnPanic(func(kind string, subj string, method string, recovered interface{}, stack []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		kinds = append(kinds, kind)
+		assert.Equal(t, "boom", recovered)
+		assert.NotEmpty(t, stack)
+	})
+
+	np.OnRequest("svc", func(request Request, accept RespondFunc, reject RejectFunc) { panic("boom") })
+	_, err := np.NewRequestor("svc").SyncRequest("explode", nil)
+	require.NotNil(t, err)
+	assert.Equal(t, utils.CodeInternalServerError, err.Code)
+	assert.Equal(t, utils.ErrInternalServerError.Error(), err.Reason)
+	assert.NotContains(t, err.Detailed().Debug(), "boom")
+
+	delivered := make(chan Notification, 1)
+	np.OnBroadcast("room", func(notification Notification, subj string) { panic("boom") })
+	np.OnBroadcast("room", func(notification Notification, subj string) { delivered <- notification })
+	np.NewBroadcaster("room").Say("message", "hello")
+	select {
+	case notification := <-delivered:
+		assert.Equal(t, "message", notification.Method)
+	case <-time.After(5 * time.Second):
+		t.Fatal("a panicking listener must not stop the other listeners")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{ListenerRequest, ListenerBroadcast}, kinds)
+}
@@ -1,6 +1,7 @@
 package nprotoo
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -8,51 +9,116 @@ import (
 
 	"github.com/chuckpreslar/emission"
 	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"github.com/mj23978/chat-backend-x/utils"
 	nats "github.com/nats-io/nats.go"
 )
 
 const (
 	// DefaultRequestTimeout .
 	DefaultRequestTimeout = 15 * time.Second
+	// ErrorCodeCanceled is the error code of requests canceled by their context.
+	ErrorCodeCanceled = 499
+	// CancelSubject is subscribed by every NatsProtoo without queue group. Cancels are sent
+	// to it instead of the channel of the request, so they are received while a handler of
+	// the channel is still running.
+	CancelSubject = "_NPROTOO.cancel"
+	// ErrorCodeTimeout is the error code of requests which timed out. It is kept from the
+	// first protocol version, gateways map it to 504 Gateway Timeout.
+	ErrorCodeTimeout = 480
+	// ErrorCodeNoListener is the error code of requests to channels without a listener.
+	ErrorCodeNoListener = 500
 )
 
-// Requestor .
+// ErrNoListener is returned to requests for channels or methods nothing listens to.
+var ErrNoListener = utils.NewDetailedError(ErrorCodeNoListener, "no listener")
+
+// Requestor sends requests to a channel. Responses are received on the single reply
+// inbox of its NatsProtoo, which makes requestors cheap to create per call.
 type Requestor struct {
 	emission.Emitter
-	subj         string
-	reply        string
-	nc           *nats.Conn
-	np           *NatsProtoo
-	timeout      time.Duration
-	transcations map[int]*Transcation
-	mutex        *sync.Mutex
+	// subj is the subject of channel in namespace.
+	subj      string
+	namespace string
+	channel   string
+	np        *NatsProtoo
+	timeout   time.Duration
+	mutex     *sync.Mutex
+	hedge     *hedge
+	// version is the protocol version of the requests, see Negotiate.
+	version int
 }
 
-func newRequestor(channel string, np *NatsProtoo, nc *nats.Conn) *Requestor {
+func newRequestor(namespace string, channel string, np *NatsProtoo) *Requestor {
 	var req Requestor
 	req.Emitter = *emission.NewEmitter()
 	req.mutex = new(sync.Mutex)
-	req.subj = channel
+	req.subj = namespaced(namespace, channel)
+	req.namespace = namespace
+	req.channel = channel
 	req.np = np
 	req.timeout = DefaultRequestTimeout
-	req.np.On("close", func(code int, err string) {
-		logger.Infof("Transport closed [%d] %s", code, err)
-		req.Emit("close", code, err)
-	})
-	req.np.On("error", func(code int, err string) {
-		logger.Warnf("Transport got error (%d, %s)", code, err)
-		req.Emit("error", code, err)
-	})
-	req.nc = nc
-	// Sub reply inbox.
-	random, _ := GenerateRandomString(12)
-	req.reply = "requestor-id-" + random
-	req.nc.QueueSubscribe(req.reply, _EMPTY_, req.onReply)
-	req.nc.Flush()
-	req.transcations = make(map[int]*Transcation)
+	req.version = ProtocolVersion
 	return &req
 }
 
+// On registers listener for event. The transport events "close" and "error" of the
+// NatsProtoo are forwarded to the requestors which listen to them.
+func (req *Requestor) On(event, listener interface{}) *emission.Emitter {
+	req.listen(event)
+	return req.Emitter.On(event, listener)
+}
+
+// AddListener is an alias of On.
+func (req *Requestor) AddListener(event, listener interface{}) *emission.Emitter {
+	return req.On(event, listener)
+}
+
+// Once registers listener for the next event only.
+func (req *Requestor) Once(event, listener interface{}) *emission.Emitter {
+	req.listen(event)
+	return req.Emitter.Once(event, listener)
+}
+
+// Off removes listener. A requestor without transport listeners is no longer forwarded to.
+func (req *Requestor) Off(event, listener interface{}) *emission.Emitter {
+	req.Emitter.Off(event, listener)
+	if req.GetListenerCount("close") == 0 && req.GetListenerCount("error") == 0 {
+		req.np.mutex.Lock()
+		delete(req.np.listening, req)
+		req.np.mutex.Unlock()
+	}
+	return &req.Emitter
+}
+
+// RemoveListener is an alias of Off.
+func (req *Requestor) RemoveListener(event, listener interface{}) *emission.Emitter {
+	return req.Off(event, listener)
+}
+
+// listen forwards the transport events to the requestor once it listens to one. Only the
+// requestors with listeners are kept, not the ones created per call.
+func (req *Requestor) listen(event interface{}) {
+	if event != "close" && event != "error" {
+		return
+	}
+	req.np.mutex.Lock()
+	req.np.listening[req] = true
+	req.np.mutex.Unlock()
+}
+
+// forwardTransport emits a transport event on every requestor listening to it.
+func (np *NatsProtoo) forwardTransport(event string, code int, err string) {
+	np.mutex.Lock()
+	requestors := make([]*Requestor, 0, len(np.listening))
+	for req := range np.listening {
+		requestors = append(requestors, req)
+	}
+	np.mutex.Unlock()
+	for _, req := range requestors {
+		req.Emit(event, code, err)
+	}
+}
+
 // SetRequestTimeout .
 func (req *Requestor) SetRequestTimeout(d time.Duration) {
 	req.mutex.Lock()
@@ -62,52 +128,138 @@ func (req *Requestor) SetRequestTimeout(d time.Duration) {
 
 // Request .
 func (req *Requestor) Request(method string, data interface{}, success AcceptFunc, reject RejectFunc) {
-	id := GenerateRandomNumber()
+	req.RequestContext(context.Background(), method, data, success, reject)
+}
+
+// RequestContext sends a request bound to ctx. The deadline of ctx is propagated to the handler, and
+// once ctx is done before a response arrived the handler is told to cancel and reject is called.
+func (req *Requestor) RequestContext(ctx context.Context, method string, data interface{}, success AcceptFunc, reject RejectFunc) {
+	if req.hedged(method) != nil {
+		req.AsyncRequestContext(ctx, method, data).Then(success, func(err *Error) {
+			reject(err.Code, err.Reason)
+		})
+		return
+	}
+	req.request(ctx, method, data, success, reject, nil)
+}
+
+func (req *Requestor) request(ctx context.Context, method string, data interface{}, success AcceptFunc, reject RejectFunc, fail func(data ResponseErrData)) {
+	id := req.np.transcations.nextID()
+	transcation := &Transcation{
+		id:     id,
+		accept: success,
+		reject: reject,
+		fail:   fail,
+		done:   make(chan struct{}),
+		close: func() {
+			logger.Infof("Transport closed !")
+		},
+	}
 	dataStr, err := json.Marshal(data)
 	if err != nil {
 		logger.Errorf("Marshal data %v", err)
+		transcation.failWith(NewResponseErrData(utils.ErrBadRequest.WithReasonf("Marshal data of [%s]: %v", method, err)))
 		return
 	}
+	req.mutex.Lock()
+	timeout := req.timeout
+	req.mutex.Unlock()
+	now := time.Now()
+	deadline := now.Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
 	request := &Request{
-		RequestData: RequestData{
-			Request: true,
-		},
+		RequestData: RequestData{Request: true},
 		CommonData: CommonData{
-			ID:     id,
-			Method: method,
-			Data:   dataStr,
+			ID:       id,
+			Method:   method,
+			Data:     dataStr,
+			Metadata: req.np.fromNamespace(req.namespace, MetadataFromContext(ctx)),
 		},
 	}
-	payload, err := json.Marshal(request)
+	request.setTimeout(now, deadline)
+	payload, header, err := req.encode(request)
 	if err != nil {
 		logger.Errorf("Marshal %v", err)
+		transcation.failWith(NewResponseErrData(utils.ErrInternalServerError.WithReasonf("Encode request [%s]: %v", method, err)))
 		return
 	}
 
-	transcation := &Transcation{
-		id:     id,
-		accept: success,
-		reject: reject,
-		close: func() {
-			logger.Infof("Transport closed !")
-		},
-	}
-
-	{
-		req.mutex.Lock()
-		defer req.mutex.Unlock()
-		req.transcations[id] = transcation
-		transcation.timer = time.AfterFunc(req.timeout, func() {
-			logger.Debugf("Request timeout transcation[%d]", transcation.id)
-			transcation.reject(480, fmt.Sprintf("Request timeout %fs transcation[%d], method[%s]", req.timeout.Seconds(), transcation.id, method))
-			req.mutex.Lock()
-			defer req.mutex.Unlock()
-			delete(req.transcations, id)
+	req.np.transcations.addWithTimeout(transcation, timeout, func() {
+		if req.np.transcations.take(id) == nil {
+			return
+		}
+		logger.Debugf("Request timeout transcation[%d]", transcation.id)
+		req.sendCancel(id)
+		transcation.failWith(ResponseErrData{
+			ErrorCode:   ErrorCodeTimeout,
+			ErrorReason: fmt.Sprintf("Request timeout %fs transcation[%d], method[%s]", timeout.Seconds(), transcation.id, method),
 		})
+	})
+
+	if ctx.Done() != nil {
+		go req.watchContext(ctx, transcation, method)
 	}
 
 	logger.Debugf("Send request [%s]", method)
-	req.np.Send(payload, req.subj, req.reply)
+	if err := req.np.send(payload, req.subj, req.np.replySubject(id), header); err != nil {
+		// The request never left, so it fails now instead of at its timeout.
+		if req.np.transcations.take(id) == nil {
+			return
+		}
+		logger.Warnf("Send request [%s] transcation[%d]: %v", method, id, err)
+		transcation.failWith(NewResponseErrData(utils.ErrUnavailable.WithReasonf("Send request [%s]: %v", method, err)))
+	}
+}
+
+// watchContext cancels the transcation once ctx is done before it finished.
+func (req *Requestor) watchContext(ctx context.Context, transcation *Transcation, method string) {
+	select {
+	case <-transcation.done:
+		return
+	case <-ctx.Done():
+	}
+	if req.np.transcations.take(transcation.id) == nil {
+		return
+	}
+	logger.Debugf("Request canceled transcation[%d]", transcation.id)
+	req.sendCancel(transcation.id)
+
+	code := ErrorCodeCanceled
+	if ctx.Err() == context.DeadlineExceeded {
+		code = ErrorCodeTimeout
+	}
+	transcation.failWith(ResponseErrData{
+		ErrorCode:   code,
+		ErrorReason: fmt.Sprintf("Request %v transcation[%d], method[%s]", ctx.Err(), transcation.id, method),
+	})
+}
+
+func (req *Requestor) sendCancel(id int) {
+	req.mutex.Lock()
+	version := req.version
+	req.mutex.Unlock()
+	payload, _, err := req.np.encodeAt(&PeerMsg{
+		CancelData: CancelData{Cancel: true},
+		CommonData: CommonData{ID: id},
+	}, version)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	req.np.Send(payload, namespaced(req.namespace, CancelSubject), req.np.replySubject(id))
+}
+
+// encode encodes request with the protocol version of the requestor.
+func (req *Requestor) encode(request *Request) ([]byte, nats.Header, error) {
+	req.mutex.Lock()
+	version := req.version
+	req.mutex.Unlock()
+	if version == ProtocolVersion {
+		return req.np.encode(request, &request.CommonData)
+	}
+	return req.np.encodeAt(&PeerMsg{RequestData: request.RequestData, CommonData: request.CommonData}, version)
 }
 
 // SyncRequest .
@@ -115,60 +267,40 @@ func (req *Requestor) SyncRequest(method string, data interface{}) (RawMessage,
 	return req.AsyncRequest(method, data).Await()
 }
 
+// SyncRequestContext is SyncRequest bound to ctx, see RequestContext.
+func (req *Requestor) SyncRequestContext(ctx context.Context, method string, data interface{}) (RawMessage, *Error) {
+	return req.AsyncRequestContext(ctx, method, data).Await()
+}
+
 // AsyncRequest .
 func (req *Requestor) AsyncRequest(method string, data interface{}) *Future {
+	return req.AsyncRequestContext(context.Background(), method, data)
+}
+
+// AsyncRequestContext is AsyncRequest bound to ctx, see RequestContext.
+func (req *Requestor) AsyncRequestContext(ctx context.Context, method string, data interface{}) *Future {
 	var future = NewFuture()
-	req.Request(method, data,
+	if h := req.hedged(method); h != nil {
+		go req.hedgedRequest(ctx, h, method, data, future)
+		return future
+	}
+	req.request(ctx, method, data,
 		func(resultData RawMessage) {
 			logger.Debugf("RequestAsFuture: accept [%v]", data)
 			future.resolve(resultData)
 		},
-		func(code int, reason string) {
-			logger.Debugf("RequestAsFuture: reject [%d:%s]", code, reason)
-			future.reject(&Error{code, reason})
+		nil,
+		func(errData ResponseErrData) {
+			logger.Debugf("RequestAsFuture: reject [%d:%s]", errData.ErrorCode, errData.ErrorReason)
+			future.reject(newError(errData))
 		})
 	return future
 }
 
-func (req *Requestor) onReply(msg *nats.Msg) {
-	logger.Debugf("Got response [subj:%s, reply:%s]: %s", msg.Subject, msg.Reply, string(msg.Data))
-	req.handleMessage(msg.Data, msg.Subject, msg.Reply)
-}
-
-func (req *Requestor) handleMessage(message []byte, subj string, reply string) {
-	var msg PeerMsg
-	if err := json.Unmarshal(message, &msg); err != nil {
-		logger.Errorf("handleMessage PeerMsg Unmarshal %v", err)
-		return
-	}
-
-	if msg.Response {
-		var data Response
-		if err := json.Unmarshal(message, &data); err != nil {
-			logger.Errorf("handleMessage Response Unmarshal %v", err)
-			return
-		}
-		req.handleResponse(data)
-	}
-}
-
-func (req *Requestor) handleResponse(response Response) {
-	req.mutex.Lock()
-	defer req.mutex.Unlock()
-	transcation := req.transcations[response.ID]
-
-	if transcation == nil {
-		logger.Errorf("received response does not match any sent request [id:%d]", response.ID)
+func (t *Transcation) failWith(data ResponseErrData) {
+	if t.fail != nil {
+		t.fail(data)
 		return
 	}
-
-	transcation.timer.Stop()
-
-	if response.Ok {
-		transcation.accept(response.Data)
-	} else {
-		transcation.reject(response.ErrorCode, response.ErrorReason)
-	}
-
-	delete(req.transcations, response.ID)
+	t.reject(data.ErrorCode, data.ErrorReason)
 }
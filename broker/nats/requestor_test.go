@@ -0,0 +1,171 @@
+package nprotoo
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mj23978/chat-backend-x/utils"
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func inflightCount(np *NatsProtoo) int {
+	np.inflightMutex.Lock()
+	defer np.inflightMutex.Unlock()
+	return len(np.inflight)
+}
+
+func TestRequestCancel(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	canceled := make(chan error, 1)
+	np.OnRequest("rpc-slow", func(request Request, accept RespondFunc, reject RejectFunc) {
+		// The handler blocks the subscription of the channel until it is canceled.
+		select {
+		case <-request.Context().Done():
+			canceled <- request.Context().Err()
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+		}
+		accept("too late")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	future := np.NewRequestor("rpc-slow").AsyncRequestContext(ctx, "wait", nil)
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	_, rerr := future.Await()
+	require.NotNil(t, rerr)
+	assert.Equal(t, ErrorCodeCanceled, rerr.Code)
+	select {
+	case err := <-canceled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not canceled")
+	}
+	assert.Eventually(t, func() bool { return inflightCount(np) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRequestCancelSuppressesReply(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	release := make(chan struct{})
+	np.OnRequest("rpc-slow", func(request Request, accept RespondFunc, reject RejectFunc) {
+		<-request.Context().Done()
+		<-release
+		accept("too late")
+	})
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	inbox := nats.NewInbox()
+	replies, err := nc.SubscribeSync(inbox)
+	require.NoError(t, err)
+	require.NoError(t, nc.PublishRequest("rpc-slow", inbox, []byte(`{"v":2,"request":true,"id":7,"method":"wait","data":null}`)))
+	require.NoError(t, nc.PublishRequest(CancelSubject, inbox, []byte(`{"v":2,"cancel":true,"id":7}`)))
+	require.NoError(t, nc.Flush())
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	_, err = replies.NextMsg(300 * time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err, "the reply of a canceled request is suppressed")
+}
+
+func TestRequestTimeoutCancelsHandler(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	canceled := make(chan struct{})
+	np.OnRequest("rpc-stuck", func(request Request, accept RespondFunc, reject RejectFunc) {
+		go func() {
+			<-request.Context().Done()
+			close(canceled)
+		}()
+	})
+
+	requestor := np.NewRequestor("rpc-stuck")
+	requestor.SetRequestTimeout(100 * time.Millisecond)
+	_, rerr := requestor.SyncRequest("never", nil)
+	require.NotNil(t, rerr)
+	assert.Equal(t, ErrorCodeTimeout, rerr.Code)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not canceled after the timeout")
+	}
+	assert.Eventually(t, func() bool { return inflightCount(np) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRequestDeadlineForgetsInflight(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	np.OnRequest("rpc-stuck", func(request Request, accept RespondFunc, reject RejectFunc) {})
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	var request PeerMsg
+	request.Request, request.ID, request.Method = true, 1, "never"
+	request.setTimeout(time.Now(), time.Now().Add(100*time.Millisecond))
+	payload, err := json.Marshal(&request)
+	require.NoError(t, err)
+	require.NoError(t, nc.PublishRequest("rpc-stuck", nats.NewInbox(), payload))
+
+	assert.Eventually(t, func() bool { return inflightCount(np) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return inflightCount(np) == 0 }, time.Second, 10*time.Millisecond,
+		"requests without cancel are forgotten after their deadline")
+}
+
+func TestRequestSendFailure(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	requestor := np.NewRequestor("rpc-closed")
+
+	start := time.Now()
+	_, rerr := requestor.SyncRequest("marshal", make(chan int))
+	require.NotNil(t, rerr)
+	assert.Equal(t, utils.CodeBadRequest, rerr.Code)
+
+	np.Close()
+	_, rerr = requestor.SyncRequest("closed", nil)
+	require.NotNil(t, rerr)
+	assert.Equal(t, utils.CodeUnavailable, rerr.Code)
+	assert.True(t, time.Since(start) < time.Second, "requests which could not be sent fail before their timeout")
+}
+
+func TestRequestorTransportEvents(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	closed := make(chan int, 2)
+	listener := func(code int, err string) { closed <- code }
+	requestor := np.NewRequestor("rpc-events")
+	requestor.On("close", listener)
+	for i := 0; i < 10; i++ {
+		np.NewRequestor("rpc-per-call")
+	}
+	other := np.NewRequestor("rpc-other")
+	other.On("close", listener)
+	other.Off("close", listener)
+	np.mutex.Lock()
+	assert.Len(t, np.listening, 1, "only the requestors listening to transport events are kept")
+	np.mutex.Unlock()
+
+	np.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close was not forwarded")
+	}
+	select {
+	case <-closed:
+		t.Fatal("close was forwarded to a requestor without listeners")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
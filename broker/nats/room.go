@@ -0,0 +1,227 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	nats "github.com/nats-io/nats.go"
+)
+
+// Types of room events, sent as the method of their notification.
+const (
+	RoomJoin    = "join"
+	RoomLeave   = "leave"
+	RoomMessage = "message"
+	// RoomGap is delivered to the members when room events were missed. Its Data is the Gap,
+	// Member and Node are empty.
+	RoomGap = "gap"
+)
+
+// ErrInvalidRoom is returned for room IDs which are empty or not a single subject token.
+var ErrInvalidRoom = errors.New("nprotoo: room ID must be a non-empty subject token")
+
+// RoomEvent is broadcast to every member of a room.
+type RoomEvent struct {
+	Type   string     `json:"type"`
+	Room   string     `json:"room"`
+	Member string     `json:"member"`
+	Data   RawMessage `json:"data,omitempty"`
+	// Node is the ID of the NatsProtoo which sent the event.
+	Node      string    `json:"node"`
+	Timestamp time.Time `json:"timestamp"`
+	// Metadata of the notification the event was received with.
+	Metadata Metadata `json:"-"`
+	// Seq is the sequence number of the event among those sent to the room by Node.
+	Seq uint64 `json:"-"`
+}
+
+// RoomFunc receives the events of a room joined by a local member.
+type RoomFunc func(event RoomEvent)
+
+// Room is a room with members connected to this node. A node subscribes to the subject of
+// a room only while it holds members of it, so room events are only delivered to nodes
+// which have members to dispatch them to.
+type Room struct {
+	*RoomBroadcaster
+	mutex    sync.Mutex
+	members  map[string]RoomFunc
+	listener BroadCastFunc
+}
+
+// RoomBroadcaster sends the events of a room. It does not require to be a member of it.
+// Its events are sequenced, see Broadcaster.WithSequence.
+type RoomBroadcaster struct {
+	np *NatsProtoo
+	bc *Broadcaster
+	id string
+}
+
+func validRoomID(room string) bool {
+	return room != _EMPTY_ && !strings.ContainsAny(room, ".*> \t\r\n")
+}
+
+// RoomSubject returns the subject the events of room are broadcast on.
+func (np *NatsProtoo) RoomSubject(room string) string {
+	return np.roomNamespace + "." + room
+}
+
+// NewRoomBroadcaster returns a broadcaster of the events of room.
+func (np *NatsProtoo) NewRoomBroadcaster(room string) (*RoomBroadcaster, error) {
+	if !validRoomID(room) {
+		return nil, ErrInvalidRoom
+	}
+	return &RoomBroadcaster{np: np, bc: np.NewBroadcaster(np.RoomSubject(room)).WithSequence(), id: room}, nil
+}
+
+// ID returns the ID of the room.
+func (rb *RoomBroadcaster) ID() string {
+	return rb.id
+}
+
+// Send broadcasts a message of member to the room.
+func (rb *RoomBroadcaster) Send(member string, data interface{}) error {
+	return rb.emit(RoomMessage, member, data)
+}
+
+// SendWithMetadata broadcasts a message of member carrying md to the room.
+func (rb *RoomBroadcaster) SendWithMetadata(md Metadata, member string, data interface{}) error {
+	return rb.emitWithMetadata(md, RoomMessage, member, data)
+}
+
+func (rb *RoomBroadcaster) emit(kind string, member string, data interface{}) error {
+	return rb.emitWithMetadata(nil, kind, member, data)
+}
+
+func (rb *RoomBroadcaster) emitWithMetadata(md Metadata, kind string, member string, data interface{}) error {
+	event := RoomEvent{Type: kind, Room: rb.id, Member: member, Node: rb.np.NodeID(), Timestamp: time.Now()}
+	if data != nil {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		event.Data = payload
+	}
+	rb.bc.SayWithMetadata(md, kind, &event)
+	return nil
+}
+
+// JoinRoom adds the local member to room and broadcasts its join event. listener receives
+// the events of the room until the member leaves it. Joining again replaces the listener.
+func (np *NatsProtoo) JoinRoom(room string, member string, listener RoomFunc) (*Room, error) {
+	if !validRoomID(room) {
+		return nil, ErrInvalidRoom
+	}
+	np.roomsMutex.Lock()
+	r, found := np.rooms[room]
+	if !found {
+		rb, _ := np.NewRoomBroadcaster(room)
+		r = &Room{RoomBroadcaster: rb, members: make(map[string]RoomFunc)}
+		r.listener = r.dispatch
+		np.rooms[room] = r
+		np.OnBroadcast(np.RoomSubject(room), r.listener)
+	}
+	r.mutex.Lock()
+	_, rejoined := r.members[member]
+	r.members[member] = listener
+	r.mutex.Unlock()
+	np.roomsMutex.Unlock()
+
+	logger.Debugf("JoinRoom: [room:%s, member:%s]", room, member)
+	if rejoined {
+		return r, nil
+	}
+	return r, r.emit(RoomJoin, member, nil)
+}
+
+// LeaveRoom removes the local member from room and broadcasts its leave event. The room
+// is unsubscribed with its last local member.
+func (np *NatsProtoo) LeaveRoom(room string, member string) error {
+	np.roomsMutex.Lock()
+	r, found := np.rooms[room]
+	if !found {
+		np.roomsMutex.Unlock()
+		return nil
+	}
+	r.mutex.Lock()
+	_, joined := r.members[member]
+	delete(r.members, member)
+	empty := len(r.members) == 0
+	r.mutex.Unlock()
+	if empty {
+		delete(np.rooms, room)
+		np.OffBroadcast(np.RoomSubject(room), r.listener)
+	}
+	np.roomsMutex.Unlock()
+
+	if !joined {
+		return nil
+	}
+	logger.Debugf("LeaveRoom: [room:%s, member:%s]", room, member)
+	return r.emit(RoomLeave, member, nil)
+}
+
+// Rooms returns the IDs of the rooms with local members.
+func (np *NatsProtoo) Rooms() []string {
+	np.roomsMutex.Lock()
+	defer np.roomsMutex.Unlock()
+	rooms := make([]string, 0, len(np.rooms))
+	for room := range np.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// RoomMembers returns the local members of room.
+func (np *NatsProtoo) RoomMembers(room string) []string {
+	np.roomsMutex.Lock()
+	r, found := np.rooms[room]
+	np.roomsMutex.Unlock()
+	if !found {
+		return []string{}
+	}
+	return r.Members()
+}
+
+// Members returns the local members of the room.
+func (r *Room) Members() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	members := make([]string, 0, len(r.members))
+	for member := range r.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// dispatch delivers an event of the room to every local member. A panic of a member's
+// listener is recovered, see OnPanic, and does not keep the event from the other members.
+func (r *Room) dispatch(notification Notification, subj string) {
+	var event RoomEvent
+	if notification.Method == GapMethod {
+		event = RoomEvent{Type: RoomGap, Room: r.id, Data: notification.Data, Timestamp: time.Now()}
+	} else if err := json.Unmarshal(notification.Data, &event); err != nil {
+		logger.Warnf("Room %s: invalid event %v", r.id, err)
+		return
+	}
+	event.Metadata = notification.Metadata
+	event.Seq = notification.Seq
+
+	r.mutex.Lock()
+	listeners := make([]RoomFunc, 0, len(r.members))
+	for _, listener := range r.members {
+		listeners = append(listeners, listener)
+	}
+	r.mutex.Unlock()
+	raw := &nats.Msg{Subject: subj, Data: notification.Data}
+	for _, listener := range listeners {
+		listener := listener
+		r.np.safely(ListenerBroadcast, event.Type, raw, func() { listener(event) })
+	}
+}
@@ -0,0 +1,111 @@
+package nprotoo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receiveRoomEvents(t *testing.T, events chan RoomEvent, n int) []RoomEvent {
+	received := make([]RoomEvent, 0, n)
+	for len(received) < n {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d room events", len(received), n)
+		}
+	}
+	return received
+}
+
+func TestRooms(t *testing.T) {
+	s := runJetStreamServer(t)
+	a, b := newTestProtoo(t, s), newTestProtoo(t, s)
+	defer a.Close()
+	defer b.Close()
+
+	_, err := a.JoinRoom("lobby.*", "alice", func(RoomEvent) {})
+	assert.Equal(t, ErrInvalidRoom, err)
+
+	alice := make(chan RoomEvent, 10)
+	_, err = a.JoinRoom("lobby", "alice", func(event RoomEvent) { alice <- event })
+	require.NoError(t, err)
+	event := receiveRoomEvents(t, alice, 1)[0]
+	assert.Equal(t, RoomJoin, event.Type)
+	assert.Equal(t, "alice", event.Member)
+
+	bob := make(chan RoomEvent, 10)
+	room, err := b.JoinRoom("lobby", "bob", func(event RoomEvent) { bob <- event })
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob"}, b.RoomMembers("lobby"))
+	event = receiveRoomEvents(t, alice, 1)[0]
+	assert.Equal(t, RoomJoin, event.Type)
+	assert.Equal(t, "bob", event.Member)
+
+	require.NoError(t, room.Send("bob", "hi"))
+	for _, events := range []chan RoomEvent{alice, bob} {
+		received := receiveRoomEvents(t, events, 1)
+		if received[0].Type == RoomJoin {
+			received = receiveRoomEvents(t, events, 1)
+		}
+		assert.Equal(t, RoomMessage, received[0].Type)
+		assert.Equal(t, "lobby", received[0].Room)
+		assert.Equal(t, "bob", received[0].Member)
+		assert.Equal(t, b.nodeID, received[0].Node)
+		assert.JSONEq(t, `"hi"`, string(received[0].Data))
+	}
+
+	rb, err := a.NewRoomBroadcaster("lobby")
+	require.NoError(t, err)
+	require.NoError(t, rb.Send("system", "welcome"))
+	assert.Equal(t, "system", receiveRoomEvents(t, alice, 1)[0].Member)
+	assert.Equal(t, "system", receiveRoomEvents(t, bob, 1)[0].Member)
+
+	require.NoError(t, b.LeaveRoom("lobby", "bob"))
+	assert.Empty(t, b.Rooms())
+	b.mutex.Lock()
+	assert.NotContains(t, b.broadcastSubs, b.RoomSubject("lobby"), "nodes without members must not receive the room events")
+	b.mutex.Unlock()
+	event = receiveRoomEvents(t, alice, 1)[0]
+	assert.Equal(t, RoomLeave, event.Type)
+	assert.Equal(t, "bob", event.Member)
+	assert.Equal(t, []string{"lobby"}, a.Rooms())
+	assert.Equal(t, "rooms.lobby", a.RoomSubject("lobby"))
+}
+
+func TestRoomMemberPanic(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	panics := make(chan string, 10)
+	np.OnPanic(func(kind string, subj string, method string, recovered interface{}, stack []byte) {
+		panics <- method
+	})
+
+	events := make(chan RoomEvent, 10)
+	for _, member := range []string{"alice", "bob", "carol"} {
+		member := member
+		_, err := np.JoinRoom("lobby", member, func(event RoomEvent) {
+			if event.Type != RoomMessage {
+				return
+			}
+			if member == "bob" {
+				panic("bob failed")
+			}
+			events <- event
+		})
+		require.NoError(t, err)
+	}
+
+	np.SetNodeID("node-2")
+	rb, err := np.NewRoomBroadcaster("lobby")
+	require.NoError(t, err)
+	require.NoError(t, rb.Send("system", "hi"))
+	received := receiveRoomEvents(t, events, 2)
+	assert.Equal(t, "node-2", received[0].Node, "events are sent with the current node ID")
+	assert.Equal(t, "node-2", received[1].Node)
+	assert.Equal(t, RoomMessage, <-panics)
+}
@@ -0,0 +1,184 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+)
+
+const (
+	// GapEvent is emitted by NatsProtoo with a Gap when sequenced notifications were missed.
+	GapEvent = "gap"
+	// GapMethod is the method of the notification delivered to the listeners of a channel
+	// in place of the notifications missed on it. Its data is the Gap.
+	GapMethod = "$gap"
+)
+
+// Gap is the range of sequence numbers missed from Source on Channel, bounds included.
+// Notifications of the range received late are still delivered.
+type Gap struct {
+	Channel string `json:"channel"`
+	Source  string `json:"source"`
+	From    uint64 `json:"from"`
+	To      uint64 `json:"to"`
+}
+
+// WithSequence stamps the notifications of the broadcaster with a sequence number. Every
+// broadcaster of a channel on a NatsProtoo shares its sequence, so subscribers track it per
+// channel and source and detect missed and duplicated notifications. The source is the
+// node ID followed by an epoch of the sequence, so the sequence of a restarted node, or of
+// a channel idle for sequenceTTL, is not taken for duplicates. Persisted notifications of
+// WithStream carry the sequence of the stream instead.
+func (bc *Broadcaster) WithSequence() *Broadcaster {
+	bc.sequenced = true
+	return bc
+}
+
+// maxMissedRanges bounds the ranges of missed notifications tracked per source. The
+// notifications of older ranges received late are dropped as duplicates.
+const maxMissedRanges = 64
+
+// sequenceTTL is the time after which the sequence of an idle channel, and the sequence
+// received from an idle source, are forgotten.
+const sequenceTTL = 10 * time.Minute
+
+// sequencer stamps the notifications sent on a channel. Its mutex is held until a stamped
+// notification was published.
+type sequencer struct {
+	mutex sync.Mutex
+	last  uint64
+	epoch string
+	// used is the last time the sequencer was returned, guarded by the mutex of NatsProtoo.
+	used time.Time
+}
+
+// sourceSequence is the sequence received from a source on a channel.
+type sourceSequence struct {
+	last uint64
+	// missed are the ranges skipped by gaps which were not received yet.
+	missed []Gap
+	seen   time.Time
+}
+
+// sequencer returns the sequencer of channel.
+func (np *NatsProtoo) sequencer(channel string) *sequencer {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	now := time.Now()
+	np.expireSequences(now)
+	seq, found := np.sequences[channel]
+	if !found {
+		seq = &sequencer{epoch: nuid.Next()}
+		np.sequences[channel] = seq
+	}
+	seq.used = now
+	return seq
+}
+
+// sequenceSource returns the Source of the notifications stamped by seq.
+func (np *NatsProtoo) sequenceSource(seq *sequencer) string {
+	return np.NodeID() + "/" + seq.epoch
+}
+
+// expireSequences forgets the sequencers and the sources idle for sequenceTTL, at most once
+// per sequenceTTL. The mutex must be held.
+func (np *NatsProtoo) expireSequences(now time.Time) {
+	if now.Sub(np.sequencesExpired) < np.sequenceTTL {
+		return
+	}
+	np.sequencesExpired = now
+	for channel, seq := range np.sequences {
+		if now.Sub(seq.used) >= np.sequenceTTL {
+			delete(np.sequences, channel)
+		}
+	}
+	for channel, received := range np.received {
+		for source, sequence := range received {
+			if now.Sub(sequence.seen) >= np.sequenceTTL {
+				delete(received, source)
+			}
+		}
+		if len(received) == 0 {
+			delete(np.received, channel)
+		}
+	}
+}
+
+// checkSequence tracks the sequence of notification received on channel. It returns false
+// for duplicates, which must be dropped, and the range missed before notification if any.
+// Notifications of a missed range received late are delivered out of order.
+func (np *NatsProtoo) checkSequence(channel string, notification *Notification) (bool, *Gap) {
+	if notification.Seq == 0 || notification.Source == _EMPTY_ {
+		return true, nil
+	}
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	now := time.Now()
+	np.expireSequences(now)
+	received, found := np.received[channel]
+	if !found {
+		received = make(map[string]*sourceSequence)
+		np.received[channel] = received
+	}
+	source, known := received[notification.Source]
+	if !known {
+		received[notification.Source] = &sourceSequence{last: notification.Seq, seen: now}
+		return true, nil
+	}
+	source.seen = now
+	if notification.Seq <= source.last {
+		if source.late(notification.Seq) {
+			outOfSequence.WithLabelValues("late").Inc()
+			return true, nil
+		}
+		outOfSequence.WithLabelValues("duplicate").Inc()
+		return false, nil
+	}
+	last := source.last
+	source.last = notification.Seq
+	if notification.Seq == last+1 {
+		return true, nil
+	}
+	outOfSequence.WithLabelValues("gap").Inc()
+	gap := &Gap{Channel: channel, Source: notification.Source, From: last + 1, To: notification.Seq - 1}
+	source.missed = append(source.missed, *gap)
+	if len(source.missed) > maxMissedRanges {
+		source.missed = source.missed[len(source.missed)-maxMissedRanges:]
+	}
+	return true, gap
+}
+
+// late removes seq from the missed ranges and reports whether it was missed.
+func (s *sourceSequence) late(seq uint64) bool {
+	for i, missed := range s.missed {
+		if seq < missed.From || seq > missed.To {
+			continue
+		}
+		var split []Gap
+		if seq > missed.From {
+			split = append(split, Gap{Channel: missed.Channel, Source: missed.Source, From: missed.From, To: seq - 1})
+		}
+		if seq < missed.To {
+			split = append(split, Gap{Channel: missed.Channel, Source: missed.Source, From: seq + 1, To: missed.To})
+		}
+		s.missed = append(s.missed[:i], append(split, s.missed[i+1:]...)...)
+		return true
+	}
+	return false
+}
+
+// gapNotification is delivered to the listeners of the channel of gap.
+func gapNotification(gap *Gap) Notification {
+	data, err := json.Marshal(gap)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+	}
+	return Notification{
+		NotificationData: NotificationData{Notification: true},
+		CommonData:       CommonData{Method: GapMethod, Data: data},
+	}
+}
@@ -0,0 +1,121 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequencedBroadcast(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+
+	notifications := make(chan Notification, 10)
+	np.OnBroadcast("room.seq", func(notification Notification, subj string) { notifications <- notification })
+	gaps := make(chan Gap, 1)
+	np.On(GapEvent, func(gap Gap) { gaps <- gap })
+
+	bc := np.NewBroadcaster("room.seq").WithSequence()
+	bc.Say("a", nil)
+	bc.Say("b", nil)
+	received := receive(t, notifications, 2)
+	assert.Equal(t, uint64(1), received[0].Seq)
+	assert.Equal(t, uint64(2), received[1].Seq)
+	source := np.sequenceSource(np.sequencer("room.seq"))
+	assert.Equal(t, source, received[1].Source)
+
+	publish := func(method string, seq uint64) {
+		payload, err := json.Marshal(&Notification{
+			NotificationData: NotificationData{Notification: true, Seq: seq, Source: source},
+			CommonData:       CommonData{Method: method, Data: RawMessage("null")},
+		})
+		require.NoError(t, err)
+		require.NoError(t, np.nc.Publish("room.seq", payload))
+	}
+	publish("f", 6)
+	publish("f", 6)
+	publish("b", 2)
+	publish("d", 4)
+	publish("d", 4)
+	publish("g", 7)
+
+	received = receive(t, notifications, 4)
+	assert.Equal(t, GapMethod, received[0].Method)
+	var gap Gap
+	require.NoError(t, json.Unmarshal(received[0].Data, &gap))
+	assert.Equal(t, Gap{Channel: "room.seq", Source: source, From: 3, To: 5}, gap)
+	assert.Equal(t, gap, <-gaps)
+	assert.Equal(t, "f", received[1].Method)
+	assert.Equal(t, "d", received[2].Method, "notifications of a gap received late are delivered")
+	assert.Equal(t, "g", received[3].Method, "duplicates are dropped")
+
+	// A restarted node with the same ID starts a new sequence.
+	restarted := newTestProtoo(t, s)
+	defer restarted.Close()
+	restarted.SetNodeID(np.NodeID())
+	restarted.NewBroadcaster("room.seq").WithSequence().Say("h", nil)
+	received = receive(t, notifications, 1)
+	assert.Equal(t, "h", received[0].Method)
+	assert.Equal(t, uint64(1), received[0].Seq)
+}
+
+func TestSequencedBroadcastConcurrent(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+
+	notifications := make(chan Notification, 100)
+	np.OnBroadcast("room.concurrent", func(notification Notification, subj string) { notifications <- notification })
+	gaps := make(chan Gap, 100)
+	np.On(GapEvent, func(gap Gap) { gaps <- gap })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bc := np.NewBroadcaster("room.concurrent").WithSequence()
+			for j := 0; j < 25; j++ {
+				bc.Say("m", nil)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, notification := range receive(t, notifications, 100) {
+		assert.Equal(t, uint64(i+1), notification.Seq, "notifications are published in sequence")
+	}
+	assert.Empty(t, gaps)
+}
+
+func TestSequenceExpiry(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	np.mutex.Lock()
+	np.sequenceTTL = 50 * time.Millisecond
+	np.mutex.Unlock()
+
+	notifications := make(chan Notification, 10)
+	np.OnBroadcast("room.idle", func(notification Notification, subj string) { notifications <- notification })
+	bc := np.NewBroadcaster("room.idle").WithSequence()
+	bc.Say("a", nil)
+	bc.Say("b", nil)
+	received := receive(t, notifications, 2)
+
+	time.Sleep(100 * time.Millisecond)
+	bc.Say("c", nil)
+	restarted := receive(t, notifications, 1)
+	assert.Equal(t, uint64(1), restarted[0].Seq, "the sequence of an idle channel restarts")
+	assert.NotEqual(t, received[1].Source, restarted[0].Source, "with a new source, not taken for a duplicate")
+
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	assert.Len(t, np.sequences, 1)
+	require.Len(t, np.received["room.idle"], 1, "the idle source is forgotten")
+	assert.Contains(t, np.received["room.idle"], restarted[0].Source)
+}
@@ -0,0 +1,253 @@
+package nprotoo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+var streamNameReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_")
+
+// StreamOptions configures the JetStream stream persisting the notifications of a Broadcaster.
+type StreamOptions struct {
+	// Name of the stream. Defaults to the channel with '.', '*', '>' and ' ' replaced by '_'.
+	Name string
+	// MaxAge limits how long notifications are kept, 0 keeps them forever.
+	MaxAge time.Duration
+	// MaxMsgs limits how many notifications are kept, 0 keeps all of them.
+	MaxMsgs int64
+	// Replicas is the number of stream replicas in a clustered JetStream.
+	Replicas int
+	// Memory keeps the stream in memory instead of files.
+	Memory bool
+}
+
+// ReplayOptions configures the durable consumer OnDurableBroadcast reads a stream with.
+type ReplayOptions struct {
+	// Stream defaults to the name derived from the channel like in StreamOptions.
+	Stream string
+	// Durable is the consumer name. A subscriber using the same name after a restart
+	// receives every notification published since its last acked one.
+	Durable string
+	// StartSequence replays the stream from this sequence when the consumer is created.
+	StartSequence uint64
+	// StartTime replays the stream from this time when the consumer is created.
+	StartTime time.Time
+	// DeliverNew only delivers notifications published after the consumer was created.
+	DeliverNew bool
+}
+
+func streamName(channel string) string {
+	return streamNameReplacer.Replace(channel)
+}
+
+// jetStream returns the JetStream context of the connection.
+func (np *NatsProtoo) jetStream() (nats.JetStreamContext, error) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	if np.js == nil {
+		js, err := np.nc.JetStream()
+		if err != nil {
+			return nil, err
+		}
+		np.js = js
+	}
+	return np.js, nil
+}
+
+// AddStream creates the stream persisting channel, or updates it if it already exists.
+func (np *NatsProtoo) AddStream(channel string, opts StreamOptions) error {
+	return np.addStream(np.subject(channel), opts)
+}
+
+// addStream creates or updates the stream persisting subject.
+func (np *NatsProtoo) addStream(subject string, opts StreamOptions) error {
+	js, err := np.jetStream()
+	if err != nil {
+		return err
+	}
+	if opts.Name == _EMPTY_ {
+		opts.Name = streamName(subject)
+	}
+	config := &nats.StreamConfig{
+		Name:     opts.Name,
+		Subjects: []string{subject},
+		MaxAge:   opts.MaxAge,
+		MaxMsgs:  opts.MaxMsgs,
+		Replicas: opts.Replicas,
+		Storage:  nats.FileStorage,
+	}
+	if config.MaxMsgs == 0 {
+		config.MaxMsgs = -1
+	}
+	if opts.Memory {
+		config.Storage = nats.MemoryStorage
+	}
+
+	if _, err = js.StreamInfo(opts.Name); errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(config)
+	} else if err == nil {
+		_, err = js.UpdateStream(config)
+	}
+	if err != nil {
+		return err
+	}
+	logger.Infof("Stream [%s] persists subject %s", opts.Name, subject)
+	return nil
+}
+
+// WithStream switches the broadcaster to persist its notifications in a JetStream stream,
+// which is created if missing. Subscribers of OnBroadcast still receive them live.
+// Acked notifications of WithAck are not used in this mode: durable consumers ack to the stream.
+func (bc *Broadcaster) WithStream(opts StreamOptions) (*Broadcaster, error) {
+	if err := bc.np.addStream(bc.subj, opts); err != nil {
+		return nil, err
+	}
+	bc.stream = true
+	return bc, nil
+}
+
+// sayPersisted publishes notification to the stream of the broadcaster.
+func (bc *Broadcaster) sayPersisted(notification *Notification) {
+	js, err := bc.np.jetStream()
+	if err != nil {
+		logger.Errorf("JetStream %v", err)
+		return
+	}
+	payload, header, err := bc.encode(notification)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	msg := nats.NewMsg(bc.subj)
+	msg.Data = payload
+	if header != nil {
+		msg.Header = header
+	}
+	ack, err := js.PublishMsg(msg, nats.MsgId(nuid.Next()))
+	if err != nil {
+		logger.Errorf("Publish notification [%s] to stream: %v", notification.Method, err)
+		bc.Emit("error", 0, err.Error())
+		return
+	}
+	bc.np.record(TapOutbound, msg)
+	logger.Debugf("Persisted notification [%s] stream[%s] seq[%d]", notification.Method, ack.Stream, ack.Sequence)
+}
+
+// OnDurableBroadcast delivers the notifications persisted for channel to listener through
+// a consumer of the stream. A notification is acked to the stream once listener returned, so
+// a restarted subscriber of a Durable consumer resumes after the last notification it
+// handled. A notification listener panicked on is not delivered again.
+//
+// Unsubscribe or Drain the returned subscription to stop delivering. A Durable consumer is
+// kept, so a later OnDurableBroadcast with the same name resumes it, other consumers are deleted.
+func (np *NatsProtoo) OnDurableBroadcast(channel string, opts ReplayOptions, listener BroadCastFunc) (*nats.Subscription, error) {
+	js, err := np.jetStream()
+	if err != nil {
+		return nil, err
+	}
+	subject := np.subject(channel)
+	if opts.Stream == _EMPTY_ {
+		opts.Stream = streamName(subject)
+	}
+	subOpts := []nats.SubOpt{nats.BindStream(opts.Stream), nats.ManualAck()}
+	if opts.Durable != _EMPTY_ {
+		// The subscription attaches to a consumer it did not create, which the NATS client
+		// does not delete when the subscription is stopped.
+		if err := addDurableConsumer(js, subject, opts); err != nil {
+			return nil, err
+		}
+		subOpts = append(subOpts, nats.Durable(opts.Durable))
+	} else {
+		subOpts = append(subOpts, nats.AckExplicit())
+		switch {
+		case opts.StartSequence > 0:
+			subOpts = append(subOpts, nats.StartSequence(opts.StartSequence))
+		case !opts.StartTime.IsZero():
+			subOpts = append(subOpts, nats.StartTime(opts.StartTime))
+		case opts.DeliverNew:
+			subOpts = append(subOpts, nats.DeliverNew())
+		default:
+			subOpts = append(subOpts, nats.DeliverAll())
+		}
+	}
+
+	sub, err := js.Subscribe(subject, func(msg *nats.Msg) {
+		np.handleDurableBroadcast(msg, listener)
+	}, subOpts...)
+	if err != nil {
+		return nil, err
+	}
+	np.mutex.Lock()
+	np.registerChannel(ChannelBroadcast, channel, _EMPTY_, opts.Durable)
+	np.mutex.Unlock()
+	logger.Debugf("OnDurableBroadcast: [channel:%s, durable:%s]", channel, opts.Durable)
+	return sub, nil
+}
+
+// addDurableConsumer creates the durable consumer of opts on subject unless it exists.
+func addDurableConsumer(js nats.JetStreamContext, subject string, opts ReplayOptions) error {
+	_, err := js.ConsumerInfo(opts.Stream, opts.Durable)
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, nats.ErrConsumerNotFound) {
+		return err
+	}
+	config := &nats.ConsumerConfig{
+		Durable:        opts.Durable,
+		DeliverSubject: nats.NewInbox(),
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		AckPolicy:      nats.AckExplicitPolicy,
+		FilterSubject:  subject,
+		MaxAckPending:  nats.DefaultSubPendingMsgsLimit,
+	}
+	switch {
+	case opts.StartSequence > 0:
+		config.DeliverPolicy, config.OptStartSeq = nats.DeliverByStartSequencePolicy, opts.StartSequence
+	case !opts.StartTime.IsZero():
+		config.DeliverPolicy, config.OptStartTime = nats.DeliverByStartTimePolicy, &opts.StartTime
+	case opts.DeliverNew:
+		config.DeliverPolicy = nats.DeliverNewPolicy
+	}
+	_, err = js.AddConsumer(opts.Stream, config)
+	return err
+}
+
+func (np *NatsProtoo) handleDurableBroadcast(msg *nats.Msg, listener BroadCastFunc) {
+	np.record(TapInbound, msg)
+	var peerMsg PeerMsg
+	if err := json.Unmarshal(msg.Data, &peerMsg); err != nil || !peerMsg.Notification {
+		logger.Errorf("handleDurableBroadcast: invalid notification on %s: %v", msg.Subject, err)
+		np.deadLetter(DeadLetterUnmarshal, fmt.Sprintf("invalid notification: %v", err), msg)
+		msg.Term()
+		return
+	}
+	if err := np.upgrade(&peerMsg); err != nil {
+		np.rejectUnsupported(&peerMsg, err, msg)
+		msg.Term()
+		return
+	}
+	notification := Notification{CommonData: peerMsg.CommonData, NotificationData: peerMsg.NotificationData}
+	notification.Metadata = notification.Metadata.merge(msg.Header)
+	if meta, err := msg.Metadata(); err == nil {
+		notification.Sequence = meta.Sequence.Stream
+		notification.Timestamp = meta.Timestamp
+	}
+	logger.Debugf("Handle durable broadcast [%s] seq[%d]", notification.Method, notification.Sequence)
+	panicked := np.safely(ListenerBroadcast, notification.Method, msg, func() {
+		listener(notification, np.channelOf(msg.Subject))
+	})
+	if panicked {
+		msg.Term()
+		return
+	}
+	if err := msg.Ack(); err != nil {
+		logger.Warnf("Ack notification seq[%d]: %v", notification.Sequence, err)
+	}
+}
@@ -0,0 +1,113 @@
+package nprotoo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runJetStreamServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	require.NoError(t, err)
+	go s.Start()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func newTestProtoo(t *testing.T, s *server.Server) *NatsProtoo {
+	np, err := NewNatsProtooWithConfig(NewConfig(s.ClientURL()))
+	require.NoError(t, err)
+	return np
+}
+
+func receive(t *testing.T, notifications chan Notification, n int) []Notification {
+	received := make([]Notification, 0, n)
+	for len(received) < n {
+		select {
+		case notification := <-notifications:
+			received = append(received, notification)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d notifications", len(received), n)
+		}
+	}
+	return received
+}
+
+func TestDurableBroadcast(t *testing.T) {
+	s := runJetStreamServer(t)
+	publisher := newTestProtoo(t, s)
+	defer publisher.Close()
+
+	bc, err := publisher.NewBroadcaster("room.events").WithStream(StreamOptions{})
+	require.NoError(t, err)
+
+	bc.Say("join", "u1")
+	bc.Say("message", "hello")
+
+	notifications := make(chan Notification, 10)
+	listener := func(notification Notification, subj string) { notifications <- notification }
+
+	subscriber := newTestProtoo(t, s)
+	sub, err := subscriber.OnDurableBroadcast("room.events", ReplayOptions{Durable: "node-a"}, listener)
+	require.NoError(t, err)
+	received := receive(t, notifications, 2)
+	assert.Equal(t, "join", received[0].Method)
+	assert.Equal(t, uint64(1), received[0].Sequence)
+	assert.Equal(t, "message", received[1].Method)
+	assert.Equal(t, uint64(2), received[1].Sequence)
+	assert.False(t, received[1].Timestamp.IsZero())
+
+	// Notifications published while the subscriber is stopped are replayed after its restart.
+	require.NoError(t, sub.Unsubscribe())
+	subscriber.Close()
+	time.Sleep(100 * time.Millisecond)
+	bc.Say("leave", "u1")
+
+	subscriber = newTestProtoo(t, s)
+	defer subscriber.Close()
+	_, err = subscriber.OnDurableBroadcast("room.events", ReplayOptions{Durable: "node-a"}, listener)
+	require.NoError(t, err)
+	received = receive(t, notifications, 1)
+	assert.Equal(t, "leave", received[0].Method)
+	assert.Equal(t, uint64(3), received[0].Sequence)
+
+	// A new consumer replays from the requested sequence.
+	_, err = subscriber.OnDurableBroadcast("room.events", ReplayOptions{Durable: "node-b", StartSequence: 2}, listener)
+	require.NoError(t, err)
+	received = receive(t, notifications, 2)
+	assert.Equal(t, []string{"message", "leave"}, []string{received[0].Method, received[1].Method})
+
+	select {
+	case notification := <-notifications:
+		t.Fatalf("unexpected notification %v", notification)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDurableBroadcastStop(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	bc, err := np.NewBroadcaster("room.stop").WithStream(StreamOptions{})
+	require.NoError(t, err)
+
+	notifications := make(chan Notification, 10)
+	listener := func(notification Notification, subj string) { notifications <- notification }
+	sub, err := np.OnDurableBroadcast("room.stop", ReplayOptions{DeliverNew: true}, listener)
+	require.NoError(t, err)
+	bc.Say("join", "u1")
+	receive(t, notifications, 1)
+
+	require.NoError(t, sub.Drain())
+	assert.Eventually(t, func() bool { return !sub.IsValid() }, 5*time.Second, 10*time.Millisecond)
+	bc.Say("leave", "u1")
+	select {
+	case notification := <-notifications:
+		t.Fatalf("notification %v delivered after the subscription stopped", notification)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,27 @@
+package nprotoo
+
+import "strings"
+
+// SubjectMatches reports whether subject matches pattern using the NATS wildcards '*' and '>'.
+func SubjectMatches(pattern string, subject string) bool {
+	patternTokens, subjectTokens := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
+
+// HasWildcard reports whether subject contains one of the NATS wildcards '*' and '>'.
+func HasWildcard(subject string) bool {
+	for _, token := range strings.Split(subject, ".") {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
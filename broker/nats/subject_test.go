@@ -0,0 +1,27 @@
+package nprotoo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubjectMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, subject string
+		matches          bool
+	}{
+		{"room.lobby", "room.lobby", true},
+		{"room.*", "room.lobby", true},
+		{"room.*", "room.lobby.events", false},
+		{"room.>", "room.lobby.events", true},
+		{"room.>", "room", false},
+		{"room.*.events", "room.lobby.events", true},
+		{"room.lobby", "room", false},
+	} {
+		assert.Equal(t, tc.matches, SubjectMatches(tc.pattern, tc.subject), "%s %s", tc.pattern, tc.subject)
+	}
+	assert.True(t, HasWildcard("room.*"))
+	assert.True(t, HasWildcard(">"))
+	assert.False(t, HasWildcard("room.lobby*"))
+}
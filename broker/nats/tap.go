@@ -0,0 +1,542 @@
+package nprotoo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	nats "github.com/nats-io/nats.go"
+)
+
+// Directions of a TapRecord, seen from the tapped NatsProtoo.
+const (
+	TapInbound  = "in"
+	TapOutbound = "out"
+)
+
+// Kinds of a TapRecord.
+const (
+	TapRequest      = "request"
+	TapResponse     = "response"
+	TapNotification = "notification"
+	TapCancel       = "cancel"
+	TapAck          = "ack"
+	TapUnknown      = "unknown"
+)
+
+// DefaultTapReplayTimeout is how long Replay waits for the responses to the replayed requests.
+const DefaultTapReplayTimeout = 5 * time.Second
+
+// TapRedacted replaces the values of credential headers and metadata in a TapRecord.
+const TapRedacted = "[REDACTED]"
+
+// redactedTapHeaders are the headers and metadata recorded as TapRedacted, compared ignoring case.
+var redactedTapHeaders = []string{AuthorizationMetadata, PeerSubjectMetadata, "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+func redactedTapHeader(key string) bool {
+	for _, redacted := range redactedTapHeaders {
+		if strings.EqualFold(key, redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeader returns a copy of h with the credentials redacted, or h if it has none.
+func redactHeader(h nats.Header) nats.Header {
+	var redacted nats.Header
+	for k := range h {
+		if !redactedTapHeader(k) {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(nats.Header, len(h))
+			for k, v := range h {
+				redacted[k] = v
+			}
+		}
+		redacted[k] = []string{TapRedacted}
+	}
+	if redacted == nil {
+		return h
+	}
+	return redacted
+}
+
+// redactMetadata returns the envelope data with the credentials of its metadata redacted,
+// or data if it has none. It is the fallback of the servers without headers.
+func redactMetadata(data []byte, md Metadata) []byte {
+	var redacted Metadata
+	for k := range md {
+		if redactedTapHeader(k) {
+			if redacted == nil {
+				redacted = md.Clone()
+			}
+			redacted[k] = TapRedacted
+		}
+	}
+	if redacted == nil {
+		return data
+	}
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return data
+	}
+	envelope["metadata"], _ = json.Marshal(redacted)
+	if patched, err := json.Marshal(envelope); err == nil {
+		return patched
+	}
+	return data
+}
+
+// TapRecord is a message sent or received by a tapped NatsProtoo. The credentials in its
+// headers and metadata, e.g. the Authorization, are recorded as TapRedacted.
+type TapRecord struct {
+	Time      time.Time `json:"time"`
+	Node      string    `json:"node,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	Direction string    `json:"direction"`
+	Kind      string    `json:"kind"`
+	Method    string    `json:"method,omitempty"`
+	ID        int       `json:"id,omitempty"`
+	// Subject is the subject the message was sent on, Channel the subject without the
+	// namespace of the tapped NatsProtoo.
+	Subject string      `json:"subject"`
+	Channel string      `json:"channel"`
+	Reply   string      `json:"reply,omitempty"`
+	Header  nats.Header `json:"header,omitempty"`
+	// Message is the envelope, a JSON string if it was not valid JSON.
+	Message json.RawMessage `json:"message"`
+}
+
+// TapSink receives the records of a tapped NatsProtoo.
+type TapSink interface {
+	Record(record TapRecord) error
+	Close() error
+}
+
+// jsonlTap writes one JSON record per line.
+type jsonlTap struct {
+	mutex  sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+}
+
+// NewJSONLTap returns a sink writing every record as a line of JSON to w.
+func NewJSONLTap(w io.Writer) TapSink {
+	closer, _ := w.(io.Closer)
+	return &jsonlTap{w: bufio.NewWriter(w), closer: closer}
+}
+
+// OpenTapFile returns a sink appending the records to the JSONL file at path.
+func OpenTapFile(path string) (TapSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLTap(f), nil
+}
+
+func (t *jsonlTap) Record(record TapRecord) error {
+	line, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, err := t.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// Records are flushed one by one so a crashed service leaves a complete recording.
+	return t.w.Flush()
+}
+
+func (t *jsonlTap) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	err := t.w.Flush()
+	if t.closer != nil && t.closer != os.Stdout {
+		if cerr := t.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// subjectTap publishes the records to a mirror subject.
+type subjectTap struct {
+	nc      *nats.Conn
+	subject string
+}
+
+// NewSubjectTap returns a sink publishing every record as JSON to subject in the namespace
+// of np, e.g. to be recorded by the `tap record --mirror` command.
+func NewSubjectTap(np *NatsProtoo, subject string) TapSink {
+	return &subjectTap{nc: np.nc, subject: np.subject(subject)}
+}
+
+func (t *subjectTap) Record(record TapRecord) error {
+	payload, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	// Published past the NatsProtoo, so the mirror is not tapped itself.
+	return t.nc.Publish(t.subject, payload)
+}
+
+func (t *subjectTap) Close() error {
+	return t.nc.Flush()
+}
+
+// Tap records every request, response and notification sent or received by this NatsProtoo
+// to sink, replacing the sink of a previous Tap. Chunks of transfers are not recorded.
+func (np *NatsProtoo) Tap(sink TapSink) {
+	np.tapMutex.Lock()
+	previous := np.tap
+	np.tap = sink
+	np.tapMutex.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	logger.Infof("Tap enabled on %s", np.service)
+}
+
+// Untap stops recording and closes the sink.
+func (np *NatsProtoo) Untap() error {
+	np.tapMutex.Lock()
+	sink := np.tap
+	np.tap = nil
+	np.tapMutex.Unlock()
+	if sink == nil {
+		return nil
+	}
+	return sink.Close()
+}
+
+// record passes msg to the tap sink, if any.
+func (np *NatsProtoo) record(direction string, msg *nats.Msg) {
+	np.tapMutex.RLock()
+	sink := np.tap
+	np.tapMutex.RUnlock()
+	if sink == nil {
+		return
+	}
+	if err := sink.Record(np.newTapRecord(direction, msg)); err != nil {
+		logger.Warnf("Tap record of %s: %v", msg.Subject, err)
+	}
+}
+
+func (np *NatsProtoo) newTapRecord(direction string, msg *nats.Msg) TapRecord {
+	record := TapRecord{
+		Time:      time.Now(),
+		Node:      np.NodeID(),
+		Service:   np.service,
+		Direction: direction,
+		Kind:      TapUnknown,
+		Subject:   msg.Subject,
+		Channel:   np.channelOf(msg.Subject),
+		Reply:     msg.Reply,
+		Header:    redactHeader(msg.Header),
+		Message:   msg.Data,
+	}
+	var peerMsg PeerMsg
+	if err := json.Unmarshal(msg.Data, &peerMsg); err != nil {
+		record.Message, _ = json.Marshal(string(msg.Data))
+		return record
+	}
+	record.Method, record.ID = peerMsg.Method, peerMsg.ID
+	record.Message = redactMetadata(msg.Data, peerMsg.Metadata)
+	switch {
+	case peerMsg.Ack:
+		record.Kind = TapAck
+	case peerMsg.Cancel:
+		record.Kind = TapCancel
+	case peerMsg.Request:
+		record.Kind = TapRequest
+	case peerMsg.Response:
+		record.Kind = TapResponse
+	case peerMsg.Notification:
+		record.Kind = TapNotification
+	}
+	return record
+}
+
+// TapSubjects records every message published on subjects in the namespace of this
+// NatsProtoo to sink as inbound, e.g. to observe services which are not tapped. The
+// returned func stops recording.
+func (np *NatsProtoo) TapSubjects(sink TapSink, subjects ...string) (func(), error) {
+	subs := make([]*nats.Subscription, 0, len(subjects))
+	stop := func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}
+	for _, subject := range subjects {
+		sub, err := np.nc.Subscribe(np.subject(subject), func(msg *nats.Msg) {
+			if err := sink.Record(np.newTapRecord(TapInbound, msg)); err != nil {
+				logger.Warnf("Tap record of %s: %v", msg.Subject, err)
+			}
+		})
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return stop, np.nc.Flush()
+}
+
+// CopyTap copies the records published to the mirror subject of a NewSubjectTap to sink.
+// The returned func stops copying.
+func (np *NatsProtoo) CopyTap(subject string, sink TapSink) (func(), error) {
+	sub, err := np.nc.Subscribe(np.subject(subject), func(msg *nats.Msg) {
+		var record TapRecord
+		if err := json.Unmarshal(msg.Data, &record); err != nil {
+			logger.Warnf("Invalid tap record on %s: %v", msg.Subject, err)
+			return
+		}
+		if err := sink.Record(record); err != nil {
+			logger.Warnf("Tap record of %s: %v", record.Subject, err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { sub.Unsubscribe() }, np.nc.Flush()
+}
+
+// ReadTap calls fn with every record of a JSONL recording.
+func ReadTap(r io.Reader, fn func(record TapRecord) error) error {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 && string(data) != "\n" {
+			var record TapRecord
+			if uerr := json.Unmarshal(data, &record); uerr != nil {
+				return fmt.Errorf("tap line %d: %v", line, uerr)
+			}
+			if ferr := fn(record); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// TapReplayOptions select the records Replay sends again and how fast.
+type TapReplayOptions struct {
+	// Speed scales the delays between the records: 1 replays at the recorded pace, 2 twice
+	// as fast. The records are sent without delay if 0.
+	Speed float64
+	// Directions and Kinds select the records sent, by default the requests, cancels and
+	// notifications received by the tapped NatsProtoo.
+	Directions []string
+	Kinds      []string
+	// Channels select the records by the patterns of their channel, see SubjectMatches.
+	Channels []string
+	// Responses receives the responses to the replayed requests, if set.
+	Responses TapSink
+	// Timeout bounds the wait for the responses after the last record, DefaultTapReplayTimeout if 0.
+	Timeout time.Duration
+}
+
+// TapReplayResult summarizes a Replay.
+type TapReplayResult struct {
+	Replayed  int `json:"replayed"`
+	Skipped   int `json:"skipped"`
+	Responses int `json:"responses"`
+	Errors    int `json:"errors"`
+}
+
+// Replay sends the records of a JSONL recording read from r again on the channels of the
+// records in the namespace of this NatsProtoo, e.g. to reproduce a bug against a test
+// environment. The deadlines of requests are moved by the time passed since they were
+// recorded, and their responses are received on an inbox of the replay. Redacted
+// credentials are sent as TapRedacted.
+func (np *NatsProtoo) Replay(ctx context.Context, r io.Reader, opts TapReplayOptions) (TapReplayResult, error) {
+	if len(opts.Directions) == 0 {
+		opts.Directions = []string{TapInbound}
+	}
+	if len(opts.Kinds) == 0 {
+		opts.Kinds = []string{TapRequest, TapCancel, TapNotification}
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTapReplayTimeout
+	}
+	replay := &tapReplay{np: np, opts: opts, replies: make(map[string]string), pending: make(map[string]bool)}
+	replay.cond = sync.NewCond(&replay.mutex)
+	replay.inbox = np.subject(nats.NewInbox())
+	sub, err := np.nc.Subscribe(replay.inbox+".*", replay.onResponse)
+	if err != nil {
+		return TapReplayResult{}, err
+	}
+	defer sub.Unsubscribe()
+
+	var first time.Time
+	start := time.Now()
+	err = ReadTap(r, func(record TapRecord) error {
+		if !replay.selects(record) {
+			replay.result.Skipped++
+			return nil
+		}
+		if first.IsZero() {
+			first = record.Time
+		}
+		if opts.Speed > 0 {
+			due := start.Add(time.Duration(float64(record.Time.Sub(first)) / opts.Speed))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return replay.send(record)
+	})
+	replay.wait(ctx)
+	replay.mutex.Lock()
+	defer replay.mutex.Unlock()
+	logger.Infof("Replayed %d records, skipped %d, %d responses with %d errors",
+		replay.result.Replayed, replay.result.Skipped, replay.result.Responses, replay.result.Errors)
+	return replay.result, err
+}
+
+type tapReplay struct {
+	np    *NatsProtoo
+	opts  TapReplayOptions
+	inbox string
+	next  int
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// replies maps the recorded reply subjects to those of the replay, pending the replies
+	// of the replay awaiting their response.
+	replies map[string]string
+	pending map[string]bool
+	result  TapReplayResult
+}
+
+func (t *tapReplay) selects(record TapRecord) bool {
+	if !contains(t.opts.Directions, record.Direction) || !contains(t.opts.Kinds, record.Kind) {
+		return false
+	}
+	if len(t.opts.Channels) == 0 {
+		return true
+	}
+	for _, pattern := range t.opts.Channels {
+		if SubjectMatches(pattern, record.Channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// send publishes record with its reply subject and deadline moved to the replay.
+func (t *tapReplay) send(record TapRecord) error {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(record.Message, &envelope); err != nil {
+		logger.Warnf("Skip tap record of %s: %v", record.Subject, err)
+		t.mutex.Lock()
+		t.result.Skipped++
+		t.mutex.Unlock()
+		return nil
+	}
+	if raw, found := envelope["deadline"]; found {
+		var deadline int64
+		if err := json.Unmarshal(raw, &deadline); err == nil && deadline > 0 {
+			remaining := time.Unix(0, deadline*int64(time.Millisecond)).Sub(record.Time)
+			envelope["deadline"], _ = json.Marshal(time.Now().Add(remaining).UnixNano() / int64(time.Millisecond))
+		}
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	reply := _EMPTY_
+	t.mutex.Lock()
+	if record.Reply != _EMPTY_ {
+		reply = t.replies[record.Reply]
+		if reply == _EMPTY_ {
+			t.next++
+			reply = t.inbox + "." + strconv.Itoa(t.next)
+			t.replies[record.Reply] = reply
+		}
+		if record.Kind == TapRequest {
+			t.pending[reply] = true
+		}
+	}
+	t.result.Replayed++
+	t.mutex.Unlock()
+
+	logger.Debugf("Replay %s [%s] on %s", record.Kind, record.Method, record.Channel)
+	return t.np.publishMsg(&nats.Msg{Subject: t.np.subject(record.Channel), Reply: reply, Header: record.Header, Data: payload})
+}
+
+func (t *tapReplay) onResponse(msg *nats.Msg) {
+	var peerMsg PeerMsg
+	if err := json.Unmarshal(msg.Data, &peerMsg); err != nil || !peerMsg.Response {
+		return
+	}
+	if t.opts.Responses != nil {
+		if err := t.opts.Responses.Record(t.np.newTapRecord(TapInbound, msg)); err != nil {
+			logger.Warnf("Tap record of %s: %v", msg.Subject, err)
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.result.Responses++
+	if !peerMsg.Ok {
+		t.result.Errors++
+	}
+	delete(t.pending, msg.Subject)
+	t.cond.Broadcast()
+}
+
+// wait waits for the responses to the replayed requests until the timeout of the replay.
+func (t *tapReplay) wait(ctx context.Context) {
+	timer := time.AfterFunc(t.opts.Timeout, func() {
+		t.mutex.Lock()
+		t.pending = nil
+		t.cond.Broadcast()
+		t.mutex.Unlock()
+	})
+	defer timer.Stop()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.mutex.Lock()
+			t.pending = nil
+			t.cond.Broadcast()
+			t.mutex.Unlock()
+		case <-stop:
+		}
+	}()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for len(t.pending) > 0 {
+		t.cond.Wait()
+	}
+}
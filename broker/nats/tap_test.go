@@ -0,0 +1,162 @@
+package nprotoo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTap(t *testing.T, recording []byte) []TapRecord {
+	var records []TapRecord
+	require.NoError(t, ReadTap(bytes.NewReader(recording), func(record TapRecord) error {
+		records = append(records, record)
+		return nil
+	}))
+	return records
+}
+
+// recordChat taps a chat service answering a request and receiving a notification.
+func recordChat(t *testing.T, s *server.Server) []byte {
+	prod := newNamespacedProtoo(t, s, "prod")
+	var recording bytes.Buffer
+	prod.Tap(NewJSONLTap(&recording))
+
+	prod.OnRequest("rpc-chat", func(request Request, accept RespondFunc, reject RejectFunc) {
+		accept(request.Method)
+	})
+	notifications := make(chan Notification, 1)
+	prod.OnBroadcast("room.1", func(notification Notification, subj string) { notifications <- notification })
+
+	result, rerr := prod.NewRequestor("rpc-chat").SyncRequest("send", map[string]string{"text": "hi"})
+	require.Nil(t, rerr)
+	assert.JSONEq(t, `"send"`, string(result))
+	prod.NewBroadcaster("room.1").Say("typing", nil)
+	receive(t, notifications, 1)
+	require.NoError(t, prod.Untap())
+	return recording.Bytes()
+}
+
+func TestTap(t *testing.T) {
+	s := runJetStreamServer(t)
+	records := readTap(t, recordChat(t, s))
+
+	seen := make(map[string]TapRecord)
+	for _, record := range records {
+		seen[record.Direction+" "+record.Kind] = record
+		assert.False(t, record.Time.IsZero())
+		assert.Equal(t, "prod."+record.Channel, record.Subject)
+	}
+	for _, key := range []string{"out request", "in request", "out response", "in response", "out notification", "in notification"} {
+		assert.Contains(t, seen, key)
+	}
+	request := seen["in request"]
+	assert.Equal(t, "rpc-chat", request.Channel)
+	assert.Equal(t, "send", request.Method)
+	assert.NotEmpty(t, request.Reply)
+	var msg PeerMsg
+	require.NoError(t, json.Unmarshal(request.Message, &msg))
+	assert.JSONEq(t, `{"text":"hi"}`, string(msg.Data))
+	assert.Equal(t, "room.1", seen["in notification"].Channel)
+}
+
+func TestTapRedact(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	var recording bytes.Buffer
+	np.Tap(NewJSONLTap(&recording))
+	np.OnRequest("rpc-auth", func(request Request, accept RespondFunc, reject RejectFunc) {
+		accept(request.Metadata.Get(AuthorizationMetadata) == "Bearer secret")
+	})
+
+	ctx := NewMetadataContext(context.Background(), Metadata{AuthorizationMetadata: "Bearer secret", "trace": "t-1"})
+	result, rerr := np.NewRequestor("rpc-auth").SyncRequestContext(ctx, "verify", nil)
+	require.Nil(t, rerr)
+	assert.JSONEq(t, `true`, string(result), "only the records are redacted")
+	require.NoError(t, np.Untap())
+
+	assert.NotContains(t, recording.String(), "Bearer secret")
+	for _, record := range readTap(t, recording.Bytes()) {
+		if record.Kind == TapRequest {
+			assert.Equal(t, TapRedacted, record.Header.Get(AuthorizationMetadata))
+			assert.Equal(t, "t-1", record.Header.Get("trace"))
+		}
+	}
+
+	md := Metadata{"authorization": "Bearer secret", "trace": "t-1"}
+	data := redactMetadata([]byte(`{"request":true,"id":1,"method":"verify","metadata":{"authorization":"Bearer secret","trace":"t-1"}}`), md)
+	assert.JSONEq(t, `{"request":true,"id":1,"method":"verify","metadata":{"authorization":"[REDACTED]","trace":"t-1"}}`, string(data))
+	assert.Equal(t, "Bearer secret", md["authorization"])
+}
+
+func TestTapReplay(t *testing.T) {
+	s := runJetStreamServer(t)
+	recording := recordChat(t, s)
+
+	staging := newNamespacedProtoo(t, s, "staging")
+	requests := make(chan Request, 1)
+	staging.OnRequest("rpc-chat", func(request Request, accept RespondFunc, reject RejectFunc) {
+		requests <- request
+		reject(500, "replayed")
+	})
+	notifications := make(chan Notification, 1)
+	staging.OnBroadcast("room.1", func(notification Notification, subj string) { notifications <- notification })
+
+	var responses bytes.Buffer
+	result, err := staging.Replay(context.Background(), bytes.NewReader(recording), TapReplayOptions{Responses: NewJSONLTap(&responses)})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Replayed)
+	assert.Equal(t, 1, result.Responses)
+	assert.Equal(t, 1, result.Errors)
+	assert.Equal(t, len(readTap(t, recording))-2, result.Skipped)
+
+	select {
+	case request := <-requests:
+		assert.Equal(t, "send", request.Method)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not replayed")
+	}
+	assert.Equal(t, "typing", receive(t, notifications, 1)[0].Method)
+	replies := readTap(t, responses.Bytes())
+	require.Len(t, replies, 1)
+	assert.Equal(t, TapResponse, replies[0].Kind)
+}
+
+func TestTapReplaySpeed(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	notifications := make(chan Notification, 2)
+	np.OnBroadcast("room.1", func(notification Notification, subj string) { notifications <- notification })
+
+	var recording bytes.Buffer
+	sink := NewJSONLTap(&recording)
+	recorded := time.Now().Add(-time.Hour)
+	for i, method := range []string{"join", "leave"} {
+		require.NoError(t, sink.Record(TapRecord{
+			Time:      recorded.Add(time.Duration(i) * 400 * time.Millisecond),
+			Direction: TapInbound,
+			Kind:      TapNotification,
+			Subject:   "room.1",
+			Channel:   "room.1",
+			Message:   json.RawMessage(`{"notification":true,"method":"` + method + `","data":null}`),
+		}))
+	}
+
+	start := time.Now()
+	result, err := np.Replay(context.Background(), bytes.NewReader(recording.Bytes()), TapReplayOptions{Speed: 4})
+	require.NoError(t, err)
+	elapsed := time.Since(start)
+	assert.Equal(t, 2, result.Replayed)
+	assert.True(t, elapsed >= 100*time.Millisecond, "%v", elapsed)
+	assert.True(t, elapsed < 400*time.Millisecond, "%v", elapsed)
+	received := receive(t, notifications, 2)
+	assert.Equal(t, "join", received[0].Method)
+	assert.Equal(t, "leave", received[1].Method)
+}
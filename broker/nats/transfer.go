@@ -0,0 +1,648 @@
+package nprotoo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// TransferMethod is the reserved method a transfer is offered to the listener of OnTransfer with.
+	TransferMethod = "$transfer"
+	// FeatureTransfer is reported in the Capabilities of NatsProtoos receiving transfers.
+	FeatureTransfer = "transfer"
+	// TransferSubjectPrefix prefixes the per-transfer subject the chunks are sent on.
+	TransferSubjectPrefix = "_NPROTOO.transfer."
+	// TransferOfferPrefix prefixes the channel transfers are offered on, see TransferChannel.
+	TransferOfferPrefix = "_NPROTOO.offer."
+
+	DefaultTransferChunkSize   = 64 * 1024
+	DefaultTransferWindow      = 16
+	DefaultTransferMaxRetries  = 5
+	DefaultTransferSyncTimeout = 10 * time.Second
+	DefaultTransferIdleTimeout = 30 * time.Second
+	// MaxTransferWindow bounds the Window of the transfers accepted by a TransferReader.
+	MaxTransferWindow = 1024
+
+	// Headers of the messages sent on the subject of a transfer.
+	transferKindHeader     = "Nprotoo-Transfer"
+	transferSeqHeader      = "Nprotoo-Transfer-Seq"
+	transferChecksumHeader = "Nprotoo-Transfer-Checksum"
+
+	// Kinds of the messages sent on the subject of a transfer.
+	transferChunk = "chunk"
+	transferSync  = "sync"
+	transferEnd   = "end"
+	transferAbort = "abort"
+)
+
+var (
+	// ErrTransferAborted is returned once the other side of a transfer gave up on it.
+	ErrTransferAborted = errors.New("nprotoo: transfer aborted")
+	// ErrTransferCorrupt is returned when the received data does not match the checksum of the sender.
+	ErrTransferCorrupt = errors.New("nprotoo: transfer checksum mismatch")
+	// ErrTransferIncomplete is returned when chunks were still missing after every retransmission.
+	ErrTransferIncomplete = errors.New("nprotoo: transfer chunks missing after retransmission")
+	// ErrTransferTimeout is returned when the sender of a transfer went silent.
+	ErrTransferTimeout = errors.New("nprotoo: transfer timed out")
+	// ErrTransferClosed is returned for writes to a closed transfer.
+	ErrTransferClosed = errors.New("nprotoo: transfer closed")
+	// ErrTransferWindow is returned for offers of a Window above MaxTransferWindow.
+	ErrTransferWindow = errors.New("nprotoo: transfer window too large")
+	// ErrHeadersRequired is returned for transfers over a server without NATS headers.
+	ErrHeadersRequired = errors.New("nprotoo: transfers require a server supporting headers")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// TransferOffer describes a transfer to its receiver.
+type TransferOffer struct {
+	ID          string `json:"id"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// Size is the number of bytes sent, if known in advance.
+	Size int64 `json:"size,omitempty"`
+	// ChunkSize is the size of the chunks, DefaultTransferChunkSize if 0.
+	ChunkSize int `json:"chunk_size"`
+	// Window is the number of chunks sent before the sender waits for the receiver to
+	// report the missing ones, DefaultTransferWindow if 0, at most MaxTransferWindow. It
+	// bounds the chunks buffered on either side.
+	Window   int      `json:"window"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// transferAccept answers a TransferOffer.
+type transferAccept struct {
+	Subject string `json:"subject"`
+}
+
+// transferSyncData is sent after every window of chunks and once all chunks were sent.
+type transferSyncData struct {
+	// Through is the sequence of the last chunk sent.
+	Through uint64 `json:"through"`
+	// Size and Checksum, the hex SHA-256 of every byte, are sent with the end of the transfer.
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// Timeout is the SyncTimeout of the sender, the receiver answers busy before it.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// transferStatus answers a transferSyncData.
+type transferStatus struct {
+	Missing []uint64 `json:"missing,omitempty"`
+	// Busy tells the sender the receiver is still more than a window of chunks behind.
+	Busy  bool   `json:"busy,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// TransferFunc receives the transfers offered on a channel. It is called on its own
+// goroutine and reads the transfer until io.EOF. Closing the reader early aborts the transfer.
+type TransferFunc func(reader *TransferReader)
+
+// TransferChannel returns the channel the transfers to channel are offered on. It is apart
+// from channel, so transfers and the requests of OnRequest are served side by side.
+func TransferChannel(channel string) string {
+	return TransferOfferPrefix + channel
+}
+
+// OnTransfer delivers the transfers sent to channel by NewTransferWriter to listener.
+// The transfers are offered on TransferChannel(channel), every chunk is sent on its own subject.
+func (np *NatsProtoo) OnTransfer(channel string, listener TransferFunc) {
+	np.AddFeature(FeatureTransfer)
+	np.OnRequest(TransferChannel(channel), func(request Request, accept RespondFunc, reject RejectFunc) {
+		if request.Method != TransferMethod {
+			accept(ErrNoListener.WithErrorf("Not found listener for %s!", request.Method))
+			return
+		}
+		var offer TransferOffer
+		if err := request.Data.Unmarshal(&offer); err != nil {
+			accept(err)
+			return
+		}
+		reader, err := np.newTransferReader(offer)
+		if err != nil {
+			accept(err)
+			return
+		}
+		logger.Debugf("Accept transfer [%s] %s on %s", offer.ID, offer.Name, reader.subject)
+		accept(transferAccept{Subject: reader.subject})
+		go listener(reader)
+	})
+}
+
+// TransferReader reads the data of a transfer in order. Chunks which were lost or corrupted
+// are sent again, and the data is checked against the checksum of the sender before io.EOF.
+type TransferReader struct {
+	Offer TransferOffer
+
+	np      *NatsProtoo
+	subject string
+	sub     *nats.Subscription
+	idle    *time.Timer
+
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	chunks map[uint64][]byte
+	// next is the sequence of the next chunk to read, hashed the last chunk hashed.
+	next   uint64
+	hashed uint64
+	hash   hash.Hash
+	size   int64
+	cur    []byte
+	// last is the sequence of the last chunk once the end of the transfer was received.
+	last uint64
+	end  bool
+	err  error
+}
+
+func (np *NatsProtoo) newTransferReader(offer TransferOffer) (*TransferReader, error) {
+	if !np.nc.HeadersSupported() {
+		return nil, ErrHeadersRequired
+	}
+	if offer.Window <= 0 {
+		offer.Window = DefaultTransferWindow
+	}
+	if offer.Window > MaxTransferWindow {
+		return nil, ErrTransferWindow
+	}
+	r := &TransferReader{
+		Offer:   offer,
+		np:      np,
+		subject: np.subject(TransferSubjectPrefix + nuid.Next()),
+		chunks:  make(map[uint64][]byte),
+		next:    1,
+		hash:    sha256.New(),
+	}
+	r.cond = sync.NewCond(&r.mutex)
+	sub, err := np.nc.Subscribe(r.subject, r.onMessage)
+	if err != nil {
+		return nil, err
+	}
+	r.sub = sub
+	r.idle = time.AfterFunc(DefaultTransferIdleTimeout, func() { r.fail(ErrTransferTimeout) })
+	return r, nil
+}
+
+func (r *TransferReader) onMessage(msg *nats.Msg) {
+	r.idle.Reset(DefaultTransferIdleTimeout)
+	switch msg.Header.Get(transferKindHeader) {
+	case transferChunk:
+		r.onChunk(msg)
+	case transferSync, transferEnd:
+		r.onSync(msg)
+	case transferAbort:
+		var data transferSyncData
+		json.Unmarshal(msg.Data, &data)
+		logger.Warnf("Transfer [%s] aborted by sender: %s", r.Offer.ID, data.Reason)
+		r.fail(ErrTransferAborted)
+	}
+}
+
+func (r *TransferReader) onChunk(msg *nats.Msg) {
+	seq, err := strconv.ParseUint(msg.Header.Get(transferSeqHeader), 10, 64)
+	if err != nil || seq == 0 {
+		return
+	}
+	if checksum := strconv.FormatUint(uint64(crc32.Checksum(msg.Data, castagnoli)), 16); checksum != msg.Header.Get(transferChecksumHeader) {
+		// Dropped like a lost chunk, it is requested again with the next sync.
+		logger.Warnf("Transfer [%s] chunk %d corrupted", r.Offer.ID, seq)
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, found := r.chunks[seq]; found || seq < r.next || r.err != nil {
+		return
+	}
+	if !r.inWindow(seq) {
+		// The sender never runs more than a window ahead of the chunks buffered here.
+		logger.Warnf("Transfer [%s] chunk %d beyond the window, dropped", r.Offer.ID, seq)
+		return
+	}
+	r.chunks[seq] = msg.Data
+	for chunk, found := r.chunks[r.hashed+1]; found; chunk, found = r.chunks[r.hashed+1] {
+		r.hash.Write(chunk)
+		r.size += int64(len(chunk))
+		r.hashed++
+	}
+	r.cond.Broadcast()
+}
+
+func (r *TransferReader) onSync(msg *nats.Msg) {
+	var data transferSyncData
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		respondTransfer(msg, transferStatus{Error: err.Error()})
+		return
+	}
+	final := msg.Header.Get(transferKindHeader) == transferEnd
+
+	r.mutex.Lock()
+	if r.err != nil {
+		err := r.err
+		r.mutex.Unlock()
+		respondTransfer(msg, transferStatus{Error: err.Error()})
+		return
+	}
+	if !r.inWindow(data.Through) {
+		r.mutex.Unlock()
+		r.fail(ErrTransferWindow)
+		respondTransfer(msg, transferStatus{Error: ErrTransferWindow.Error()})
+		return
+	}
+	var missing []uint64
+	for seq := r.next; seq <= data.Through; seq++ {
+		if _, found := r.chunks[seq]; !found {
+			missing = append(missing, seq)
+		}
+	}
+	if len(missing) > 0 {
+		r.mutex.Unlock()
+		respondTransfer(msg, transferStatus{Missing: missing})
+		return
+	}
+	if final {
+		r.end = true
+		r.last = data.Through
+		if checksum := hex.EncodeToString(r.hash.Sum(nil)); checksum != data.Checksum || r.size != data.Size {
+			logger.Warnf("Transfer [%s] received %d bytes %s, sent %d bytes %s", r.Offer.ID, r.size, checksum, data.Size, data.Checksum)
+			r.err = ErrTransferCorrupt
+		}
+		err := r.err
+		// Every chunk was received, the rest is read at the pace of the listener.
+		r.stop()
+		r.cond.Broadcast()
+		r.mutex.Unlock()
+		status := transferStatus{}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		respondTransfer(msg, status)
+		return
+	}
+	r.mutex.Unlock()
+
+	// The sender waits until the reader consumed all but a window of chunks, it is told
+	// the reader is busy before its sync times out.
+	wait := data.Timeout / 2
+	if wait <= 0 {
+		wait = DefaultTransferSyncTimeout / 2
+	}
+	go func() {
+		busy := false
+		timer := time.AfterFunc(wait, func() {
+			r.mutex.Lock()
+			busy = true
+			r.cond.Broadcast()
+			r.mutex.Unlock()
+		})
+		defer timer.Stop()
+		r.mutex.Lock()
+		for len(r.chunks) > r.Offer.Window && r.err == nil && !busy {
+			r.cond.Wait()
+		}
+		status := transferStatus{Busy: len(r.chunks) > r.Offer.Window}
+		if r.err != nil {
+			status = transferStatus{Error: r.err.Error()}
+		}
+		r.mutex.Unlock()
+		respondTransfer(msg, status)
+	}()
+}
+
+// inWindow reports whether the sender may have sent seq: it runs at most a window ahead
+// of the last sync, which returned once at most a window of chunks was buffered. r.mutex
+// must be held.
+func (r *TransferReader) inWindow(seq uint64) bool {
+	return seq < r.next+2*uint64(r.Offer.Window)
+}
+
+func respondTransfer(msg *nats.Msg, status transferStatus) {
+	payload, err := json.Marshal(&status)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	msg.Respond(payload)
+}
+
+// Read reads the data of the transfer. It returns io.EOF once every chunk was read and the
+// data matched the checksum of the sender, ErrTransferCorrupt if it did not.
+func (r *TransferReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for len(r.cur) == 0 {
+		if chunk, found := r.chunks[r.next]; found {
+			delete(r.chunks, r.next)
+			r.next++
+			r.cur = chunk
+			r.cond.Broadcast()
+			continue
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.end && r.next > r.last {
+			r.stop()
+			return 0, io.EOF
+		}
+		r.cond.Wait()
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops receiving the transfer. A transfer closed before it was read completely is
+// aborted, which fails the writes of the sender.
+func (r *TransferReader) Close() error {
+	r.fail(ErrTransferAborted)
+	return nil
+}
+
+// fail stops the transfer with err, unless it ended already.
+func (r *TransferReader) fail(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil && !(r.end && r.next > r.last) {
+		r.err = err
+	}
+	r.stop()
+	r.cond.Broadcast()
+}
+
+// stop unsubscribes the subject of the transfer. r.mutex must be held.
+func (r *TransferReader) stop() {
+	r.idle.Stop()
+	r.sub.Unsubscribe()
+}
+
+// TransferWriter sends data in chunks to the receiver of a transfer. Close must be called
+// once every byte was written, it returns once the receiver verified the data.
+type TransferWriter struct {
+	Offer TransferOffer
+
+	np      *NatsProtoo
+	ctx     context.Context
+	subject string
+
+	// MaxRetries bounds how often missing chunks of a window, or a sync which timed out,
+	// are sent again.
+	MaxRetries int
+	// SyncTimeout bounds the wait for the receiver to report the missing chunks.
+	SyncTimeout time.Duration
+
+	// publish sends the messages of the transfer and request its syncs, both replaced in tests
+	// to lose them.
+	publish func(msg *nats.Msg) error
+	request func(ctx context.Context, msg *nats.Msg) (*nats.Msg, error)
+
+	mutex   sync.Mutex
+	buf     []byte
+	seq     uint64
+	pending map[uint64][]byte
+	hash    hash.Hash
+	size    int64
+	err     error
+}
+
+// NewTransferWriter offers a transfer to the listener of OnTransfer on channel and returns
+// the writer of its data. The transfer is aborted once ctx is done.
+func (np *NatsProtoo) NewTransferWriter(ctx context.Context, channel string, offer TransferOffer) (*TransferWriter, error) {
+	if !np.nc.HeadersSupported() {
+		return nil, ErrHeadersRequired
+	}
+	if offer.ID == _EMPTY_ {
+		offer.ID = nuid.Next()
+	}
+	if offer.ChunkSize <= 0 {
+		offer.ChunkSize = DefaultTransferChunkSize
+	}
+	if max := int(np.nc.MaxPayload()) - 1024; max > 0 && offer.ChunkSize > max {
+		offer.ChunkSize = max
+	}
+	if offer.Window <= 0 {
+		offer.Window = DefaultTransferWindow
+	}
+	result, rerr := np.NewRequestor(TransferChannel(channel)).SyncRequestContext(ctx, TransferMethod, &offer)
+	if rerr != nil {
+		return nil, rerr
+	}
+	var accepted transferAccept
+	if err := result.Unmarshal(&accepted); err != nil {
+		return nil, err
+	}
+	logger.Debugf("Transfer [%s] %s accepted on %s", offer.ID, offer.Name, accepted.Subject)
+	return &TransferWriter{
+		Offer:       offer,
+		np:          np,
+		ctx:         ctx,
+		subject:     accepted.Subject,
+		MaxRetries:  DefaultTransferMaxRetries,
+		SyncTimeout: DefaultTransferSyncTimeout,
+		publish:     np.nc.PublishMsg,
+		request:     np.nc.RequestMsgWithContext,
+		buf:         make([]byte, 0, offer.ChunkSize),
+		pending:     make(map[uint64][]byte, offer.Window),
+		hash:        sha256.New(),
+	}, nil
+}
+
+// SendTransfer sends everything read from r as a transfer to the listener of OnTransfer on channel.
+func (np *NatsProtoo) SendTransfer(ctx context.Context, channel string, offer TransferOffer, r io.Reader) error {
+	w, err := np.NewTransferWriter(ctx, channel, offer)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort(err.Error())
+		return err
+	}
+	return w.Close()
+}
+
+// Write sends p in chunks. It blocks while the receiver is a window of chunks behind.
+func (w *TransferWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := w.Offer.ChunkSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == w.Offer.ChunkSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush sends the buffered chunk. w.mutex must be held.
+func (w *TransferWriter) flush() error {
+	chunk := w.buf
+	w.buf = make([]byte, 0, w.Offer.ChunkSize)
+	w.seq++
+	w.pending[w.seq] = chunk
+	w.hash.Write(chunk)
+	w.size += int64(len(chunk))
+	if err := w.sendChunk(w.seq, chunk); err != nil {
+		return w.fail(err)
+	}
+	transferChunks.WithLabelValues("sent").Inc()
+	if len(w.pending) >= w.Offer.Window {
+		return w.sync(transferSync, transferSyncData{Through: w.seq})
+	}
+	return nil
+}
+
+func (w *TransferWriter) sendChunk(seq uint64, chunk []byte) error {
+	msg := nats.NewMsg(w.subject)
+	msg.Header.Set(transferKindHeader, transferChunk)
+	msg.Header.Set(transferSeqHeader, strconv.FormatUint(seq, 10))
+	msg.Header.Set(transferChecksumHeader, strconv.FormatUint(uint64(crc32.Checksum(chunk, castagnoli)), 16))
+	msg.Data = chunk
+	return w.publish(msg)
+}
+
+// sync asks the receiver for the missing chunks and sends them again until none is missing.
+// w.mutex must be held.
+func (w *TransferWriter) sync(kind string, data transferSyncData) error {
+	data.Timeout = w.SyncTimeout
+	payload, err := json.Marshal(&data)
+	if err != nil {
+		return w.fail(err)
+	}
+	for retry := 0; ; {
+		if err := w.ctx.Err(); err != nil {
+			w.abort(err.Error())
+			return w.fail(err)
+		}
+		msg := nats.NewMsg(w.subject)
+		msg.Header.Set(transferKindHeader, kind)
+		msg.Data = payload
+		ctx, cancel := context.WithTimeout(w.ctx, w.SyncTimeout)
+		reply, err := w.request(ctx, msg)
+		cancel()
+		if err == nats.ErrNoResponders {
+			// The receiver stopped listening to the transfer.
+			return w.fail(ErrTransferAborted)
+		}
+		if err == context.DeadlineExceeded && w.ctx.Err() == nil && retry < w.MaxRetries {
+			// The sync or its status was lost.
+			logger.Debugf("Transfer [%s] sync timed out, sending it again", w.Offer.ID)
+			retry++
+			continue
+		}
+		if err != nil {
+			w.abort(err.Error())
+			return w.fail(err)
+		}
+		var status transferStatus
+		if err := json.Unmarshal(reply.Data, &status); err != nil {
+			return w.fail(err)
+		}
+		switch {
+		case status.Error == ErrTransferCorrupt.Error():
+			return w.fail(ErrTransferCorrupt)
+		case status.Error != _EMPTY_:
+			logger.Warnf("Transfer [%s] failed by receiver: %s", w.Offer.ID, status.Error)
+			return w.fail(ErrTransferAborted)
+		case status.Busy:
+			// The listener reads slowly, the transfer is bounded by ctx.
+			continue
+		case len(status.Missing) == 0:
+			w.pending = make(map[uint64][]byte, w.Offer.Window)
+			return nil
+		case retry >= w.MaxRetries:
+			w.abort(ErrTransferIncomplete.Error())
+			return w.fail(ErrTransferIncomplete)
+		}
+		logger.Debugf("Transfer [%s] resend chunks %v", w.Offer.ID, status.Missing)
+		for _, seq := range status.Missing {
+			chunk, found := w.pending[seq]
+			if !found {
+				w.abort(ErrTransferIncomplete.Error())
+				return w.fail(ErrTransferIncomplete)
+			}
+			if err := w.sendChunk(seq, chunk); err != nil {
+				return w.fail(err)
+			}
+			transferChunks.WithLabelValues("retransmitted").Inc()
+		}
+		retry++
+	}
+}
+
+// Close sends the last chunk and waits for the receiver to verify the data.
+func (w *TransferWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		if w.err == ErrTransferClosed {
+			return nil
+		}
+		return w.err
+	}
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if err := w.sync(transferEnd, transferSyncData{
+		Through:  w.seq,
+		Size:     w.size,
+		Checksum: hex.EncodeToString(w.hash.Sum(nil)),
+	}); err != nil {
+		return err
+	}
+	logger.Debugf("Transfer [%s] sent %d bytes in %d chunks", w.Offer.ID, w.size, w.seq)
+	w.err = ErrTransferClosed
+	return nil
+}
+
+// Abort stops the transfer, the receiver reads ErrTransferAborted.
+func (w *TransferWriter) Abort(reason string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		w.abort(reason)
+		w.err = ErrTransferAborted
+	}
+}
+
+// abort tells the receiver the transfer was given up. w.mutex must be held.
+func (w *TransferWriter) abort(reason string) {
+	payload, _ := json.Marshal(&transferSyncData{Through: w.seq, Reason: reason})
+	msg := nats.NewMsg(w.subject)
+	msg.Header.Set(transferKindHeader, transferAbort)
+	msg.Data = payload
+	w.publish(msg)
+}
+
+// fail records err as the error of every following write. w.mutex must be held.
+func (w *TransferWriter) fail(err error) error {
+	if w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
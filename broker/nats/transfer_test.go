@@ -0,0 +1,223 @@
+package nprotoo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type transferResult struct {
+	offer TransferOffer
+	data  []byte
+	err   error
+}
+
+func receiveTransfers(np *NatsProtoo, channel string) chan transferResult {
+	results := make(chan transferResult, 1)
+	np.OnTransfer(channel, func(reader *TransferReader) {
+		data, err := ioutil.ReadAll(reader)
+		results <- transferResult{offer: reader.Offer, data: data, err: err}
+	})
+	return results
+}
+
+func awaitTransfer(t *testing.T, results chan transferResult) transferResult {
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer not received")
+		return transferResult{}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	np.OnRequest("media", func(request Request, accept RespondFunc, reject RejectFunc) {
+		accept(request.Method)
+	})
+	results := receiveTransfers(np, "media")
+
+	data := make([]byte, 300*1024+17)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	offer := TransferOffer{Name: "voice.ogg", ContentType: "audio/ogg", Size: int64(len(data)), ChunkSize: 4096, Window: 8}
+	require.NoError(t, np.SendTransfer(context.Background(), "media", offer, bytes.NewReader(data)))
+
+	result := awaitTransfer(t, results)
+	require.NoError(t, result.err)
+	assert.Equal(t, data, result.data)
+	assert.Equal(t, "voice.ogg", result.offer.Name)
+	assert.Equal(t, "audio/ogg", result.offer.ContentType)
+
+	reply, rerr := np.NewRequestor("media").SyncRequest("play", nil)
+	require.Nil(t, rerr)
+	assert.JSONEq(t, `"play"`, string(reply), "the request listener of the channel is kept")
+
+	capabilities, err := np.NewRequestor(TransferChannel("media")).Capabilities(context.Background())
+	require.NoError(t, err)
+	assert.True(t, capabilities.Supports(FeatureTransfer))
+}
+
+func TestTransferRetransmit(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	results := receiveTransfers(np, "media")
+
+	w, err := np.NewTransferWriter(context.Background(), "media", TransferOffer{ChunkSize: 1024, Window: 4})
+	require.NoError(t, err)
+	sent := make(map[string]int)
+	w.publish = func(msg *nats.Msg) error {
+		seq := msg.Header.Get(transferSeqHeader)
+		sent[seq]++
+		if sent[seq] > 1 {
+			return np.nc.PublishMsg(msg)
+		}
+		switch seq {
+		case "3", "10":
+			return nil
+		case "6":
+			corrupt := nats.NewMsg(msg.Subject)
+			corrupt.Header = msg.Header
+			corrupt.Data = append([]byte{^msg.Data[0]}, msg.Data[1:]...)
+			return np.nc.PublishMsg(corrupt)
+		}
+		return np.nc.PublishMsg(msg)
+	}
+
+	data := make([]byte, 10*1024+1)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	_, err = io.Copy(w, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	result := awaitTransfer(t, results)
+	require.NoError(t, result.err)
+	assert.Equal(t, data, result.data)
+	assert.Equal(t, 2, sent["3"], "lost chunks are sent again")
+	assert.Equal(t, 2, sent["6"], "corrupted chunks are sent again")
+	assert.Equal(t, 2, sent["10"])
+	assert.Equal(t, 1, sent["1"])
+}
+
+func TestTransferAborted(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	np.OnTransfer("media", func(reader *TransferReader) { reader.Close() })
+
+	w, err := np.NewTransferWriter(context.Background(), "media", TransferOffer{ChunkSize: 16, Window: 2})
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = w.Write(make([]byte, 64))
+	assert.Equal(t, ErrTransferAborted, err)
+	assert.Equal(t, ErrTransferAborted, w.Close())
+
+	results := make(chan error, 1)
+	np.OnTransfer("uploads", func(reader *TransferReader) {
+		_, err := ioutil.ReadAll(reader)
+		results <- err
+	})
+	w, err = np.NewTransferWriter(context.Background(), "uploads", TransferOffer{})
+	require.NoError(t, err)
+	w.Write([]byte("partial"))
+	w.Abort("canceled by user")
+	select {
+	case err := <-results:
+		assert.Equal(t, ErrTransferAborted, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("abort not received")
+	}
+}
+
+func TestTransferSlowReader(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	readers := make(chan *TransferReader, 1)
+	np.OnTransfer("media", func(reader *TransferReader) { readers <- reader })
+
+	w, err := np.NewTransferWriter(context.Background(), "media", TransferOffer{ChunkSize: 16, Window: 2})
+	require.NoError(t, err)
+	w.SyncTimeout = 100 * time.Millisecond
+	lost := 0
+	w.request = func(ctx context.Context, msg *nats.Msg) (*nats.Msg, error) {
+		if lost < 2 {
+			// The syncs are lost, and sent again once they timed out.
+			lost++
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return np.nc.RequestMsgWithContext(ctx, msg)
+	}
+	reader := <-readers
+
+	data := make([]byte, 16*8)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		written <- err
+	}()
+
+	// The reader is behind for more than MaxRetries sync timeouts, the sender waits for it.
+	time.Sleep(time.Duration(w.MaxRetries+3) * w.SyncTimeout)
+	read := make([]byte, 0, len(data))
+	buf := make([]byte, 16)
+	for len(read) < len(data) {
+		n, err := reader.Read(buf)
+		require.NoError(t, err)
+		read = append(read, buf[:n]...)
+	}
+	select {
+	case err := <-written:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer not sent")
+	}
+	assert.Equal(t, 2, lost)
+	assert.False(t, reader.sub.IsValid(), "the reader stops listening once the end was accepted")
+	n, err := reader.Read(buf)
+	assert.Zero(t, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestTransferWindow(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	readers := make(chan *TransferReader, 1)
+	np.OnTransfer("media", func(reader *TransferReader) { readers <- reader })
+
+	_, err := np.NewTransferWriter(context.Background(), "media", TransferOffer{Window: MaxTransferWindow + 1})
+	assert.Error(t, err)
+
+	w, err := np.NewTransferWriter(context.Background(), "media", TransferOffer{ChunkSize: 16, Window: 2})
+	require.NoError(t, err)
+	reader := <-readers
+	for _, seq := range []uint64{1, 4, 5, 100} {
+		require.NoError(t, w.sendChunk(seq, []byte("chunk")))
+	}
+	require.NoError(t, np.nc.Flush())
+	time.Sleep(50 * time.Millisecond)
+	reader.mutex.Lock()
+	assert.Len(t, reader.chunks, 2, "chunks beyond twice the window are dropped")
+	assert.Contains(t, reader.chunks, uint64(4))
+	reader.mutex.Unlock()
+}
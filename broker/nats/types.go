@@ -1,9 +1,14 @@
 package nprotoo
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"time"
+
+	nats "github.com/nats-io/nats.go"
+
+	"github.com/mj23978/chat-backend-x/utils"
 )
 
 type RawMessage []byte
@@ -27,13 +32,16 @@ func (m *RawMessage) UnmarshalJSON(data []byte) error {
 
 func (r RawMessage) Unmarshal(msgType interface{}) *Error {
 	if err := json.Unmarshal(r, &msgType); err != nil {
-		return &Error{Code: 400, Reason: err.Error()}
+		return &Error{Code: utils.CodeBadRequest, Reason: err.Error()}
 	}
 	return nil
 }
 
 // AcceptFunc .
 type AcceptFunc func(data RawMessage)
+
+// RespondFunc sends data as the successful response of a request. If data is an error
+// the request is rejected instead, keeping every detail of the error on the wire.
 type RespondFunc func(data interface{})
 
 // RejectFunc .
@@ -49,12 +57,19 @@ type PeerMsg struct {
 	RequestData
 	ResponseData
 	NotificationData
+	CancelData
+	AckData
 	CommonData
 }
 
 type RequestData struct {
 	Request   bool   `json:"request"`
 	ReplySubj string `json:"reply"`
+	// Deadline is the absolute deadline of the request in unix milliseconds, 0 if it has none.
+	Deadline int64 `json:"deadline,omitempty"`
+	// Timeout is the time the request had left when it was sent in milliseconds. Receivers
+	// prefer it over Deadline, which is only right while the clocks of both nodes agree.
+	Timeout int64 `json:"timeout,omitempty"`
 }
 
 type ResponseData struct {
@@ -64,18 +79,144 @@ type ResponseData struct {
 }
 
 type ResponseErrData struct {
-	ErrorCode   int    `json:"errorCode"`
-	ErrorReason string `json:"errorReason"`
+	ErrorCode        int                    `json:"errorCode"`
+	ErrorReason      string                 `json:"errorReason"`
+	ErrorStatus      string                 `json:"errorStatus,omitempty"`
+	ErrorDescription string                 `json:"errorDescription,omitempty"`
+	ErrorDebug       string                 `json:"errorDebug,omitempty"`
+	ErrorDetails     map[string]interface{} `json:"errorDetails,omitempty"`
+	RequestID        string                 `json:"requestId,omitempty"`
+}
+
+// NewResponseErrData converts err into the error fields of a response.
+// The message of err is sent as errorReason and its utils.ReasonCarrier reason as errorDescription.
+func NewResponseErrData(err error) ResponseErrData {
+	de := utils.ToDetailedError(err)
+	return ResponseErrData{
+		ErrorCode:        de.StatusCode(),
+		ErrorReason:      de.Error(),
+		ErrorStatus:      de.Status(),
+		ErrorDescription: de.Reason(),
+		ErrorDebug:       de.Debug(),
+		ErrorDetails:     de.Details(),
+		RequestID:        de.RequestID(),
+	}
+}
+
+// ToError converts the error fields of a response back into a *utils.DetailedError.
+func (d ResponseErrData) ToError() *utils.DetailedError {
+	de := utils.NewDetailedError(d.ErrorCode, d.ErrorReason)
+	if d.ErrorStatus != "" {
+		de.StatusField = d.ErrorStatus
+	}
+	de.ReasonField = d.ErrorDescription
+	de.DebugField = d.ErrorDebug
+	de.DetailsField = d.ErrorDetails
+	de.RIDField = d.RequestID
+	return de
 }
 
 type NotificationData struct {
 	Notification bool `json:"notification"`
+	// AckRequired asks every subscriber to ack the notification to the reply subject.
+	AckRequired bool `json:"ackRequired,omitempty"`
+	// Seq is the sequence number of the notification among those sent on its channel by
+	// Source, set by broadcasters WithSequence. Source is the node ID of the sender and the
+	// epoch of its process, separated by a slash.
+	Seq    uint64 `json:"seq,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// AckData marks a control message acking notification ID on behalf of subscriber Node.
+type AckData struct {
+	Ack  bool   `json:"ack,omitempty"`
+	Node string `json:"node,omitempty"`
+}
+
+// CancelData marks a control message telling the handler of request ID to stop working on it.
+type CancelData struct {
+	Cancel bool `json:"cancel,omitempty"`
 }
 
 type CommonData struct {
-	ID     int        `json:"id"`
-	Method string     `json:"method"`
-	Data   RawMessage `json:"data"`
+	// Version is the protocol version of the envelope, see ProtocolVersion. Envelopes
+	// without it were sent by peers released before the envelope was versioned.
+	Version int        `json:"v,omitempty"`
+	ID      int        `json:"id"`
+	Method  string     `json:"method"`
+	Data    RawMessage `json:"data"`
+	// Metadata is only sent in the envelope if the server does not support NATS headers.
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// Metadata carries cross-cutting values of a message such as trace context, auth tokens,
+// content type, tenant, locale or a correlation ID.
+type Metadata map[string]string
+
+const (
+	// ChannelMetadata is set on the notifications pushed to peers, e.g. over WebSocket or
+	// Server-Sent Events, to the channel they were broadcast on.
+	ChannelMetadata = "channel"
+	// PeerSubjectMetadata is set on the requests of an authenticated peer to the subject of its token.
+	PeerSubjectMetadata = "Peer-Subject"
+	// AuthorizationMetadata is set on the requests of an authenticated peer to its bearer token.
+	AuthorizationMetadata = "Authorization"
+)
+
+// Get returns the value of key, or an empty string.
+func (md Metadata) Get(key string) string {
+	if md == nil {
+		return _EMPTY_
+	}
+	return md[key]
+}
+
+// Clone returns a copy of md.
+func (md Metadata) Clone() Metadata {
+	if md == nil {
+		return nil
+	}
+	c := make(Metadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+func (md Metadata) header() nats.Header {
+	h := make(nats.Header, len(md))
+	for k, v := range md {
+		h[k] = []string{v}
+	}
+	return h
+}
+
+func (md Metadata) merge(h nats.Header) Metadata {
+	if len(h) == 0 {
+		return md
+	}
+	if md == nil {
+		md = make(Metadata, len(h))
+	}
+	for k, v := range h {
+		if len(v) > 0 {
+			md[k] = v[0]
+		}
+	}
+	return md
+}
+
+type metadataKey struct{}
+
+// NewMetadataContext returns a context carrying md. Requests sent with it carry md.
+func NewMetadataContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext returns the metadata set by NewMetadataContext.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
 }
 
 func (m PeerMsg) ToNotification() Notification {
@@ -106,14 +247,23 @@ func NewResponse(id int, data interface{}) (*Response, error) {
 }
 
 func NewResponseErr(id int, errorCode int, errorReason string) *Response {
+	return newResponseErr(id, ResponseErrData{
+		ErrorCode:   errorCode,
+		ErrorReason: errorReason,
+	})
+}
+
+// NewResponseErrFromError builds an error response carrying every detail of err.
+func NewResponseErrFromError(id int, err error) *Response {
+	return newResponseErr(id, NewResponseErrData(err))
+}
+
+func newResponseErr(id int, data ResponseErrData) *Response {
 	response := &Response{
 		ResponseData: ResponseData{
-			Response: true,
-			Ok:       false,
-			ResponseErrData: ResponseErrData{
-				ErrorCode:   errorCode,
-				ErrorReason: errorReason,
-			},
+			Response:        true,
+			Ok:              false,
+			ResponseErrData: data,
 		},
 		CommonData: CommonData{
 			ID: id,
@@ -138,6 +288,57 @@ func NewResponseErr(id int, errorCode int, errorReason string) *Response {
 type Request struct {
 	RequestData
 	CommonData
+
+	ctx context.Context
+	// version is the protocol version of the requestor, its response is sent with.
+	version int
+}
+
+// Context returns the context of the request. It carries the deadline set by the requestor
+// and is done once the request was answered.
+func (r Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// DeadlineTime returns the deadline of the request, if it has one.
+func (r RequestData) DeadlineTime() (time.Time, bool) {
+	if r.Deadline == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, r.Deadline*int64(time.Millisecond)), true
+}
+
+// setTimeout sets Deadline and Timeout for a request sent at now which must be answered by deadline.
+func (r *RequestData) setTimeout(now, deadline time.Time) {
+	r.Deadline = deadline.UnixNano() / int64(time.Millisecond)
+	r.Timeout = int64(deadline.Sub(now) / time.Millisecond)
+}
+
+// localDeadline moves the Deadline of a request received at now to now plus its Timeout,
+// so the deadline does not depend on the clock of the requestor.
+func (r *RequestData) localDeadline(now time.Time) {
+	if r.Timeout > 0 {
+		r.Deadline = now.Add(time.Duration(r.Timeout)*time.Millisecond).UnixNano() / int64(time.Millisecond)
+	}
+}
+
+// Expired reports whether the deadline of the request passed.
+func (r RequestData) Expired() bool {
+	deadline, ok := r.DeadlineTime()
+	return ok && !time.Now().Before(deadline)
+}
+
+func (r Request) withContext(parent context.Context) (Request, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if deadline, ok := r.DeadlineTime(); ok {
+		r.ctx, cancel = context.WithDeadline(parent, deadline)
+	} else {
+		r.ctx, cancel = context.WithCancel(parent)
+	}
+	return r, cancel
 }
 
 /*
@@ -186,6 +387,9 @@ type ResponseError struct {
 type Notification struct {
 	CommonData
 	NotificationData
+	// Sequence and Timestamp are set from the stream for notifications delivered by OnDurableBroadcast.
+	Sequence  uint64    `json:"-"`
+	Timestamp time.Time `json:"-"`
 }
 
 // Transcation .
@@ -193,6 +397,12 @@ type Transcation struct {
 	id     int
 	accept AcceptFunc
 	reject RejectFunc
+	fail   func(data ResponseErrData)
+	done   chan struct{}
 	close  func()
 	timer  *time.Timer
+	// deadline is when timer fires. While paused, remaining holds the time it had left.
+	deadline  time.Time
+	remaining time.Duration
+	paused    bool
 }
@@ -0,0 +1,114 @@
+package nprotoo
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mj23978/chat-backend-x/utils"
+)
+
+func TestResponseErrDataRoundTrip(t *testing.T) {
+	original := utils.ErrUnauthorized.
+		WithReason("token expired").
+		WithDebug("exp=1").
+		WithDetail("user", "u1").
+		WithRequestID("rid")
+
+	payload, err := json.Marshal(NewResponseErrFromError(1, original))
+	require.NoError(t, err)
+
+	var response Response
+	require.NoError(t, json.Unmarshal(payload, &response))
+	assert.False(t, response.Ok)
+	assert.Equal(t, utils.CodeUnauthorized, response.ErrorCode)
+	assert.Equal(t, original, response.ToError())
+
+	remote := newError(response.ResponseErrData)
+	assert.Equal(t, original.Error(), remote.Error())
+	assert.Equal(t, original, utils.ToDetailedError(remote))
+	assert.Equal(t, utils.CodeUnauthorized, remote.Detailed().ToHerodot().StatusCode())
+}
+
+func TestResponseErrDataLegacy(t *testing.T) {
+	de := NewResponseErr(1, 404, "Not found").ToError()
+	assert.Equal(t, 404, de.StatusCode())
+	assert.Equal(t, "Not Found", de.Status())
+	assert.Equal(t, "Not found", de.Error())
+	assert.Equal(t, 480, (&Error{Code: 480, Reason: "timeout"}).Detailed().StatusCode())
+}
+
+func TestRequestDeadline(t *testing.T) {
+	var request Request
+	assert.False(t, request.Expired())
+	_, ok := request.Context().Deadline()
+	assert.False(t, ok)
+
+	request.Deadline = time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	assert.True(t, request.Expired())
+
+	deadline := time.Now().Add(time.Minute)
+	request.Deadline = deadline.UnixNano() / int64(time.Millisecond)
+	assert.False(t, request.Expired())
+
+	request, cancel := request.withContext(context.Background())
+	actual, ok := request.Context().Deadline()
+	require.True(t, ok)
+	assert.WithinDuration(t, deadline, actual, time.Millisecond)
+
+	cancel()
+	assert.Error(t, request.Context().Err())
+}
+
+func TestRequestTimeoutClockSkew(t *testing.T) {
+	sent := time.Now()
+	var request Request
+	request.setTimeout(sent, sent.Add(2*time.Second))
+	assert.EqualValues(t, 2000, request.Timeout)
+
+	// The clock of the receiver is ahead by a minute.
+	received := sent.Add(time.Minute)
+	request.localDeadline(received)
+	deadline, ok := request.DeadlineTime()
+	require.True(t, ok)
+	assert.WithinDuration(t, received.Add(2*time.Second), deadline, time.Millisecond)
+
+	legacy := Request{RequestData: RequestData{Deadline: 42}}
+	legacy.localDeadline(received)
+	assert.EqualValues(t, 42, legacy.Deadline, "requests without timeout keep their deadline")
+}
+
+func TestMethodLabel(t *testing.T) {
+	np := &NatsProtoo{mutex: new(sync.Mutex), methods: make(map[string][]MethodDescription)}
+	np.RegisterMethod("rpc-chat.*", MethodDescription{Name: "send"})
+	assert.Equal(t, "send", np.methodLabel("rpc-chat.1", "send"))
+	assert.Equal(t, otherMethod, np.methodLabel("rpc-chat.1", "random-1234"))
+	assert.Equal(t, otherMethod, np.methodLabel("rpc-auth", "send"))
+	assert.Equal(t, DescribeMethod, np.methodLabel("rpc-auth", DescribeMethod))
+}
+
+func TestMetadata(t *testing.T) {
+	var md Metadata
+	assert.Equal(t, "", md.Get("tenant"))
+	assert.Nil(t, md.Clone())
+
+	md = md.merge(nats.Header{"tenant": []string{"acme"}, "Trace-Id": []string{"t1", "t2"}})
+	assert.Equal(t, Metadata{"tenant": "acme", "Trace-Id": "t1"}, md)
+	assert.Equal(t, nats.Header{"tenant": []string{"acme"}, "Trace-Id": []string{"t1"}}, md.header())
+
+	ctx := NewMetadataContext(context.Background(), md)
+	assert.Equal(t, md, MetadataFromContext(ctx))
+	assert.Nil(t, MetadataFromContext(context.Background()))
+
+	payload, err := json.Marshal(&Notification{CommonData: CommonData{Method: "m", Metadata: md}})
+	require.NoError(t, err)
+	var msg PeerMsg
+	require.NoError(t, json.Unmarshal(payload, &msg))
+	assert.Equal(t, md, msg.ToNotification().Metadata)
+}
@@ -0,0 +1,271 @@
+package nprotoo
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"github.com/mj23978/chat-backend-x/utils"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	// ProtocolVersion is the version of the envelope sent by this NatsProtoo.
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest version which is still accepted through the VersionAdapters.
+	MinProtocolVersion = 1
+	// legacyVersion is the version of the envelopes sent before they carried a version.
+	legacyVersion = 1
+
+	// CapabilitiesMethod is the reserved method every NatsProtoo answers with its Capabilities,
+	// on each channel it serves requests on. It is answered whatever version it is sent with.
+	CapabilitiesMethod = "$capabilities"
+	// ErrorCodeUnsupportedVersion is the error code of requests sent with an unsupported version.
+	ErrorCodeUnsupportedVersion = 505
+)
+
+// Features reported in the Capabilities of every NatsProtoo.
+const (
+	FeatureCancel   = "cancel"
+	FeatureAck      = "ack"
+	FeatureSequence = "sequence"
+	FeatureDescribe = "describe"
+	FeatureHeaders  = "headers"
+)
+
+// ErrUnsupportedVersion is returned when a peer does not support any version this NatsProtoo does.
+var ErrUnsupportedVersion = utils.NewDetailedError(ErrorCodeUnsupportedVersion, "unsupported protocol version")
+
+// VersionAdapter converts an envelope between a version and the next one. Upgrade is applied
+// to the envelopes received in the older version, Downgrade to the envelopes sent to a peer
+// which negotiated the older version. A nil func leaves the envelope as is.
+type VersionAdapter struct {
+	Upgrade   func(msg *PeerMsg) error
+	Downgrade func(msg *PeerMsg) error
+}
+
+// Capabilities is the answer to CapabilitiesMethod.
+type Capabilities struct {
+	// Version and MinVersion bound the protocol versions the peer accepts.
+	Version    int      `json:"version"`
+	MinVersion int      `json:"min_version"`
+	Features   []string `json:"features"`
+	Service    string   `json:"service"`
+	NodeID     string   `json:"node_id"`
+}
+
+// Supports reports whether the peer reported feature.
+func (c Capabilities) Supports(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyCapabilities are assumed for peers which do not answer CapabilitiesMethod.
+var legacyCapabilities = Capabilities{Version: legacyVersion, MinVersion: legacyVersion}
+
+// defaultVersionAdapters convert between the released versions. Version 1 envelopes only
+// lack the version, which is assumed if missing, so they need no conversion.
+func defaultVersionAdapters() map[int]VersionAdapter {
+	return map[int]VersionAdapter{legacyVersion: {}}
+}
+
+// SetVersionAdapter sets the adapter converting envelopes between version and version+1.
+func (np *NatsProtoo) SetVersionAdapter(version int, adapter VersionAdapter) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	np.adapters[version] = adapter
+}
+
+// AddFeature adds features to the Capabilities, e.g. the optional methods of the service.
+func (np *NatsProtoo) AddFeature(features ...string) {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	for _, feature := range features {
+		np.features[feature] = true
+	}
+}
+
+// Capabilities returns the protocol versions and features of this NatsProtoo.
+func (np *NatsProtoo) Capabilities() Capabilities {
+	features := []string{FeatureCancel, FeatureAck, FeatureSequence, FeatureDescribe}
+	if np.nc.HeadersSupported() {
+		features = append(features, FeatureHeaders)
+	}
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	for feature := range np.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return Capabilities{
+		Version:    ProtocolVersion,
+		MinVersion: np.minVersion(),
+		Features:   features,
+		Service:    np.service,
+		NodeID:     np.nodeID,
+	}
+}
+
+// minVersion returns the oldest version the adapters upgrade from. np.mutex must be held.
+func (np *NatsProtoo) minVersion() int {
+	version := ProtocolVersion
+	for version > MinProtocolVersion {
+		if _, found := np.adapters[version-1]; !found {
+			break
+		}
+		version--
+	}
+	return version
+}
+
+// peerVersion returns the version msg was sent with.
+func peerVersion(msg *PeerMsg) int {
+	if msg.Version == 0 {
+		return legacyVersion
+	}
+	return msg.Version
+}
+
+// upgrade converts a received envelope to ProtocolVersion.
+func (np *NatsProtoo) upgrade(msg *PeerMsg) error {
+	version := peerVersion(msg)
+	np.mutex.Lock()
+	min := np.minVersion()
+	if version < min || version > ProtocolVersion {
+		np.mutex.Unlock()
+		return ErrUnsupportedVersion.WithReasonf("unsupported protocol version %d, supported %d-%d", version, min, ProtocolVersion).
+			WithDetail("version", version).WithDetail("min_version", min).WithDetail("max_version", ProtocolVersion)
+	}
+	adapters := make([]VersionAdapter, 0, ProtocolVersion-version)
+	for v := version; v < ProtocolVersion; v++ {
+		adapters = append(adapters, np.adapters[v])
+	}
+	np.mutex.Unlock()
+	for _, adapter := range adapters {
+		if adapter.Upgrade != nil {
+			if err := adapter.Upgrade(msg); err != nil {
+				return err
+			}
+		}
+	}
+	msg.Version = ProtocolVersion
+	return nil
+}
+
+// encodeAt encodes msg for a peer of version, converted by the VersionAdapters.
+func (np *NatsProtoo) encodeAt(msg *PeerMsg, version int) ([]byte, nats.Header, error) {
+	np.mutex.Lock()
+	adapters := make([]VersionAdapter, 0, ProtocolVersion-version)
+	for v := ProtocolVersion - 1; v >= version; v-- {
+		adapters = append(adapters, np.adapters[v])
+	}
+	np.mutex.Unlock()
+	for _, adapter := range adapters {
+		if adapter.Downgrade != nil {
+			if err := adapter.Downgrade(msg); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	msg.Version = version
+	return np.encode(msg, &msg.CommonData)
+}
+
+// rejectUnsupported answers a message whose version could not be upgraded.
+func (np *NatsProtoo) rejectUnsupported(msg *PeerMsg, err error, raw *nats.Msg) {
+	version := strconv.Itoa(peerVersion(msg))
+	logger.Warnf("Drop message [%s] of %s: %v", msg.Method, raw.Subject, err)
+	unsupportedVersions.WithLabelValues(version).Inc()
+	if msg.Request && raw.Reply != _EMPTY_ {
+		response := NewResponseErrFromError(msg.ID, err)
+		payload, _, err := np.encode(response, &response.CommonData)
+		if err == nil {
+			np.Reply(payload, raw.Reply)
+		}
+		return
+	}
+	np.deadLetter(DeadLetterUnsupportedVersion, err.Error(), raw)
+}
+
+// Capabilities asks a peer serving the channel of the requestor for its Capabilities.
+// Peers released before the capability exchange are reported with version 1 and no features.
+// They are told by their answer: any error, e.g. of a missing listener, or any data which is
+// not Capabilities. Only requests which were not answered, e.g. timed out, fail.
+func (req *Requestor) Capabilities(ctx context.Context) (Capabilities, error) {
+	result, rerr := req.AsyncRequestContext(ctx, CapabilitiesMethod, nil).Await()
+	if rerr != nil {
+		if !answered(rerr) {
+			return Capabilities{}, rerr
+		}
+		return legacyCapabilities, nil
+	}
+	var capabilities Capabilities
+	if err := json.Unmarshal(result, &capabilities); err != nil || capabilities.Version == 0 {
+		return legacyCapabilities, nil
+	}
+	return capabilities, nil
+}
+
+// answered reports whether err was answered by a peer rather than raised by the requestor.
+func answered(err *Error) bool {
+	switch err.Code {
+	case ErrorCodeTimeout, ErrorCodeCanceled, utils.CodeUnavailable:
+		return false
+	}
+	return true
+}
+
+// Negotiate asks a peer for its Capabilities and sends the following requests with the
+// newest version both support. It fails with ErrUnsupportedVersion if there is none.
+func (req *Requestor) Negotiate(ctx context.Context) (Capabilities, error) {
+	capabilities, err := req.Capabilities(ctx)
+	if err != nil {
+		return capabilities, err
+	}
+	version := capabilities.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < MinProtocolVersion || version < capabilities.MinVersion {
+		return capabilities, ErrUnsupportedVersion.WithReasonf("no common protocol version with %s %s, supported %d-%d",
+			capabilities.Service, capabilities.NodeID, capabilities.MinVersion, capabilities.Version)
+	}
+	req.SetProtocolVersion(version)
+	logger.Debugf("Negotiated protocol version %d with %s %s", version, capabilities.Service, capabilities.NodeID)
+	return capabilities, nil
+}
+
+// SetProtocolVersion sets the version the requests are sent with, ProtocolVersion by default.
+func (req *Requestor) SetProtocolVersion(version int) error {
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return ErrUnsupportedVersion.WithReasonf("unsupported protocol version %d", version)
+	}
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	req.version = version
+	return nil
+}
+
+// WithProtocolVersion sends the notifications with version, e.g. while subscribers of an
+// older version are upgraded.
+func (bc *Broadcaster) WithProtocolVersion(version int) (*Broadcaster, error) {
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return nil, ErrUnsupportedVersion.WithReasonf("unsupported protocol version %d", version)
+	}
+	bc.version = version
+	return bc, nil
+}
+
+// encode encodes notification with the version of the broadcaster.
+func (bc *Broadcaster) encode(notification *Notification) ([]byte, nats.Header, error) {
+	if bc.version == 0 || bc.version == ProtocolVersion {
+		return bc.np.encode(notification, &notification.CommonData)
+	}
+	return bc.np.encodeAt(&PeerMsg{NotificationData: notification.NotificationData, CommonData: notification.CommonData}, bc.version)
+}
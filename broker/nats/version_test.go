@@ -0,0 +1,146 @@
+package nprotoo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionedEnvelope(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	np.OnRequest("rpc-versions", func(request Request, accept RespondFunc, reject RejectFunc) {
+		accept(request.Method)
+	})
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	call := func(payload string) PeerMsg {
+		reply, err := nc.Request("rpc-versions", []byte(payload), 5*time.Second)
+		require.NoError(t, err)
+		var response PeerMsg
+		require.NoError(t, json.Unmarshal(reply.Data, &response))
+		return response
+	}
+
+	response := call(`{"request":true,"id":1,"method":"legacy","data":null}`)
+	assert.True(t, response.Ok)
+	assert.Equal(t, 1, response.Version, "legacy requests are answered with version 1")
+	assert.Equal(t, RawMessage(`"legacy"`), response.Data)
+
+	response = call(`{"v":2,"request":true,"id":2,"method":"current","data":null}`)
+	assert.True(t, response.Ok)
+	assert.Equal(t, ProtocolVersion, response.Version)
+
+	response = call(`{"v":99,"request":true,"id":3,"method":"future","data":null}`)
+	assert.False(t, response.Ok)
+	assert.Equal(t, ErrorCodeUnsupportedVersion, response.ErrorCode)
+	assert.Equal(t, float64(99), response.ErrorDetails["version"])
+	assert.Equal(t, float64(ProtocolVersion), response.ErrorDetails["max_version"])
+}
+
+func TestVersionAdapter(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	np.SetVersionAdapter(1, VersionAdapter{
+		Upgrade: func(msg *PeerMsg) error {
+			if msg.Method == "sendMessage" {
+				msg.Method = "send"
+			}
+			return nil
+		},
+		Downgrade: func(msg *PeerMsg) error {
+			if msg.Response && msg.Ok {
+				msg.Data = RawMessage(`{"legacy":` + string(msg.Data) + `}`)
+			}
+			return nil
+		},
+	})
+	np.OnRequest("rpc-adapted", func(request Request, accept RespondFunc, reject RejectFunc) {
+		accept(request.Method)
+	})
+
+	requestor := np.NewRequestor("rpc-adapted")
+	require.NoError(t, requestor.SetProtocolVersion(1))
+	result, rerr := requestor.SyncRequest("sendMessage", nil)
+	require.Nil(t, rerr)
+	assert.JSONEq(t, `{"legacy":"send"}`, string(result))
+
+	require.Error(t, requestor.SetProtocolVersion(ProtocolVersion+1))
+}
+
+func TestCapabilities(t *testing.T) {
+	s := runJetStreamServer(t)
+	np := newTestProtoo(t, s)
+	defer np.Close()
+	np.AddFeature("attachments")
+	np.OnRequest("rpc-caps", func(request Request, accept RespondFunc, reject RejectFunc) { accept(nil) })
+
+	requestor := np.NewRequestor("rpc-caps")
+	capabilities, err := requestor.Negotiate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, capabilities.Version)
+	assert.Equal(t, MinProtocolVersion, capabilities.MinVersion)
+	assert.Equal(t, np.NodeID(), capabilities.NodeID)
+	assert.True(t, capabilities.Supports("attachments"))
+	assert.True(t, capabilities.Supports(FeatureCancel))
+	assert.False(t, capabilities.Supports("video"))
+
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	answer := func(channel string, response string) {
+		_, err := nc.Subscribe(channel, func(msg *nats.Msg) {
+			var request PeerMsg
+			require.NoError(t, json.Unmarshal(msg.Data, &request))
+			if !request.Request {
+				return
+			}
+			var answer map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(response), &answer))
+			answer["id"] = request.ID
+			payload, err := json.Marshal(answer)
+			require.NoError(t, err)
+			nc.Publish(msg.Reply, payload)
+		})
+		require.NoError(t, err)
+		require.NoError(t, nc.Flush())
+	}
+
+	answer("rpc-legacy", `{"response":true,"ok":false,"errorCode":404,"errorReason":"Not found listener for rpc-legacy!"}`)
+	legacy := np.NewRequestor("rpc-legacy")
+	capabilities, err = legacy.Negotiate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, legacyCapabilities, capabilities)
+	assert.Equal(t, 1, legacy.version)
+
+	for channel, response := range map[string]string{
+		"rpc-no-listener": `{"v":2,"response":true,"ok":false,"errorCode":500,"errorReason":"Not found listener for rpc-no-listener!"}`,
+		"rpc-handler":     `{"response":true,"ok":false,"errorCode":400,"errorReason":"unknown method"}`,
+		"rpc-echo":        `{"response":true,"ok":true,"data":"pong"}`,
+		"rpc-empty":       `{"response":true,"ok":true,"data":{}}`,
+	} {
+		answer(channel, response)
+		capabilities, err = np.NewRequestor(channel).Capabilities(context.Background())
+		require.NoError(t, err, channel)
+		assert.Equal(t, legacyCapabilities, capabilities, channel)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = np.NewRequestor("rpc-silent").Capabilities(ctx)
+	assert.Error(t, err, "peers which do not answer are not legacy")
+
+	answer("rpc-future", `{"v":2,"response":true,"ok":true,"data":{"version":3,"min_version":3}}`)
+	_, err = np.NewRequestor("rpc-future").Negotiate(context.Background())
+	assert.True(t, errors.Is(err, ErrUnsupportedVersion), "%v", err)
+}
@@ -50,3 +50,12 @@ func MustGetInt(cmd *cobra.Command, name string) int {
 	}
 	return ss
 }
+
+// MustGetFloat64 returns a float64 flag or fatals if an error occurs.
+func MustGetFloat64(cmd *cobra.Command, name string) float64 {
+	f, err := cmd.Flags().GetFloat64(name)
+	if err != nil {
+		Fatalf(err.Error())
+	}
+	return f
+}
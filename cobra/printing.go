@@ -9,6 +9,8 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+
+	"github.com/mj23978/chat-backend-x/utils"
 )
 
 type (
@@ -48,6 +50,22 @@ func PrintErrors(cmd *cobra.Command, errs map[string]error) {
 	}
 }
 
+// PrintError prints err as a utils.DetailedError to STD_ERR, using the format set by the format flags.
+func PrintError(cmd *cobra.Command, err error) {
+	de := utils.ToDetailedError(err)
+	switch getFormat(cmd) {
+	case FormatJSON:
+		printJSON(cmd.ErrOrStderr(), de, false)
+	case FormatJSONPretty:
+		printJSON(cmd.ErrOrStderr(), de, true)
+	default:
+		fmt.Fprintf(cmd.ErrOrStderr(), "%d %s: %s\n", de.StatusCode(), de.Status(), de.Error())
+		if de.Reason() != "" {
+			fmt.Fprintf(cmd.ErrOrStderr(), "reason: %s\n", de.Reason())
+		}
+	}
+}
+
 func PrintRow(cmd *cobra.Command, row OutputEntry) {
 	f := getFormat(cmd)
 
@@ -3,10 +3,12 @@ package discovery
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	log "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -160,6 +162,60 @@ func (e *Etcd) close() error {
 	return e.client.Close()
 }
 
+// Closed reports whether the client was closed.
+func (e *Etcd) Closed() bool {
+	return e.stop
+}
+
+// Ping checks that the etcd cluster answers a read within the operation timeout.
+func (e *Etcd) Ping() error {
+	if e.stop {
+		return errors.New("Etcd already close")
+	}
+	_, err := e.get("health")
+	return err
+}
+
+// LeaseAlive returns an error if key is not kept alive by a lease or its lease expired.
+func (e *Etcd) LeaseAlive(key string) error {
+	e.liveKeyIDLock.RLock()
+	id, found := e.liveKeyID[key]
+	e.liveKeyIDLock.RUnlock()
+	if !found {
+		return fmt.Errorf("no lease registered for %s", key)
+	}
+	return e.leaseAlive(key, id)
+}
+
+// LeasesAlive returns an error if any lease kept by this client expired.
+func (e *Etcd) LeasesAlive() error {
+	e.liveKeyIDLock.RLock()
+	leases := make(map[string]clientv3.LeaseID, len(e.liveKeyID))
+	for k, id := range e.liveKeyID {
+		leases[k] = id
+	}
+	e.liveKeyIDLock.RUnlock()
+	for k, id := range leases {
+		if err := e.leaseAlive(k, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Etcd) leaseAlive(key string, id clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
+	defer cancel()
+	resp, err := e.client.TimeToLive(ctx, id)
+	if err != nil {
+		return err
+	}
+	if resp.TTL <= 0 {
+		return fmt.Errorf("lease of %s expired", key)
+	}
+	return nil
+}
+
 func (e *Etcd) put(key, value string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
 	_, err := e.client.Put(ctx, key, value)
@@ -229,3 +285,107 @@ func (e *Etcd) update(key, value string) error {
 	// log.Infof("Etcd.Update %s %s %v", key, value, err)
 	return err
 }
+
+// KeepLease grants a lease kept alive until quit is closed, which revokes it. Keys are put
+// with it by PutWithLease, however many there are LeasesAlive checks it once, as name.
+func (e *Etcd) KeepLease(name string, quit chan bool) (clientv3.LeaseID, error) {
+	resp, err := e.client.Grant(context.TODO(), defaultGrantTimeout)
+	if err != nil {
+		log.Errorf("Etcd.KeepLease Grant %s %v", name, err)
+		return 0, err
+	}
+	ch, err := e.client.KeepAlive(context.TODO(), resp.ID)
+	if err != nil {
+		log.Errorf("Etcd.KeepLease %s %v", name, err)
+		e.client.Revoke(context.TODO(), resp.ID)
+		return 0, err
+	}
+	e.liveKeyIDLock.Lock()
+	e.liveKeyID[name] = resp.ID
+	e.liveKeyIDLock.Unlock()
+	go func() {
+		for {
+			select {
+			case _, ok := <-ch:
+				if !ok {
+					// The lease expired or the client was closed, wait for quit to unregister it.
+					ch = nil
+				}
+			case <-quit:
+				e.liveKeyIDLock.Lock()
+				if e.liveKeyID[name] == resp.ID {
+					delete(e.liveKeyID, name)
+				}
+				e.liveKeyIDLock.Unlock()
+				log.Debugf("Lease %v Revoked", resp.ID)
+				e.client.Revoke(context.TODO(), resp.ID)
+				return
+			}
+		}
+	}()
+	return resp.ID, nil
+}
+
+// PutWithLease puts value to key with lease, e.g. one granted by KeepLease.
+func (e *Etcd) PutWithLease(key, value string, lease clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
+	defer cancel()
+	_, err := e.client.Put(ctx, key, value, clientv3.WithLease(lease))
+	return err
+}
+
+// Del deletes key, or every key under it if prefix.
+func (e *Etcd) Del(key string, prefix bool) error {
+	return e.del(key, prefix)
+}
+
+// Get returns the value of key, empty if it does not exist.
+func (e *Etcd) Get(key string) (string, error) {
+	return e.get(key)
+}
+
+// GetByPrefix returns the keys under key with their values.
+func (e *Etcd) GetByPrefix(key string) (map[string]string, error) {
+	return e.getByPrefix(key)
+}
+
+// WatchWithPrevKV is like watch, but the events carry the previous value of the keys, so
+// the value of a deleted key is known.
+func (e *Etcd) WatchWithPrevKV(key string, watchFunc WatchCallback, prefix bool) error {
+	if watchFunc == nil {
+		return errors.New("watchFunc is nil")
+	}
+	opts := []clientv3.OpOption{clientv3.WithPrevKV()}
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	watchFunc(e.client.Watch(context.Background(), key, opts...))
+	return nil
+}
+
+// Claim creates key with a lease of ttl seconds if it does not exist yet. Only one of the
+// clients claiming the same key gets true, which elects it to act on an event once.
+func (e *Etcd) Claim(key string, ttl int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
+	defer cancel()
+	lease, err := e.client.Grant(ctx, ttl)
+	if err != nil {
+		return false, err
+	}
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "", clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if !resp.Succeeded {
+		e.client.Revoke(context.TODO(), lease.ID)
+	}
+	return resp.Succeeded, nil
+}
+
+// IsLeaseNotFound reports whether err tells that a lease expired or was revoked.
+func IsLeaseNotFound(err error) bool {
+	return err == rpctypes.ErrLeaseNotFound
+}
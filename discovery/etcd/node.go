@@ -3,6 +3,7 @@ package discovery
 import (
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	log "github.com/mj23978/chat-backend-x/logger/zerolog"
@@ -72,9 +73,25 @@ func (sn *ServiceNode) UnregisterNode() error {
 	return fmt.Errorf("We Didnt Any Service with This ID ")
 }
 
+// Etcd returns the etcd client the node is registered with.
+func (sn *ServiceNode) Etcd() *Etcd {
+	return sn.reg.Etcd()
+}
+
+// CheckRegistration returns an error unless the node registration lease is active.
+func (sn *ServiceNode) CheckRegistration() error {
+	if sn.node.ID == "" {
+		return fmt.Errorf("node is not registered")
+	}
+	return sn.reg.Etcd().LeaseAlive(sn.reg.nodePath(sn.node.Info["service"], sn.node))
+}
+
 // ServiceWatcher .
 type ServiceWatcher struct {
-	reg      *ServiceRegistry
+	reg *ServiceRegistry
+	// mutex guards nodesMap, which is written by the watch goroutines and read by the
+	// callers of GetNodes and NodeIDs.
+	mutex    sync.RWMutex
 	nodesMap map[string]map[string]Node
 	callback ServiceWatchCallback
 }
@@ -90,12 +107,42 @@ func NewServiceWatcher(endpoints []string, dc string) *ServiceWatcher {
 	return sw
 }
 
+// Etcd returns the etcd client the watcher reads from.
+func (sw *ServiceWatcher) Etcd() *Etcd {
+	return sw.reg.Etcd()
+}
+
+// GetNodes returns a copy of the known nodes of service by ID.
 func (sw *ServiceWatcher) GetNodes(service string) (map[string]Node, bool) {
+	sw.mutex.RLock()
+	defer sw.mutex.RUnlock()
 	nodes, found := sw.nodesMap[service]
-	return nodes, found
+	if !found {
+		return nil, false
+	}
+	copied := make(map[string]Node, len(nodes))
+	for id, node := range nodes {
+		copied[id] = node
+	}
+	return copied, true
+}
+
+// NodeIDs returns the "id" of every known node of service, e.g. the expected subscribers
+// of an acknowledged notification.
+func (sw *ServiceWatcher) NodeIDs(service string) []string {
+	sw.mutex.RLock()
+	defer sw.mutex.RUnlock()
+	nodes := sw.nodesMap[service]
+	ids := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		ids = append(ids, node.Info["id"])
+	}
+	return ids
 }
 
 func (sw *ServiceWatcher) GetNodesByID(ID string) (*Node, bool) {
+	sw.mutex.RLock()
+	defer sw.mutex.RUnlock()
 	for _, nodes := range sw.nodesMap {
 		for id, node := range nodes {
 			if id == ID {
@@ -107,6 +154,8 @@ func (sw *ServiceWatcher) GetNodesByID(ID string) (*Node, bool) {
 }
 
 func (sw *ServiceWatcher) DeleteNodesByID(ID string) bool {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
 	for service, nodes := range sw.nodesMap {
 		for id := range nodes {
 			if id == ID {
@@ -154,26 +203,36 @@ func (sw *ServiceWatcher) WatchServiceNode(serviceName string, callback ServiceW
 		log.Debugf("Nodes: => %v", nodes)
 
 		for _, node := range nodes {
-			id := node.ID
 			service := node.Info["service"]
 
-			if _, found := sw.nodesMap[service]; !found {
-				sw.nodesMap[service] = make(map[string]Node)
-			}
-
-			if _, found := sw.GetNodesByID(node.ID); !found {
+			if sw.addNode(service, node) {
 				log.Infof("New %s node UP => [%s].", service, node.ID)
 				callback(service, UP, node)
 
 				log.Infof("Start watch for [%s] node => [%s].", service, node.ID)
 				Watch(node.ID, sw.WatchNode, true)
-				sw.nodesMap[service][id] = node
 			}
 		}
 		time.Sleep(2 * time.Second)
 	}
 }
 
+// addNode adds node to the nodes of service. It returns false if a node with its ID is known.
+func (sw *ServiceWatcher) addNode(service string, node Node) bool {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	for _, nodes := range sw.nodesMap {
+		if _, found := nodes[node.ID]; found {
+			return false
+		}
+	}
+	if _, found := sw.nodesMap[service]; !found {
+		sw.nodesMap[service] = make(map[string]Node)
+	}
+	sw.nodesMap[service][node.ID] = node
+	return true
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
 
 func randomString(n int) string {
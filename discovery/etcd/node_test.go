@@ -2,6 +2,7 @@ package discovery
 
 import (
 	"encoding/json"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -125,3 +126,33 @@ func TestUpTime(t *testing.T) {
 	ServiceUpTimeNode()
 	wg.Wait()
 }
+
+func TestServiceWatcherNodes(t *testing.T) {
+	sw := &ServiceWatcher{nodesMap: make(map[string]map[string]Node)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			id := "node-" + strconv.Itoa(i)
+			sw.addNode("game", Node{ID: id, Info: map[string]string{"id": id}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		nodes, _ := sw.GetNodes("game")
+		for id := range nodes {
+			delete(nodes, id)
+		}
+		sw.NodeIDs("game")
+	}
+	<-done
+
+	nodes, found := sw.GetNodes("game")
+	if !found || len(nodes) != 100 || len(sw.NodeIDs("game")) != 100 {
+		t.Fatalf("expected 100 nodes, got %d", len(nodes))
+	}
+	for id := range nodes {
+		if sw.addNode("game", nodes[id]) {
+			t.Fatalf("node %s added twice", id)
+		}
+	}
+}
@@ -57,7 +57,7 @@ func (r *ServiceRegistry) keepRegistered(serviceName string, node Node) {
 	for {
 		select {
 		case <-ticker.C:
-			nodePath := r.Scheme + serviceName + "-" + node.ID
+			nodePath := r.nodePath(serviceName, node)
 			err := r.etcd.keepWhile(nodePath, encode(node.Info), r.quit)
 			if err != nil {
 				log.Warnf("Registration got errors. Restarting. err=%s", err)
@@ -71,6 +71,11 @@ func (r *ServiceRegistry) keepRegistered(serviceName string, node Node) {
 	}
 }
 
+// Etcd returns the etcd client backing the registry.
+func (r *ServiceRegistry) Etcd() *Etcd {
+	return r.etcd
+}
+
 //GetServiceNodes returns a list of active service nodes
 func (r *ServiceRegistry) GetServiceNodes(serviceName string) ([]Node, error) {
 	rsp, err := r.etcd.GetResponseByPrefix(r.servicePath(serviceName))
@@ -113,6 +118,10 @@ func decode(ds []byte) map[string]string {
 	return nil
 }
 
+func (r *ServiceRegistry) nodePath(serviceName string, node Node) string {
+	return r.Scheme + serviceName + "-" + node.ID
+}
+
 func (r *ServiceRegistry) servicePath(serviceName string) string {
 	service := strings.Replace(serviceName, "/", "-", -1)
 	return path.Join(r.Scheme, service)
@@ -0,0 +1,181 @@
+// Package gateway exposes nprotoo request channels as an HTTP JSON API and broadcast
+// channels as Server-Sent Events.
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/opentracing/opentracing-go"
+	"github.com/ory/herodot"
+	"github.com/pborman/uuid"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"github.com/mj23978/chat-backend-x/utils"
+)
+
+const (
+	// RPCPath is the route of RPC calls, the body of the POST request is the data of the request.
+	RPCPath = "/rpc/:channel/:method"
+
+	// DefaultMaxBodyBytes limits the size of request bodies.
+	DefaultMaxBodyBytes = 1 << 20
+
+	// RequestIDHeader carries the request ID of a call. It is generated if missing and
+	// forwarded in the envelope metadata and the response.
+	RequestIDHeader = "X-Request-Id"
+	// AuthorizationHeader carries the bearer token forwarded in the envelope metadata.
+	AuthorizationHeader = "Authorization"
+)
+
+// TracingHeaders are copied from the HTTP request into the envelope metadata.
+var TracingHeaders = []string{
+	"traceparent",
+	"tracestate",
+	"uber-trace-id",
+	"b3",
+	"X-B3-TraceId",
+	"X-B3-SpanId",
+	"X-B3-ParentSpanId",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+}
+
+// Handler maps POST /rpc/{channel}/{method} to a request to the allow-listed channel.
+type Handler struct {
+	H  herodot.Writer
+	np *nprotoo.NatsProtoo
+	// Channels lists the channels requests may be sent to.
+	Channels map[string]bool
+	// Timeout of a request, nprotoo.DefaultRequestTimeout if 0.
+	Timeout      time.Duration
+	MaxBodyBytes int64
+}
+
+// NewHandler instantiates a handler sending requests through np to channels.
+func NewHandler(h herodot.Writer, np *nprotoo.NatsProtoo, channels ...string) *Handler {
+	allowed := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		allowed[channel] = true
+	}
+	return &Handler{
+		H:            h,
+		np:           np,
+		Channels:     allowed,
+		Timeout:      nprotoo.DefaultRequestTimeout,
+		MaxBodyBytes: DefaultMaxBodyBytes,
+	}
+}
+
+// SetRoutes registers this handler's routes.
+func (h *Handler) SetRoutes(r *httprouter.Router) {
+	r.POST(RPCPath, h.RPC)
+}
+
+// ServeHTTP implements http.Handler for routers other than httprouter, e.g. negroni.Wrap.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "rpc" {
+		h.H.WriteError(w, r, utils.ErrNotFound.WithReasonf("No route for %s", r.URL.Path).ToHerodot())
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.H.WriteErrorCode(w, r, http.StatusMethodNotAllowed, utils.NewDetailedError(http.StatusMethodNotAllowed, "Only POST is allowed").ToHerodot())
+		return
+	}
+	h.RPC(w, r, httprouter.Params{{Key: "channel", Value: parts[1]}, {Key: "method", Value: parts[2]}})
+}
+
+// RPC sends the request and writes the data of the response, or its error with a matching status.
+func (h *Handler) RPC(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	channel, method := ps.ByName("channel"), ps.ByName("method")
+
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = uuid.New()
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+
+	if !h.Channels[channel] {
+		h.writeError(w, r, utils.ErrNotFound.WithReasonf("Channel %s is not exposed", channel), requestID)
+		return
+	}
+	if strings.HasPrefix(method, "$") {
+		// Methods starting with $ are reserved by nprotoo, e.g. $describe or $transfer.
+		h.writeError(w, r, utils.ErrNotFound.WithReasonf("Method %s is reserved", method), requestID)
+		return
+	}
+
+	maxBodyBytes := h.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = DefaultMaxBodyBytes
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		h.writeError(w, r, utils.ErrBadRequest.WithReasonf("Unable to read the request body: %s", err), requestID)
+		return
+	}
+	var data interface{}
+	if body = bytes.TrimSpace(body); len(body) > 0 {
+		if !json.Valid(body) {
+			h.writeError(w, r, utils.ErrBadRequest.WithReason("The request body is not valid JSON"), requestID)
+			return
+		}
+		data = json.RawMessage(body)
+	}
+
+	requestor := h.np.NewRequestor(channel)
+	if h.Timeout > 0 {
+		requestor.SetRequestTimeout(h.Timeout)
+	}
+	ctx := nprotoo.NewMetadataContext(r.Context(), h.metadata(r, requestID))
+	result, rerr := requestor.SyncRequestContext(ctx, method, data)
+	if rerr != nil {
+		h.writeError(w, r, rerr.Detailed(), requestID)
+		return
+	}
+	if len(result) == 0 {
+		result = nprotoo.RawMessage("null")
+	}
+	h.H.Write(w, r, json.RawMessage(result))
+}
+
+// metadata collects the tracing headers, request ID and bearer token of r.
+func (h *Handler) metadata(r *http.Request, requestID string) nprotoo.Metadata {
+	md := nprotoo.Metadata{RequestIDHeader: requestID}
+	for _, key := range TracingHeaders {
+		if value := r.Header.Get(key); value != "" {
+			md[key] = value
+		}
+	}
+	if span := opentracing.SpanFromContext(r.Context()); span != nil {
+		carrier := opentracing.TextMapCarrier(md)
+		if err := opentracing.GlobalTracer().Inject(span.Context(), opentracing.TextMap, carrier); err != nil {
+			logger.Warnf("Unable to inject the trace into the request: %v", err)
+		}
+	}
+	if authorization := r.Header.Get(AuthorizationHeader); strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+		md[AuthorizationHeader] = authorization
+	}
+	return md
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, err *utils.DetailedError, requestID string) {
+	if err.RequestID() == "" {
+		err = err.WithRequestID(requestID)
+	}
+	code := err.StatusCode()
+	if code == nprotoo.ErrorCodeTimeout {
+		code = http.StatusGatewayTimeout
+	} else if code < http.StatusBadRequest || code > 599 {
+		code = http.StatusInternalServerError
+	}
+	h.H.WriteErrorCode(w, r, code, err.ToHerodot())
+}
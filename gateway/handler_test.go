@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/ory/herodot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/negroni"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	"github.com/mj23978/chat-backend-x/utils"
+)
+
+func TestGateway(t *testing.T) {
+	s, err := server.NewServer(&server.Options{Port: -1})
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Shutdown()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	np, err := nprotoo.NewNatsProtooWithConfig(nprotoo.NewConfig(s.ClientURL()))
+	require.NoError(t, err)
+	defer np.Close()
+	np.OnRequest("chat", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		md := request.Metadata
+		switch request.Method {
+		case "echo":
+			accept(map[string]interface{}{
+				"data":          request.Data,
+				"request_id":    md.Get(RequestIDHeader),
+				"authorization": md.Get(AuthorizationHeader),
+				"traceparent":   md.Get("traceparent"),
+			})
+		case "conflict":
+			accept(utils.ErrConflict.WithReason("room exists"))
+		case "slow":
+		}
+	})
+
+	handler := NewHandler(herodot.NewJSONWriter(nil), np, "chat")
+	handler.Timeout = 200 * time.Millisecond
+	router := httprouter.New()
+	handler.SetRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	post := func(t *testing.T, url string, body string, header http.Header, expectedCode int) (map[string]interface{}, http.Header) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, expectedCode, res.StatusCode)
+
+		var result map[string]interface{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+		return result, res.Header
+	}
+
+	t.Run("case=accept", func(t *testing.T) {
+		result, header := post(t, ts.URL+"/rpc/chat/echo", `{"text":"hi"}`, http.Header{
+			"X-Request-Id":  {"req-1"},
+			"Authorization": {"Bearer token"},
+			"Traceparent":   {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		}, http.StatusOK)
+		assert.Equal(t, map[string]interface{}{"text": "hi"}, result["data"])
+		assert.Equal(t, "req-1", result["request_id"])
+		assert.Equal(t, "Bearer token", result["authorization"])
+		assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", result["traceparent"])
+		assert.Equal(t, "req-1", header.Get(RequestIDHeader))
+	})
+
+	t.Run("case=generated request id", func(t *testing.T) {
+		result, header := post(t, ts.URL+"/rpc/chat/echo", ``, nil, http.StatusOK)
+		assert.NotEmpty(t, header.Get(RequestIDHeader))
+		assert.Equal(t, header.Get(RequestIDHeader), result["request_id"])
+		assert.Empty(t, result["authorization"])
+	})
+
+	t.Run("case=reject", func(t *testing.T) {
+		result, _ := post(t, ts.URL+"/rpc/chat/conflict", `{}`, nil, http.StatusConflict)
+		assert.Equal(t, "room exists", result["error"].(map[string]interface{})["reason"])
+	})
+
+	t.Run("case=timeout", func(t *testing.T) {
+		result, _ := post(t, ts.URL+"/rpc/chat/slow", `{}`, nil, http.StatusGatewayTimeout)
+		assert.EqualValues(t, nprotoo.ErrorCodeTimeout, result["error"].(map[string]interface{})["code"])
+	})
+
+	t.Run("case=channel not allowed", func(t *testing.T) {
+		post(t, ts.URL+"/rpc/admin/echo", `{}`, nil, http.StatusNotFound)
+	})
+
+	t.Run("case=reserved method", func(t *testing.T) {
+		for _, method := range []string{nprotoo.DescribeMethod, nprotoo.CapabilitiesMethod, nprotoo.TransferMethod} {
+			post(t, ts.URL+"/rpc/chat/"+method, `{}`, nil, http.StatusNotFound)
+		}
+	})
+
+	t.Run("case=invalid json", func(t *testing.T) {
+		post(t, ts.URL+"/rpc/chat/echo", `{`, nil, http.StatusBadRequest)
+	})
+
+	t.Run("case=negroni", func(t *testing.T) {
+		n := negroni.New()
+		n.UseHandler(handler)
+		ns := httptest.NewServer(n)
+		defer ns.Close()
+
+		result, _ := post(t, ns.URL+"/rpc/chat/echo", `[1]`, nil, http.StatusOK)
+		assert.Equal(t, []interface{}{float64(1)}, result["data"])
+
+		res, err := http.Get(ns.URL + "/rpc/chat/echo")
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	})
+}
@@ -0,0 +1,351 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ory/herodot"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"github.com/mj23978/chat-backend-x/utils"
+)
+
+const (
+	// EventsPath streams the channels given by the repeated "channel" query parameter,
+	// EventsChannelPath the channel of the path.
+	EventsPath        = "/events"
+	EventsChannelPath = "/events/:channel"
+
+	// LastEventIDHeader is sent by EventSource when reconnecting. LastEventIDQuery is
+	// accepted as well for clients unable to set headers.
+	LastEventIDHeader = "Last-Event-ID"
+	LastEventIDQuery  = "lastEventId"
+
+	// DefaultEventBufferSize is the number of events kept for resuming streams.
+	DefaultEventBufferSize = 1024
+	// DefaultHeartbeat is the interval of the comments keeping idle streams open.
+	DefaultHeartbeat = 15 * time.Second
+	// DefaultLinger is how long a channel stays subscribed after its last stream closed,
+	// so a reconnecting client resumes without missing events.
+	DefaultLinger = time.Minute
+
+	// ResetEvent is written first to streams which can not resume after their Last-Event-ID,
+	// as the events following it are no longer buffered or were never received, e.g. after
+	// a restart. Clients reload the state of their channels then.
+	ResetEvent = "$reset"
+
+	clientEventBuffer = 64
+)
+
+// EventStream streams the notifications broadcast on the allow-listed channels as
+// Server-Sent Events. The id of an event is the unix time in microseconds it was received
+// at, made unique within this EventStream, its event the method of the notification and its
+// data the notification, the channel it was broadcast on set as nprotoo.ChannelMetadata.
+// Since ids are timestamps, a client resumes at about the same point after a restart or on
+// another instance behind a load balancer, or is sent ResetEvent if that is not possible.
+type EventStream struct {
+	H  herodot.Writer
+	np *nprotoo.NatsProtoo
+	// Channels lists the channels clients may stream. Patterns may use the NATS wildcards
+	// '*' and '>', the channels clients stream may not.
+	Channels   []string
+	BufferSize int
+	Heartbeat  time.Duration
+	Linger     time.Duration
+
+	mutex sync.Mutex
+	// lastID is the id of the newest event, evicted the one of the newest event dropped from buffer.
+	lastID  uint64
+	evicted uint64
+	buffer  []*event
+	topics  map[string]*topic
+}
+
+type event struct {
+	id uint64
+	// topic is the channel of the topic which received the event. The channel it was
+	// broadcast on is set as nprotoo.ChannelMetadata of data.
+	topic  string
+	method string
+	data   []byte
+}
+
+// topic is a channel subscribed through OnBroadcast on behalf of the streams reading it.
+type topic struct {
+	// since is the id all events of the topic are newer than.
+	since    uint64
+	listener nprotoo.BroadCastFunc
+	clients  map[*client]bool
+	linger   *time.Timer
+}
+
+type client struct {
+	channels []string
+	events   chan *event
+	// overflow is closed if the client is too slow to keep up. It then reconnects and
+	// resumes from the buffer.
+	overflow chan struct{}
+	closed   bool
+}
+
+// NewEventStream instantiates a handler streaming the notifications of channels received by np.
+func NewEventStream(h herodot.Writer, np *nprotoo.NatsProtoo, channels ...string) *EventStream {
+	return &EventStream{
+		H:          h,
+		np:         np,
+		Channels:   channels,
+		BufferSize: DefaultEventBufferSize,
+		Heartbeat:  DefaultHeartbeat,
+		Linger:     DefaultLinger,
+		topics:     make(map[string]*topic),
+	}
+}
+
+// SetRoutes registers this handler's routes.
+func (es *EventStream) SetRoutes(r *httprouter.Router) {
+	r.GET(EventsPath, es.Stream)
+	r.GET(EventsChannelPath, es.Stream)
+}
+
+// ServeHTTP implements http.Handler for routers other than httprouter, e.g. negroni.Wrap.
+func (es *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ps httprouter.Params
+	path := strings.Trim(r.URL.Path, "/")
+	if parts := strings.SplitN(path, "/", 2); len(parts) == 2 && parts[0] == strings.Trim(EventsPath, "/") {
+		ps = httprouter.Params{{Key: "channel", Value: parts[1]}}
+	} else if path != strings.Trim(EventsPath, "/") {
+		es.H.WriteError(w, r, utils.ErrNotFound.WithReasonf("No route for %s", r.URL.Path).ToHerodot())
+		return
+	}
+	es.Stream(w, r, ps)
+}
+
+// Stream writes the events of the requested channels until the client disconnects. The
+// events buffered after Last-Event-ID are written first.
+func (es *EventStream) Stream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	channels := r.URL.Query()["channel"]
+	if channel := ps.ByName("channel"); channel != "" {
+		channels = append(channels, channel)
+	}
+	if len(channels) == 0 {
+		es.H.WriteError(w, r, utils.ErrBadRequest.WithReason("At least one channel is required").ToHerodot())
+		return
+	}
+	for _, channel := range channels {
+		if nprotoo.HasWildcard(channel) {
+			es.H.WriteError(w, r, utils.ErrBadRequest.WithReasonf("Streaming the wildcard channel %s is not supported", channel).ToHerodot())
+			return
+		}
+		if !es.allowed(channel) {
+			es.H.WriteError(w, r, utils.ErrForbidden.WithReasonf("Channel %s is not exposed", channel).ToHerodot())
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		es.H.WriteError(w, r, utils.ErrInternalServerError.WithReason("Streaming is not supported").ToHerodot())
+		return
+	}
+
+	lastEventID := r.Header.Get(LastEventIDHeader)
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get(LastEventIDQuery)
+	}
+	var last uint64
+	if lastEventID != "" {
+		// An id which is not ours is taken as older than every event, which resets the stream.
+		var err error
+		if last, err = strconv.ParseUint(lastEventID, 10, 64); err != nil || last == 0 {
+			last = 1
+		}
+	}
+
+	c := &client{channels: channels, events: make(chan *event, clientEventBuffer), overflow: make(chan struct{})}
+	backlog := es.subscribe(c, last)
+	defer es.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range backlog {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	heartbeat := es.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = DefaultHeartbeat
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-c.events:
+			writeEvent(w, e)
+		case <-ticker.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-c.overflow:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes e, or the ResetEvent if its method is empty.
+func writeEvent(w http.ResponseWriter, e *event) {
+	if e.method == "" {
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: null\n\n", e.id, ResetEvent)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.method, e.data)
+}
+
+func (es *EventStream) allowed(channel string) bool {
+	for _, pattern := range es.Channels {
+		if nprotoo.SubjectMatches(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe registers c with the topics of its channels and returns the buffered events
+// after last it wants. Both happen under the mutex, so no event is missed or sent twice.
+// If the events after last are not all buffered, a reset event is returned instead.
+func (es *EventStream) subscribe(c *client, last uint64) []*event {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	resumable := last >= es.evicted
+	for _, channel := range c.channels {
+		t, found := es.topics[channel]
+		if !found {
+			t = &topic{since: es.now(), clients: make(map[*client]bool)}
+			channel := channel
+			t.listener = func(notification nprotoo.Notification, subj string) { es.publish(channel, subj, notification) }
+			es.topics[channel] = t
+			es.np.OnBroadcast(channel, t.listener)
+		}
+		if t.linger != nil {
+			t.linger.Stop()
+			t.linger = nil
+		}
+		t.clients[c] = true
+		resumable = resumable && last >= t.since
+	}
+
+	var backlog []*event
+	if last == 0 {
+		return backlog
+	}
+	if !resumable {
+		return append(backlog, &event{id: es.lastID})
+	}
+	i := sort.Search(len(es.buffer), func(i int) bool { return es.buffer[i].id > last })
+	for _, e := range es.buffer[i:] {
+		if c.streams(e.topic) {
+			backlog = append(backlog, e)
+		}
+	}
+	return backlog
+}
+
+// unsubscribe removes c from its topics. Topics without clients are unsubscribed after Linger.
+func (es *EventStream) unsubscribe(c *client) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	c.closed = true
+	for _, channel := range c.channels {
+		t, found := es.topics[channel]
+		if !found {
+			continue
+		}
+		delete(t.clients, c)
+		if len(t.clients) == 0 && t.linger == nil {
+			channel := channel
+			t.linger = time.AfterFunc(es.Linger, func() { es.expire(channel, t) })
+		}
+	}
+}
+
+func (es *EventStream) expire(channel string, t *topic) {
+	es.mutex.Lock()
+	if es.topics[channel] != t || len(t.clients) > 0 {
+		es.mutex.Unlock()
+		return
+	}
+	delete(es.topics, channel)
+	es.mutex.Unlock()
+	es.np.OffBroadcast(channel, t.listener)
+}
+
+// publish buffers the notification broadcast on channel and sends it to the clients of topic.
+func (es *EventStream) publish(topic string, channel string, notification nprotoo.Notification) {
+	notification.Metadata = nprotoo.Metadata{nprotoo.ChannelMetadata: channel}
+	data, err := json.Marshal(&notification)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	method := strings.NewReplacer("\r", "", "\n", "").Replace(notification.Method)
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.lastID = es.now() + 1
+	e := &event{id: es.lastID, topic: topic, method: method, data: data}
+	size := es.BufferSize
+	if size <= 0 {
+		size = DefaultEventBufferSize
+	}
+	es.buffer = append(es.buffer, e)
+	if len(es.buffer) > size {
+		es.evicted = es.buffer[len(es.buffer)-size-1].id
+		es.buffer = es.buffer[len(es.buffer)-size:]
+	}
+
+	t, found := es.topics[topic]
+	if !found {
+		return
+	}
+	for c := range t.clients {
+		if c.closed {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			logger.Warnf("Event stream client is too slow, closing it at event %d", e.id)
+			c.closed = true
+			close(c.overflow)
+		}
+	}
+}
+
+// now returns the current time in microseconds, or lastID if the clock is behind it. The
+// mutex must be held.
+func (es *EventStream) now() uint64 {
+	if now := uint64(time.Now().UnixNano() / int64(time.Microsecond)); now > es.lastID {
+		return now
+	}
+	return es.lastID
+}
+
+func (c *client) streams(topic string) bool {
+	for _, channel := range c.channels {
+		if channel == topic {
+			return true
+		}
+	}
+	return false
+}
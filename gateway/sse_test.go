@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/ory/herodot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+)
+
+type sseEvent struct {
+	id, event, data string
+	heartbeat       bool
+}
+
+func readEvent(t *testing.T, lines chan string) sseEvent {
+	var e sseEvent
+	for {
+		select {
+		case line, ok := <-lines:
+			require.True(t, ok, "the stream ended")
+			switch {
+			case line == "" && (e.id != "" || e.heartbeat):
+				return e
+			case strings.HasPrefix(line, ":"):
+				e.heartbeat = true
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+}
+
+func openStream(t *testing.T, url string, lastEventID string) (*http.Response, chan string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set(LastEventIDHeader, lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return res, lines
+}
+
+func TestEventStream(t *testing.T) {
+	s, err := server.NewServer(&server.Options{Port: -1})
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Shutdown()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	np, err := nprotoo.NewNatsProtooWithConfig(nprotoo.NewConfig(s.ClientURL()))
+	require.NoError(t, err)
+	defer np.Close()
+
+	stream := NewEventStream(herodot.NewJSONWriter(nil), np, "room.*")
+	router := httprouter.New()
+	stream.SetRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + EventsPath)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = http.Get(ts.URL + EventsPath + "/secret")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, lines := openStream(t, ts.URL+EventsPath+"?channel=room.lobby", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	bc := np.NewBroadcaster("room.lobby")
+	bc.Say("join", "u1")
+	bc.Say("message", "hello")
+
+	join := readEvent(t, lines)
+	assert.Equal(t, "join", join.event)
+	e := readEvent(t, lines)
+	assert.Equal(t, "message", e.event)
+	assert.Greater(t, eventID(t, e), eventID(t, join))
+	var notification nprotoo.Notification
+	require.NoError(t, json.Unmarshal([]byte(e.data), &notification))
+	assert.Equal(t, "room.lobby", notification.Metadata.Get(nprotoo.ChannelMetadata))
+	assert.JSONEq(t, `"hello"`, string(notification.Data))
+	res.Body.Close()
+
+	bc.Say("leave", "u1")
+	stream.Heartbeat = 50 * time.Millisecond
+	res, lines = openStream(t, ts.URL+EventsPath+"/room.lobby", e.id)
+	defer res.Body.Close()
+	leave := readEvent(t, lines)
+	assert.Equal(t, "leave", leave.event, "the stream resumes after Last-Event-ID")
+	assert.True(t, readEvent(t, lines).heartbeat)
+
+	stream.mutex.Lock()
+	stream.BufferSize = 1
+	stream.mutex.Unlock()
+	bc.Say("first", "u1")
+	bc.Say("second", "u1")
+	first := readEvent(t, lines)
+	for first.heartbeat {
+		first = readEvent(t, lines)
+	}
+	assert.Equal(t, "first", first.event)
+
+	t.Run("case=resume from buffer", func(t *testing.T) {
+		res, lines := openStream(t, ts.URL+EventsPath+"/room.lobby", first.id)
+		defer res.Body.Close()
+		assert.Equal(t, "second", readEvent(t, lines).event)
+	})
+
+	for name, lastEventID := range map[string]string{
+		"evicted":      leave.id,
+		"before topic": "1",
+		"invalid":      "abc",
+	} {
+		t.Run("case=reset "+name, func(t *testing.T) {
+			res, lines := openStream(t, ts.URL+EventsPath+"/room.lobby", lastEventID)
+			defer res.Body.Close()
+			e := readEvent(t, lines)
+			assert.Equal(t, ResetEvent, e.event)
+			assert.Equal(t, "null", e.data)
+		})
+	}
+
+	t.Run("case=wildcard channel", func(t *testing.T) {
+		res, err := http.Get(ts.URL + EventsPath + "?channel=room.*")
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+}
+
+func eventID(t *testing.T, e sseEvent) uint64 {
+	id, err := strconv.ParseUint(e.id, 10, 64)
+	require.NoError(t, err)
+	return id
+}
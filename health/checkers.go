@@ -0,0 +1,61 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+
+	nats "github.com/nats-io/nats.go"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	discovery "github.com/mj23978/chat-backend-x/discovery/etcd"
+)
+
+// NatsAliveChecker fails once the NatsProtoo transport was closed.
+func NatsAliveChecker(np *nprotoo.NatsProtoo) Checker {
+	return func() error {
+		if np == nil || np.Closed() {
+			return errors.New("nats connection is closed")
+		}
+		return nil
+	}
+}
+
+// NatsReadyChecker fails while the NatsProtoo transport is not connected or the server does not answer.
+func NatsReadyChecker(np *nprotoo.NatsProtoo) Checker {
+	return func() error {
+		if err := NatsAliveChecker(np)(); err != nil {
+			return err
+		}
+		if status := np.Status(); status != nats.CONNECTED {
+			return fmt.Errorf("nats connection is not connected (status %d)", status)
+		}
+		_, err := np.RTT()
+		return err
+	}
+}
+
+// EtcdReadyChecker fails if the etcd cluster is unreachable or a lease kept by e expired.
+func EtcdReadyChecker(e *discovery.Etcd) Checker {
+	return func() error {
+		if e == nil || e.Closed() {
+			return errors.New("etcd client is closed")
+		}
+		if err := e.Ping(); err != nil {
+			return err
+		}
+		return e.LeasesAlive()
+	}
+}
+
+// ServiceNodeReadyChecker fails until the node registration lease is active.
+func ServiceNodeReadyChecker(sn *discovery.ServiceNode) Checker {
+	return func() error {
+		if sn == nil || sn.Etcd() == nil {
+			return errors.New("service node has no etcd client")
+		}
+		if err := EtcdReadyChecker(sn.Etcd())(); err != nil {
+			return err
+		}
+		return sn.CheckRegistration()
+	}
+}
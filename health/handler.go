@@ -0,0 +1,144 @@
+package health
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ory/herodot"
+)
+
+const (
+	// AliveCheckPath is the path where information about the life state of the instance is provided.
+	AliveCheckPath = "/health/alive"
+	// ReadyCheckPath is the path where information about the ready state of the instance is provided.
+	ReadyCheckPath = "/health/ready"
+)
+
+// RoutesToObserve returns a string of all the available routes of this module.
+func RoutesToObserve() []string {
+	return []string{
+		AliveCheckPath,
+		ReadyCheckPath,
+	}
+}
+
+// Checker should return an error if the component is not alive or ready.
+type Checker func() error
+
+// Checkers is a map of named Checkers.
+type Checkers map[string]Checker
+
+// NoopChecker is always alive and ready.
+func NoopChecker() error {
+	return nil
+}
+
+// Status is returned when all checks passed.
+type Status struct {
+	// Status always contains "ok".
+	Status string `json:"status"`
+}
+
+// NotReadyStatus is returned when at least one check failed.
+type NotReadyStatus struct {
+	// Errors contains a list of errors that caused the not ready status.
+	Errors map[string]string `json:"errors"`
+}
+
+// Handler handles HTTP requests to health endpoints.
+type Handler struct {
+	H           herodot.Writer
+	AliveChecks Checkers
+	ReadyChecks Checkers
+	// ShareErrors exposes checker errors in responses instead of an obfuscated message.
+	ShareErrors bool
+}
+
+// NewHandler instantiates a handler.
+func NewHandler(
+	h herodot.Writer,
+	aliveChecks Checkers,
+	readyChecks Checkers,
+) *Handler {
+	if aliveChecks == nil {
+		aliveChecks = Checkers{}
+	}
+	if readyChecks == nil {
+		readyChecks = Checkers{}
+	}
+	return &Handler{
+		H:           h,
+		AliveChecks: aliveChecks,
+		ReadyChecks: readyChecks,
+	}
+}
+
+// SetRoutes registers this handler's routes.
+func (h *Handler) SetRoutes(r *httprouter.Router) {
+	r.GET(AliveCheckPath, h.Alive)
+	r.GET(ReadyCheckPath, h.Ready)
+}
+
+// Alive returns an ok status if the instance and all AliveChecks are ok.
+//
+// swagger:route GET /health/alive health isInstanceAlive
+//
+// Check alive status
+//
+// This endpoint returns a 200 status code when the HTTP server is up running and
+// long lived components such as the NATS connection were not closed.
+//
+//     Produces:
+//     - application/json
+//
+//     Responses:
+//       200: healthStatus
+//       503: healthNotReadyStatus
+func (h *Handler) Alive(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.check(rw, r, h.AliveChecks)
+}
+
+// Ready returns an ok status if the instance is ready to handle requests and all ReadyChecks are ok.
+//
+// swagger:route GET /health/ready health isInstanceReady
+//
+// Check readiness status
+//
+// This endpoint returns a 200 status code when the HTTP server is up running and the environment
+// dependencies (e.g. NATS and the etcd registration) are responsive as well.
+//
+//     Produces:
+//     - application/json
+//
+//     Responses:
+//       200: healthStatus
+//       503: healthNotReadyStatus
+func (h *Handler) Ready(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.check(rw, r, h.ReadyChecks)
+}
+
+func (h *Handler) check(rw http.ResponseWriter, r *http.Request, checks Checkers) {
+	var notReady = NotReadyStatus{
+		Errors: map[string]string{},
+	}
+
+	for n, c := range checks {
+		if err := c(); err != nil {
+			if h.ShareErrors {
+				notReady.Errors[n] = err.Error()
+			} else {
+				notReady.Errors[n] = "error may contain sensitive information and was obfuscated"
+			}
+		}
+	}
+
+	if len(notReady.Errors) > 0 {
+		h.H.WriteCode(rw, r, http.StatusServiceUnavailable, notReady)
+		return
+	}
+
+	h.H.Write(rw, r, &Status{
+		Status: "ok",
+	})
+}
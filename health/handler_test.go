@@ -0,0 +1,55 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ory/herodot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	alive := errors.New("not alive")
+	ready := errors.New("not ready")
+
+	handler := NewHandler(herodot.NewJSONWriter(nil),
+		Checkers{"test": func() error { return alive }},
+		Checkers{"test": func() error { return ready }},
+	)
+	router := httprouter.New()
+	handler.SetRoutes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	get := func(t *testing.T, path string, expectedCode int) map[string]interface{} {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, expectedCode, res.StatusCode)
+
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		return body
+	}
+
+	body := get(t, AliveCheckPath, http.StatusServiceUnavailable)
+	assert.Equal(t, "error may contain sensitive information and was obfuscated", body["errors"].(map[string]interface{})["test"])
+
+	handler.ShareErrors = true
+	body = get(t, ReadyCheckPath, http.StatusServiceUnavailable)
+	assert.Equal(t, "not ready", body["errors"].(map[string]interface{})["test"])
+
+	alive = nil
+	ready = nil
+	assert.Equal(t, "ok", get(t, AliveCheckPath, http.StatusOK)["status"])
+	assert.Equal(t, "ok", get(t, ReadyCheckPath, http.StatusOK)["status"])
+
+	handler.ReadyChecks["nats"] = NatsAliveChecker(nil)
+	body = get(t, ReadyCheckPath, http.StatusServiceUnavailable)
+	assert.Equal(t, "nats connection is closed", body["errors"].(map[string]interface{})["nats"])
+}
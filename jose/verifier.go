@@ -0,0 +1,73 @@
+package jose
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// KeyGetter returns the JSON Web Key identified by kid. It is implemented by *Fetcher.
+type KeyGetter interface {
+	GetKey(kid string) (*jose.JSONWebKey, error)
+}
+
+// StaticKeys is a KeyGetter of a fixed JSON Web Key Set.
+type StaticKeys jose.JSONWebKeySet
+
+// GetKey returns the key with kid, or the only key of the set if kid is empty.
+func (s StaticKeys) GetKey(kid string) (*jose.JSONWebKey, error) {
+	if kid == "" && len(s.Keys) == 1 {
+		return &s.Keys[0], nil
+	}
+	for i := range s.Keys {
+		if s.Keys[i].KeyID == kid {
+			return &s.Keys[i], nil
+		}
+	}
+	return nil, errors.Errorf("unable to find JSON Web Key with ID: %s", kid)
+}
+
+// Verifier verifies signed JSON Web Tokens.
+type Verifier struct {
+	Keys KeyGetter
+	// Issuer and Audience are checked if not empty.
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat.
+	Leeway time.Duration
+}
+
+// Verify checks the signature and the standard claims of token and returns its claims.
+func (v *Verifier) Verify(token string) (*Claims, map[string]interface{}, error) {
+	t, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if len(t.Headers) != 1 {
+		return nil, nil, errors.New("token must have exactly one signature")
+	}
+	key, err := v.Keys.GetKey(t.Headers[0].KeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, symmetric := key.Key.([]byte); !symmetric && !key.IsPublic() {
+		public := key.Public()
+		key = &public
+	}
+
+	var standard jwt.Claims
+	raw := make(map[string]interface{})
+	if err := t.Claims(key, &standard, &raw); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	expected := jwt.Expected{Issuer: v.Issuer, Time: time.Now()}
+	if v.Audience != "" {
+		expected.Audience = jwt.Audience{v.Audience}
+	}
+	if err := standard.ValidateWithLeeway(expected, v.Leeway); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return ParseMapStringInterfaceClaims(raw), raw, nil
+}
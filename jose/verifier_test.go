@@ -0,0 +1,55 @@
+package jose
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestVerifier(t *testing.T) {
+	keys, err := GenerateSigningKeys("key-1", string(jose.RS256), 2048)
+	require.NoError(t, err)
+	private := keys.Keys[0]
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: private}, (&jose.SignerOptions{}).WithHeader("kid", "key-1"))
+	require.NoError(t, err)
+	sign := func(claims jwt.Claims, extra map[string]interface{}) string {
+		token, err := jwt.Signed(signer).Claims(claims).Claims(extra).CompactSerialize()
+		require.NoError(t, err)
+		return token
+	}
+
+	verifier := &Verifier{
+		Keys:     StaticKeys{Keys: []jose.JSONWebKey{private.Public()}},
+		Issuer:   "https://auth.local",
+		Audience: "chat",
+	}
+	now := time.Now()
+
+	claims, raw, err := verifier.Verify(sign(jwt.Claims{
+		Issuer:   "https://auth.local",
+		Subject:  "user-1",
+		Audience: jwt.Audience{"chat"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Minute)),
+	}, map[string]interface{}{"room": "lobby"}))
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.Subject)
+	assert.Equal(t, "lobby", raw["room"])
+
+	_, _, err = verifier.Verify(sign(jwt.Claims{
+		Issuer:   "https://auth.local",
+		Audience: jwt.Audience{"chat"},
+		Expiry:   jwt.NewNumericDate(now.Add(-time.Minute)),
+	}, nil))
+	require.Error(t, err, "expired tokens must be rejected")
+
+	_, _, err = verifier.Verify(sign(jwt.Claims{Issuer: "https://evil.local", Audience: jwt.Audience{"chat"}}, nil))
+	require.Error(t, err, "tokens of other issuers must be rejected")
+
+	_, _, err = verifier.Verify("not-a-token")
+	require.Error(t, err)
+}
@@ -0,0 +1,254 @@
+package presence
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	discovery "github.com/mj23978/chat-backend-x/discovery/etcd"
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+)
+
+const (
+	// DefaultEtcdPrefix is the prefix of the keys of an EtcdStore.
+	DefaultEtcdPrefix = "/presence/"
+	// claimTTL is the lifetime in seconds of the keys electing the node reporting an expiry.
+	claimTTL = 60
+)
+
+var (
+	_ Store = (*EtcdStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// EtcdStore is a Store shared by every node. The presences kept by a node share a single
+// etcd lease, which expires a few seconds after the node died. Every EtcdStore watching
+// the prefix then notices the expiry, and one of them reports it. A presence is keyed by
+// its user and node, so the user stays present while it is connected to another node.
+type EtcdStore struct {
+	etcd   *discovery.Etcd
+	prefix string
+	mutex  sync.Mutex
+	// lease is shared by the presences of kept, closing quit revokes it.
+	lease     clientv3.LeaseID
+	quit      chan bool
+	kept      map[string]Presence
+	listeners []func(p Presence)
+}
+
+// NewEtcdStore returns a store keeping presences under prefix, DefaultEtcdPrefix if empty.
+func NewEtcdStore(etcd *discovery.Etcd, prefix string) (*EtcdStore, error) {
+	if prefix == "" {
+		prefix = DefaultEtcdPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s := &EtcdStore{etcd: etcd, prefix: prefix, kept: make(map[string]Presence)}
+	if err := etcd.WatchWithPrevKV(prefix+"users/", s.watch, true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// userPrefix returns the prefix of the keys of the presences of user.
+func (s *EtcdStore) userPrefix(user string) string {
+	return s.prefix + "users/" + url.PathEscape(user) + "/"
+}
+
+func (s *EtcdStore) key(user string, node string) string {
+	return s.userPrefix(user) + url.PathEscape(node)
+}
+
+func (s *EtcdStore) Keep(p Presence) error {
+	value, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := s.key(p.User, p.Node)
+	if err := s.put(key, string(value)); err != nil {
+		if !discovery.IsLeaseNotFound(err) {
+			return err
+		}
+		// The lease expired, e.g. while etcd was unreachable, which deleted every presence put with it.
+		logger.Warnf("EtcdStore: lease %x of %d presences expired, granting a new one", s.lease, len(s.kept))
+		if err := s.regrant(); err != nil {
+			return err
+		}
+		if err := s.put(key, string(value)); err != nil {
+			return err
+		}
+	}
+	s.kept[key] = p
+	return nil
+}
+
+// put puts value to key with the lease of this store, granting it first if needed. The
+// mutex must be held.
+func (s *EtcdStore) put(key, value string) error {
+	if s.quit == nil {
+		quit := make(chan bool)
+		lease, err := s.etcd.KeepLease(s.prefix, quit)
+		if err != nil {
+			return err
+		}
+		s.lease, s.quit = lease, quit
+	}
+	return s.etcd.PutWithLease(key, value, s.lease)
+}
+
+// regrant puts every kept presence again with a new lease. The mutex must be held.
+func (s *EtcdStore) regrant() error {
+	s.revokeLease()
+	var first error
+	for key, p := range s.kept {
+		value, err := json.Marshal(&p)
+		if err == nil {
+			err = s.put(key, string(value))
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// revokeLease revokes the lease of this store. The mutex must be held.
+func (s *EtcdStore) revokeLease() {
+	if s.quit != nil {
+		close(s.quit)
+		s.quit = nil
+	}
+}
+
+// Release records the presence offline before deleting it, so the watchers tell the
+// release from an expiry.
+func (s *EtcdStore) Release(user string, node string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := s.key(user, node)
+	p, found := s.kept[key]
+	if !found {
+		return nil
+	}
+	delete(s.kept, key)
+	p.Status = StatusOffline
+	value, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	if err := s.put(key, string(value)); err != nil {
+		return err
+	}
+	return s.etcd.Del(key, false)
+}
+
+func (s *EtcdStore) Get(user string) (*Presence, error) {
+	presences, err := s.list(s.userPrefix(user))
+	if err != nil {
+		return nil, err
+	}
+	return Merge(presences...), nil
+}
+
+func (s *EtcdStore) List() ([]Presence, error) {
+	presences, err := s.list(s.prefix + "users/")
+	if err != nil {
+		return nil, err
+	}
+	return mergeAll(presences), nil
+}
+
+// list returns the presences under prefix, one per user and node.
+func (s *EtcdStore) list(prefix string) ([]Presence, error) {
+	values, err := s.etcd.GetByPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	presences := make([]Presence, 0, len(values))
+	for key, value := range values {
+		var p Presence
+		if err := json.Unmarshal([]byte(value), &p); err != nil {
+			logger.Warnf("EtcdStore: invalid presence %s: %v", key, err)
+			continue
+		}
+		presences = append(presences, p)
+	}
+	return presences, nil
+}
+
+func (s *EtcdStore) OnExpired(listener func(p Presence)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// Close releases the presences kept by this store and revokes its lease.
+func (s *EtcdStore) Close() error {
+	s.mutex.Lock()
+	kept := make([]Presence, 0, len(s.kept))
+	for _, p := range s.kept {
+		kept = append(kept, p)
+	}
+	s.mutex.Unlock()
+	for _, p := range kept {
+		if err := s.Release(p.User, p.Node); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	s.revokeLease()
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *EtcdStore) watch(ch clientv3.WatchChan) {
+	go func() {
+		for msg := range ch {
+			for _, ev := range msg.Events {
+				if ev.Type != clientv3.EventTypeDelete || ev.PrevKv == nil {
+					continue
+				}
+				var p Presence
+				if err := json.Unmarshal(ev.PrevKv.Value, &p); err != nil || p.Status == StatusOffline {
+					continue
+				}
+				s.expired(p, clientv3.LeaseID(ev.PrevKv.Lease), ev.Kv.ModRevision)
+			}
+		}
+	}()
+}
+
+// expired notifies the listeners if this store is the first to claim the expiry. The
+// presences of this store stay kept, as they are still connected: if its lease expired,
+// they are put again with a new one.
+func (s *EtcdStore) expired(p Presence, lease clientv3.LeaseID, revision int64) {
+	s.mutex.Lock()
+	if _, kept := s.kept[s.key(p.User, p.Node)]; kept && s.quit != nil && lease == s.lease {
+		logger.Warnf("EtcdStore: lease %x expired, granting a new one", lease)
+		if err := s.regrant(); err != nil {
+			logger.Warnf("EtcdStore: put presences with a new lease: %v", err)
+		}
+	}
+	listeners := append(([]func(p Presence))(nil), s.listeners...)
+	s.mutex.Unlock()
+
+	claimed, err := s.etcd.Claim(fmt.Sprintf("%sexpired/%s/%s/%d", s.prefix, url.PathEscape(p.User), url.PathEscape(p.Node), revision), claimTTL)
+	if err != nil {
+		logger.Warnf("EtcdStore: claim of the expiry of %s on %s failed: %v", p.User, p.Node, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	logger.Infof("Presence of %s on %s expired", p.User, p.Node)
+	for _, listener := range listeners {
+		listener(p)
+	}
+}
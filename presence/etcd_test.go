@@ -0,0 +1,123 @@
+package presence
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	discovery "github.com/mj23978/chat-backend-x/discovery/etcd"
+)
+
+// newEtcdStore returns a store on the etcd cluster of ETCD_ENDPOINTS, a comma separated
+// list of endpoints. The test is skipped if it is not set.
+func newEtcdStore(t *testing.T, prefix string) *EtcdStore {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD_ENDPOINTS is not set")
+	}
+	e := discovery.NewServiceWatcher(strings.Split(endpoints, ","), "presence-test").Etcd()
+	require.NotNil(t, e)
+	s, err := NewEtcdStore(e, prefix)
+	require.NoError(t, err)
+	return s
+}
+
+func TestEtcdStore(t *testing.T) {
+	prefix := "/presence-test/" + strconv.FormatInt(time.Now().UnixNano(), 36) + "/"
+	n1, n2 := newEtcdStore(t, prefix), newEtcdStore(t, prefix)
+	defer n1.Close()
+
+	var mutex sync.Mutex
+	var expired []Presence
+	for _, s := range []*EtcdStore{n1, n2} {
+		s.OnExpired(func(p Presence) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			expired = append(expired, p)
+		})
+	}
+
+	require.NoError(t, n1.Keep(Presence{User: "alice", Status: StatusOnline, Rooms: []string{"lobby"}, Node: "n1"}))
+	require.NoError(t, n1.Keep(Presence{User: "bob", Status: StatusOnline, Node: "n1"}))
+	require.NoError(t, n2.Keep(Presence{User: "alice", Status: StatusAway, Rooms: []string{"games"}, Node: "n2"}))
+
+	p, err := n2.Get("alice")
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.Equal(t, StatusOnline, p.Status)
+	assert.Equal(t, []string{"n1", "n2"}, p.Nodes)
+	assert.ElementsMatch(t, []string{"lobby", "games"}, p.Rooms)
+
+	presences, err := n1.List()
+	require.NoError(t, err)
+	require.Len(t, presences, 2)
+	assert.Equal(t, "alice", presences[0].User)
+	assert.Equal(t, "bob", presences[1].User)
+
+	require.NoError(t, n1.Release("alice", "n1"))
+	p, err = n1.Get("alice")
+	require.NoError(t, err)
+	require.NotNil(t, p, "alice is still connected to n2")
+	assert.Equal(t, StatusAway, p.Status)
+	assert.Equal(t, []string{"n2"}, p.Nodes)
+
+	// n2 dies: revoking its lease expires the presences it kept.
+	n2.mutex.Lock()
+	n2.revokeLease()
+	n2.mutex.Unlock()
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(expired) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	require.Len(t, expired, 1, "an expiry is reported once, releases are not reported")
+	assert.Equal(t, "alice", expired[0].User)
+	assert.Equal(t, "n2", expired[0].Node)
+	mutex.Unlock()
+
+	p, err = n1.Get("alice")
+	require.NoError(t, err)
+	assert.Nil(t, p)
+	require.NoError(t, n1.etcd.LeasesAlive(), "the presences of n1 share a live lease")
+}
+
+func TestEtcdStoreLeaseExpired(t *testing.T) {
+	prefix := "/presence-test/" + strconv.FormatInt(time.Now().UnixNano(), 36) + "/"
+	s := newEtcdStore(t, prefix)
+	defer s.Close()
+
+	require.NoError(t, s.Keep(Presence{User: "alice", Status: StatusOnline, Node: "n1"}))
+	require.NoError(t, s.Keep(Presence{User: "bob", Status: StatusOnline, Node: "n1"}))
+
+	// The lease expires behind the back of the store, e.g. while etcd was unreachable.
+	client, err := clientv3.New(clientv3.Config{Endpoints: strings.Split(os.Getenv("ETCD_ENDPOINTS"), ",")})
+	require.NoError(t, err)
+	defer client.Close()
+	s.mutex.Lock()
+	lease := s.lease
+	s.mutex.Unlock()
+	_, err = client.Revoke(context.Background(), lease)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		presences, err := s.List()
+		return err == nil && len(presences) == 2
+	}, 5*time.Second, 10*time.Millisecond, "the kept presences are put with a new lease")
+	require.NoError(t, s.Keep(Presence{User: "carol", Status: StatusOnline, Node: "n1"}))
+	presences, err := s.List()
+	require.NoError(t, err)
+	assert.Len(t, presences, 3)
+	s.mutex.Lock()
+	assert.NotEqual(t, lease, s.lease)
+	s.mutex.Unlock()
+}
@@ -0,0 +1,134 @@
+package presence
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultTTL is the lease duration of a MemoryStore.
+const DefaultTTL = 30 * time.Second
+
+// MemoryStore is a Store for a single node. A lease expires TTL after the presence was
+// last kept, so sessions renew it by calling Tracker.Touch on their heartbeats.
+type MemoryStore struct {
+	ttl   time.Duration
+	mutex sync.Mutex
+	// records maps users to their presences by node.
+	records   map[string]map[string]*memoryRecord
+	listeners []func(p Presence)
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryRecord struct {
+	presence Presence
+	expires  time.Time
+}
+
+// NewMemoryStore returns a MemoryStore with leases of ttl, DefaultTTL if 0.
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	s := &MemoryStore{
+		ttl:     ttl,
+		records: make(map[string]map[string]*memoryRecord),
+		quit:    make(chan struct{}),
+	}
+	go s.expire()
+	return s
+}
+
+func (s *MemoryStore) Keep(p Presence) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nodes, found := s.records[p.User]
+	if !found {
+		nodes = make(map[string]*memoryRecord)
+		s.records[p.User] = nodes
+	}
+	nodes[p.Node] = &memoryRecord{presence: p, expires: time.Now().Add(s.ttl)}
+	return nil
+}
+
+func (s *MemoryStore) Release(user string, node string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remove(user, node)
+	return nil
+}
+
+// remove deletes the presence of user on node. The mutex must be held.
+func (s *MemoryStore) remove(user string, node string) {
+	delete(s.records[user], node)
+	if len(s.records[user]) == 0 {
+		delete(s.records, user)
+	}
+}
+
+func (s *MemoryStore) Get(user string) (*Presence, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	presences := make([]Presence, 0, len(s.records[user]))
+	for _, record := range s.records[user] {
+		presences = append(presences, record.presence)
+	}
+	return Merge(presences...), nil
+}
+
+func (s *MemoryStore) List() ([]Presence, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	presences := make([]Presence, 0, len(s.records))
+	for _, nodes := range s.records {
+		for _, record := range nodes {
+			presences = append(presences, record.presence)
+		}
+	}
+	return mergeAll(presences), nil
+}
+
+func (s *MemoryStore) OnExpired(listener func(p Presence)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+func (s *MemoryStore) Close() error {
+	s.closeOnce.Do(func() { close(s.quit) })
+	return nil
+}
+
+// expire removes the records whose lease expired and notifies the listeners.
+func (s *MemoryStore) expire() {
+	interval := s.ttl / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case now := <-ticker.C:
+			var expired []Presence
+			s.mutex.Lock()
+			for user, nodes := range s.records {
+				for node, record := range nodes {
+					if now.After(record.expires) {
+						expired = append(expired, record.presence)
+						s.remove(user, node)
+					}
+				}
+			}
+			listeners := append(([]func(p Presence))(nil), s.listeners...)
+			s.mutex.Unlock()
+			for _, p := range expired {
+				for _, listener := range listeners {
+					listener(p)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Package presence tracks the online state of users with leases and broadcasts its
+// transitions through nprotoo.
+package presence
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Statuses of a user.
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// ErrUnknownUser is returned when the status of a user not online on this node is changed.
+var ErrUnknownUser = errors.New("presence: user is not online on this node")
+
+// Presence is the state of a user recorded in a Store.
+type Presence struct {
+	User   string `json:"user"`
+	Status string `json:"status"`
+	// Rooms lists the rooms the user is a member of.
+	Rooms []string `json:"rooms,omitempty"`
+	// Node is the ID of the NatsProtoo holding the lease of the user.
+	Node  string    `json:"node"`
+	Since time.Time `json:"since"`
+	// Nodes lists every node the user is connected to, set on the presences merged by
+	// Store.Get and Store.List.
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// InRoom reports whether the user is a member of room.
+func (p *Presence) InRoom(room string) bool {
+	for _, r := range p.Rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is broadcast when the presence of a user changed.
+type Event struct {
+	Presence
+	// Previous is the status of the user before the transition.
+	Previous string `json:"previous"`
+	// Expired is set on offline events caused by an expired lease, e.g. when the node
+	// holding it died.
+	Expired bool `json:"expired,omitempty"`
+}
+
+// EventFunc receives presence events.
+type EventFunc func(event Event)
+
+// Store records presences with leases. A user connected to several nodes has a presence
+// per node, which Get and List merge, see Merge.
+type Store interface {
+	// Keep records p on node p.Node until it is released or its lease expires. Keeping a
+	// recorded user again updates it and renews its lease.
+	Keep(p Presence) error
+	// Release removes the presence of user on node without expiring it.
+	Release(user string, node string) error
+	// Get returns the merged presence of user, nil if it has none.
+	Get(user string) (*Presence, error)
+	// List returns the merged presence of every recorded user.
+	List() ([]Presence, error)
+	// OnExpired registers listener to be called once per expired lease of a user on a
+	// node, with the last presence recorded for it.
+	OnExpired(listener func(p Presence))
+	Close() error
+}
+
+// statusRanks orders the statuses by availability, Merge picks the highest.
+var statusRanks = map[string]int{StatusAway: 1, StatusOnline: 2}
+
+// Merge merges the presences of a user on several nodes. The user is online if it is
+// online on any node, otherwise away, and member of the rooms of every node. Node and
+// Since are taken from the earliest presence with that status. Merge returns nil if
+// none of presences is online or away.
+func Merge(presences ...Presence) *Presence {
+	var merged *Presence
+	rooms := map[string]bool{}
+	nodes := map[string]bool{}
+	for _, p := range presences {
+		rank := statusRanks[p.Status]
+		if rank == 0 {
+			continue
+		}
+		if merged == nil || rank > statusRanks[merged.Status] || (rank == statusRanks[merged.Status] && p.Since.Before(merged.Since)) {
+			chosen := p
+			if merged != nil {
+				chosen.Rooms = merged.Rooms
+			} else {
+				chosen.Rooms = nil
+			}
+			merged = &chosen
+		}
+		for _, room := range p.Rooms {
+			if !rooms[room] {
+				rooms[room] = true
+				merged.Rooms = append(merged.Rooms, room)
+			}
+		}
+		nodes[p.Node] = true
+		for _, node := range p.Nodes {
+			nodes[node] = true
+		}
+	}
+	if merged == nil {
+		return nil
+	}
+	merged.Nodes = make([]string, 0, len(nodes))
+	for node := range nodes {
+		merged.Nodes = append(merged.Nodes, node)
+	}
+	sort.Strings(merged.Nodes)
+	return merged
+}
+
+// mergeAll merges the presences of every user, sorted by user.
+func mergeAll(presences []Presence) []Presence {
+	byUser := make(map[string][]Presence)
+	for _, p := range presences {
+		byUser[p.User] = append(byUser[p.User], p)
+	}
+	merged := make([]Presence, 0, len(byUser))
+	for _, userPresences := range byUser {
+		if p := Merge(userPresences...); p != nil {
+			merged = append(merged, *p)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].User < merged[j].User })
+	return merged
+}
@@ -0,0 +1,32 @@
+package presence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	now := time.Now()
+	assert.Nil(t, Merge())
+	assert.Nil(t, Merge(Presence{User: "alice", Status: StatusOffline, Node: "n1"}))
+
+	merged := Merge(
+		Presence{User: "alice", Status: StatusAway, Rooms: []string{"games"}, Node: "n3", Since: now.Add(-time.Hour)},
+		Presence{User: "alice", Status: StatusOnline, Rooms: []string{"lobby"}, Node: "n2", Since: now},
+		Presence{User: "alice", Status: StatusOnline, Rooms: []string{"lobby", "music"}, Node: "n1", Since: now.Add(-time.Minute)},
+		Presence{User: "alice", Status: StatusOffline, Rooms: []string{"secret"}, Node: "n4", Since: now},
+	)
+	require.NotNil(t, merged)
+	assert.Equal(t, StatusOnline, merged.Status)
+	assert.Equal(t, "n1", merged.Node, "the earliest presence with the merged status is picked")
+	assert.Equal(t, now.Add(-time.Minute), merged.Since)
+	assert.Equal(t, []string{"games", "lobby", "music"}, merged.Rooms)
+	assert.Equal(t, []string{"n1", "n2", "n3"}, merged.Nodes)
+
+	again := Merge(*merged, Presence{User: "alice", Status: StatusAway, Node: "n5"})
+	assert.Equal(t, StatusOnline, again.Status)
+	assert.Equal(t, []string{"n1", "n2", "n3", "n5"}, again.Nodes)
+}
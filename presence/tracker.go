@@ -0,0 +1,222 @@
+package presence
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+)
+
+// DefaultSubject is the channel presence events are broadcast on. The method of an event
+// notification is the new status.
+const DefaultSubject = "presence"
+
+// Tracker records the presence of the users connected to this node in a Store and
+// broadcasts the transitions of their presence merged across nodes, see Merge. A user
+// going offline on this node is only broadcast offline if it is not connected to another
+// node. Events of expired leases are broadcast by the node the Store reports the expiry to.
+type Tracker struct {
+	np        *nprotoo.NatsProtoo
+	store     Store
+	subject   string
+	bc        *nprotoo.Broadcaster
+	listener  nprotoo.BroadCastFunc
+	mutex     sync.Mutex
+	local     map[string]Presence
+	listeners []EventFunc
+}
+
+// NewTracker returns a tracker broadcasting on DefaultSubject.
+func NewTracker(np *nprotoo.NatsProtoo, store Store) *Tracker {
+	return NewTrackerWithSubject(np, store, DefaultSubject)
+}
+
+// NewTrackerWithSubject returns a tracker broadcasting on subject.
+func NewTrackerWithSubject(np *nprotoo.NatsProtoo, store Store, subject string) *Tracker {
+	t := &Tracker{
+		np:      np,
+		store:   store,
+		subject: subject,
+		bc:      np.NewBroadcaster(subject),
+		local:   make(map[string]Presence),
+	}
+	t.listener = t.receive
+	np.OnBroadcast(subject, t.listener)
+	store.OnExpired(t.expired)
+	return t
+}
+
+// OnChange registers listener to receive the presence events of every node.
+func (t *Tracker) OnChange(listener EventFunc) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.listeners = append(t.listeners, listener)
+}
+
+// Online records user online and member of rooms.
+func (t *Tracker) Online(user string, rooms ...string) error {
+	return t.set(user, StatusOnline, rooms)
+}
+
+// Away records user away, keeping its rooms.
+func (t *Tracker) Away(user string) error {
+	t.mutex.Lock()
+	p, found := t.local[user]
+	t.mutex.Unlock()
+	if !found {
+		return ErrUnknownUser
+	}
+	return t.set(user, StatusAway, p.Rooms)
+}
+
+// Offline releases the lease of user on this node and broadcasts its offline event, or
+// its new status if it is still connected to other nodes.
+func (t *Tracker) Offline(user string) error {
+	t.mutex.Lock()
+	p, found := t.local[user]
+	delete(t.local, user)
+	t.mutex.Unlock()
+	if !found {
+		return nil
+	}
+	if err := t.store.Release(user, p.Node); err != nil {
+		return err
+	}
+	return t.left(p, false)
+}
+
+// Touch renews the lease of user, e.g. on the heartbeats of its session.
+func (t *Tracker) Touch(user string) error {
+	t.mutex.Lock()
+	p, found := t.local[user]
+	t.mutex.Unlock()
+	if !found {
+		return ErrUnknownUser
+	}
+	return t.store.Keep(p)
+}
+
+// Get returns the presence of user, nil if it is offline.
+func (t *Tracker) Get(user string) (*Presence, error) {
+	return t.store.Get(user)
+}
+
+// OnlineMembers returns the presences of the online and away members of room.
+func (t *Tracker) OnlineMembers(room string) ([]Presence, error) {
+	presences, err := t.store.List()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Presence, 0, len(presences))
+	for _, p := range presences {
+		if p.Status != StatusOffline && p.InRoom(room) {
+			members = append(members, p)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].User < members[j].User })
+	return members, nil
+}
+
+// Close sets the local users offline and stops receiving events.
+func (t *Tracker) Close() error {
+	t.mutex.Lock()
+	users := make([]string, 0, len(t.local))
+	for user := range t.local {
+		users = append(users, user)
+	}
+	t.mutex.Unlock()
+	for _, user := range users {
+		if err := t.Offline(user); err != nil {
+			return err
+		}
+	}
+	t.np.OffBroadcast(t.subject, t.listener)
+	return nil
+}
+
+func (t *Tracker) set(user string, status string, rooms []string) error {
+	t.mutex.Lock()
+	previous, found := t.local[user]
+	p := Presence{User: user, Status: status, Rooms: rooms, Node: t.np.NodeID(), Since: previous.Since}
+	if !found || previous.Status != status {
+		p.Since = time.Now()
+	}
+	t.local[user] = p
+	t.mutex.Unlock()
+
+	before, err := t.store.Get(user)
+	if err != nil {
+		return err
+	}
+	if err := t.store.Keep(p); err != nil {
+		return err
+	}
+	after, err := t.store.Get(user)
+	if err != nil {
+		return err
+	}
+	if after == nil {
+		after = Merge(p)
+	}
+	event := Event{Presence: *after, Previous: StatusOffline}
+	if before != nil {
+		event.Previous = before.Status
+	}
+	t.broadcast(event)
+	return nil
+}
+
+// left broadcasts the transition of the user of p, whose presence on p.Node was removed.
+// The user is offline unless it is still connected to other nodes, in which case only a
+// change of its status is broadcast.
+func (t *Tracker) left(p Presence, expired bool) error {
+	after, err := t.store.Get(p.User)
+	if err != nil {
+		return err
+	}
+	if after == nil {
+		previous := p.Status
+		p.Status, p.Since = StatusOffline, time.Now()
+		t.broadcast(Event{Presence: p, Previous: previous, Expired: expired})
+		return nil
+	}
+	// The presence before the removal is the remaining one merged with the removed.
+	if before := Merge(*after, p); before.Status != after.Status {
+		t.broadcast(Event{Presence: *after, Previous: before.Status})
+	}
+	return nil
+}
+
+// expired broadcasts the transition of a user whose lease on a node expired.
+func (t *Tracker) expired(p Presence) {
+	t.mutex.Lock()
+	if local, found := t.local[p.User]; found && local.Node == p.Node {
+		delete(t.local, p.User)
+	}
+	t.mutex.Unlock()
+	if err := t.left(p, true); err != nil {
+		logger.Warnf("Presence: expiry of %s on %s: %v", p.User, p.Node, err)
+	}
+}
+
+func (t *Tracker) broadcast(event Event) {
+	logger.Debugf("Presence: [user:%s, %s => %s]", event.User, event.Previous, event.Status)
+	t.bc.Say(event.Status, &event)
+}
+
+func (t *Tracker) receive(notification nprotoo.Notification, subj string) {
+	var event Event
+	if err := json.Unmarshal(notification.Data, &event); err != nil {
+		logger.Warnf("Presence: invalid event %v", err)
+		return
+	}
+	t.mutex.Lock()
+	listeners := append(([]EventFunc)(nil), t.listeners...)
+	t.mutex.Unlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
@@ -0,0 +1,141 @@
+package presence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+)
+
+func receiveEvent(t *testing.T, events chan Event) Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no presence event received")
+		return Event{}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	s, err := server.NewServer(&server.Options{Port: -1})
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Shutdown()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	np, err := nprotoo.NewNatsProtooWithConfig(nprotoo.NewConfig(s.ClientURL()))
+	require.NoError(t, err)
+	defer np.Close()
+
+	store := NewMemoryStore(100 * time.Millisecond)
+	defer store.Close()
+	tracker := NewTracker(np, store)
+	events := make(chan Event, 10)
+	tracker.OnChange(func(event Event) { events <- event })
+
+	require.NoError(t, tracker.Online("alice", "lobby"))
+	require.NoError(t, tracker.Online("bob", "lobby", "games"))
+	require.NoError(t, tracker.Online("carol", "games"))
+	for _, user := range []string{"alice", "bob", "carol"} {
+		event := receiveEvent(t, events)
+		assert.Equal(t, user, event.User)
+		assert.Equal(t, StatusOnline, event.Status)
+		assert.Equal(t, StatusOffline, event.Previous)
+		assert.Equal(t, np.NodeID(), event.Node)
+	}
+
+	require.NoError(t, tracker.Away("bob"))
+	event := receiveEvent(t, events)
+	assert.Equal(t, StatusAway, event.Status)
+	assert.Equal(t, StatusOnline, event.Previous)
+	assert.Equal(t, []string{"lobby", "games"}, event.Rooms)
+
+	members, err := tracker.OnlineMembers("lobby")
+	require.NoError(t, err)
+	require.Len(t, members, 2)
+	assert.Equal(t, "alice", members[0].User)
+	assert.Equal(t, "bob", members[1].User)
+	assert.Equal(t, StatusAway, members[1].Status)
+
+	require.NoError(t, tracker.Offline("carol"))
+	event = receiveEvent(t, events)
+	assert.Equal(t, "carol", event.User)
+	assert.Equal(t, StatusOffline, event.Status)
+	assert.False(t, event.Expired)
+	p, err := tracker.Get("carol")
+	require.NoError(t, err)
+	assert.Nil(t, p)
+
+	// alice keeps her session alive, bob's lease expires.
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		require.NoError(t, tracker.Touch("alice"))
+		time.Sleep(20 * time.Millisecond)
+	}
+	event = receiveEvent(t, events)
+	assert.Equal(t, "bob", event.User)
+	assert.Equal(t, StatusOffline, event.Status)
+	assert.Equal(t, StatusAway, event.Previous)
+	assert.True(t, event.Expired)
+	assert.Equal(t, ErrUnknownUser, tracker.Touch("bob"))
+
+	members, err = tracker.OnlineMembers("lobby")
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, "alice", members[0].User)
+
+	require.NoError(t, tracker.Close())
+}
+
+func TestTrackerNodes(t *testing.T) {
+	s, err := server.NewServer(&server.Options{Port: -1})
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Shutdown()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	store := NewMemoryStore(time.Minute)
+	defer store.Close()
+	trackers := make([]*Tracker, 2)
+	for i, node := range []string{"n1", "n2"} {
+		config := nprotoo.NewConfig(s.ClientURL())
+		config.NodeID = node
+		np, err := nprotoo.NewNatsProtooWithConfig(config)
+		require.NoError(t, err)
+		defer np.Close()
+		trackers[i] = NewTracker(np, store)
+	}
+	events := make(chan Event, 10)
+	trackers[0].OnChange(func(event Event) { events <- event })
+
+	require.NoError(t, trackers[0].Online("alice", "lobby"))
+	assert.Equal(t, StatusOnline, receiveEvent(t, events).Status)
+	require.NoError(t, trackers[1].Online("alice", "games"))
+	event := receiveEvent(t, events)
+	assert.Equal(t, StatusOnline, event.Previous)
+	assert.Equal(t, []string{"lobby", "games"}, event.Rooms)
+	assert.Equal(t, []string{"n1", "n2"}, event.Nodes)
+
+	require.NoError(t, trackers[1].Away("alice"))
+	event = receiveEvent(t, events)
+	assert.Equal(t, StatusOnline, event.Status, "alice is still online on n1")
+
+	require.NoError(t, trackers[0].Offline("alice"))
+	event = receiveEvent(t, events)
+	assert.Equal(t, StatusAway, event.Status, "going offline on n1 leaves alice away on n2")
+	assert.Equal(t, StatusOnline, event.Previous)
+	assert.Equal(t, "n2", event.Node)
+
+	require.NoError(t, trackers[1].Offline("alice"))
+	event = receiveEvent(t, events)
+	assert.Equal(t, StatusOffline, event.Status)
+	assert.Equal(t, StatusAway, event.Previous)
+	p, err := trackers[0].Get("alice")
+	require.NoError(t, err)
+	assert.Nil(t, p)
+}
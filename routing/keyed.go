@@ -0,0 +1,214 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	discovery "github.com/mj23978/chat-backend-x/discovery/etcd"
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+)
+
+// DefaultMaxTrackedKeys bounds the keys a KeyedRequestor reports moves of.
+const DefaultMaxTrackedKeys = 100000
+
+// ErrNoNodes is returned when the service has no live node to route a key to.
+var ErrNoNodes = errors.New("routing: no live node of the service")
+
+// NodeSource returns the live nodes of a service. It is implemented by *discovery.ServiceWatcher.
+type NodeSource interface {
+	GetNodes(service string) (map[string]discovery.Node, bool)
+}
+
+var _ NodeSource = (*discovery.ServiceWatcher)(nil)
+
+// NodeChannels returns the rpc channels of the live nodes of service, e.g. as the Targets
+// of nprotoo.HedgeOptions.
+func NodeChannels(nodes NodeSource, service string) func() []string {
+	return func() []string {
+		live, _ := nodes.GetNodes(service)
+		channels := make([]string, 0, len(live))
+		for _, node := range live {
+			channels = append(channels, discovery.GetRPCChannel(node))
+		}
+		sort.Strings(channels)
+		return channels
+	}
+}
+
+// MovedFunc receives the routed keys moved to another node by a change of the node set.
+type MovedFunc func(moves []Move)
+
+// KeyedRequestor sends the requests about a key to the rpc channel of the node owning the
+// key on a Ring of the live nodes of a service. The ring is rebuilt when the node set
+// changes, which only reroutes the keys of the nodes which joined or left.
+type KeyedRequestor struct {
+	np       *nprotoo.NatsProtoo
+	nodes    NodeSource
+	service  string
+	replicas int
+	timeout  time.Duration
+
+	// MaxTrackedKeys bounds the keys moves are reported of. Keys are tracked once routed.
+	MaxTrackedKeys int
+
+	mutex      sync.Mutex
+	ring       *Ring
+	requestors map[string]*nprotoo.Requestor
+	keys       map[string]bool
+	listeners  []MovedFunc
+}
+
+// NewKeyedRequestor returns a requestor routing keys to the nodes of service found in nodes.
+func NewKeyedRequestor(np *nprotoo.NatsProtoo, nodes NodeSource, service string) *KeyedRequestor {
+	return &KeyedRequestor{
+		np:             np,
+		nodes:          nodes,
+		service:        service,
+		replicas:       DefaultReplicas,
+		timeout:        nprotoo.DefaultRequestTimeout,
+		MaxTrackedKeys: DefaultMaxTrackedKeys,
+		ring:           NewRing(DefaultReplicas),
+		requestors:     make(map[string]*nprotoo.Requestor),
+		keys:           make(map[string]bool),
+	}
+}
+
+// SetReplicas sets the number of virtual nodes of every node. Every requestor of a
+// service must use the same number to agree on the owner of keys.
+func (kr *KeyedRequestor) SetReplicas(replicas int) {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.replicas = replicas
+	kr.ring = NewRing(replicas, kr.ring.Nodes()...)
+}
+
+// SetRequestTimeout sets the timeout of the requests.
+func (kr *KeyedRequestor) SetRequestTimeout(d time.Duration) {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.timeout = d
+	for _, requestor := range kr.requestors {
+		requestor.SetRequestTimeout(d)
+	}
+}
+
+// OnMoved registers listener to receive the tracked keys moved by a change of the node set.
+func (kr *KeyedRequestor) OnMoved(listener MovedFunc) {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.listeners = append(kr.listeners, listener)
+}
+
+// Refresh rebuilds the ring if the live nodes changed and returns the tracked keys which
+// moved. It is called before routing a key, and may be called from a ServiceWatchCallback
+// to report moves without waiting for the next request.
+func (kr *KeyedRequestor) Refresh() []Move {
+	nodes, _ := kr.nodes.GetNodes(kr.service)
+	ids := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		ids = append(ids, node.Info["id"])
+	}
+
+	kr.mutex.Lock()
+	if !kr.changed(ids) {
+		kr.mutex.Unlock()
+		return nil
+	}
+	next := NewRing(kr.replicas, ids...)
+	keys := make([]string, 0, len(kr.keys))
+	for key := range kr.keys {
+		keys = append(keys, key)
+	}
+	moves := kr.ring.Moved(next, keys...)
+	logger.Infof("KeyedRequestor[%s]: nodes %v => %v, %d keys moved", kr.service, kr.ring.Nodes(), next.Nodes(), len(moves))
+	kr.ring = next
+	for node := range kr.requestors {
+		if !next.Has(node) {
+			delete(kr.requestors, node)
+		}
+	}
+	listeners := append(([]MovedFunc)(nil), kr.listeners...)
+	kr.mutex.Unlock()
+
+	if len(moves) > 0 {
+		for _, listener := range listeners {
+			listener(moves)
+		}
+	}
+	return moves
+}
+
+// changed reports whether ids differ from the nodes of the ring. kr.mutex must be held.
+func (kr *KeyedRequestor) changed(ids []string) bool {
+	if len(ids) != kr.ring.Len() {
+		return true
+	}
+	for _, id := range ids {
+		if !kr.ring.Has(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Node returns the ID of the node owning key.
+func (kr *KeyedRequestor) Node(key string) (string, error) {
+	kr.Refresh()
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	node := kr.ring.Get(key)
+	if node == "" {
+		return "", ErrNoNodes
+	}
+	return node, nil
+}
+
+// For returns the requestor of the rpc channel of the node owning key.
+func (kr *KeyedRequestor) For(key string) (*nprotoo.Requestor, error) {
+	kr.Refresh()
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	node := kr.ring.Get(key)
+	if node == "" {
+		return nil, ErrNoNodes
+	}
+	if !kr.keys[key] && (kr.MaxTrackedKeys <= 0 || len(kr.keys) < kr.MaxTrackedKeys) {
+		kr.keys[key] = true
+	}
+	requestor, found := kr.requestors[node]
+	if !found {
+		requestor = kr.np.NewRequestor(discovery.GetRPCChannel(discovery.Node{Info: map[string]string{"id": node}}))
+		requestor.SetRequestTimeout(kr.timeout)
+		kr.requestors[node] = requestor
+	}
+	return requestor, nil
+}
+
+// Forget stops tracking key, e.g. once the room it names was closed.
+func (kr *KeyedRequestor) Forget(key string) {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	delete(kr.keys, key)
+}
+
+// SyncRequest sends a request about key and waits for its response.
+func (kr *KeyedRequestor) SyncRequest(key string, method string, data interface{}) (nprotoo.RawMessage, error) {
+	return kr.SyncRequestContext(context.Background(), key, method, data)
+}
+
+// SyncRequestContext is SyncRequest canceled with ctx.
+func (kr *KeyedRequestor) SyncRequestContext(ctx context.Context, key string, method string, data interface{}) (nprotoo.RawMessage, error) {
+	requestor, err := kr.For(key)
+	if err != nil {
+		return nil, err
+	}
+	result, rerr := requestor.SyncRequestContext(ctx, method, data)
+	if rerr != nil {
+		return nil, rerr
+	}
+	return result, nil
+}
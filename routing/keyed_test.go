@@ -0,0 +1,105 @@
+package routing
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	discovery "github.com/mj23978/chat-backend-x/discovery/etcd"
+)
+
+type staticNodes struct {
+	mutex sync.Mutex
+	nodes map[string]discovery.Node
+}
+
+func (s *staticNodes) GetNodes(service string) (map[string]discovery.Node, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nodes := make(map[string]discovery.Node, len(s.nodes))
+	for id, node := range s.nodes {
+		nodes[id] = node
+	}
+	return nodes, len(nodes) > 0
+}
+
+func (s *staticNodes) set(ids ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nodes = make(map[string]discovery.Node)
+	for _, id := range ids {
+		s.nodes[id] = discovery.Node{ID: id, Info: map[string]string{"id": id, "service": "chat"}}
+	}
+}
+
+func TestKeyedRequestor(t *testing.T) {
+	s, err := server.NewServer(&server.Options{Port: -1})
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Shutdown()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	np, err := nprotoo.NewNatsProtooWithConfig(nprotoo.NewConfig(s.ClientURL()))
+	require.NoError(t, err)
+	defer np.Close()
+	for _, id := range []string{"chat-a", "chat-b"} {
+		id := id
+		np.OnRequest("rpc-"+id, func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+			accept(id)
+		})
+	}
+
+	nodes := &staticNodes{}
+	kr := NewKeyedRequestor(np, nodes, "chat")
+	_, err = kr.SyncRequest("room-1", "state", nil)
+	assert.Equal(t, ErrNoNodes, err)
+
+	nodes.set("chat-a", "chat-b")
+	owners := map[string]string{}
+	for _, key := range []string{"room-1", "room-2", "room-3", "room-4", "room-5", "room-6"} {
+		result, err := kr.SyncRequest(key, "state", nil)
+		require.NoError(t, err)
+		var node string
+		require.NoError(t, json.Unmarshal(result, &node))
+		owner, err := kr.Node(key)
+		require.NoError(t, err)
+		assert.Equal(t, owner, node, "the request about %s is sent to its owner", key)
+		owners[key] = node
+	}
+
+	var moved []Move
+	kr.OnMoved(func(moves []Move) { moved = moves })
+	nodes.set("chat-a")
+	moves := kr.Refresh()
+	assert.Equal(t, moves, moved)
+	for key, owner := range owners {
+		if owner == "chat-b" {
+			assert.Contains(t, moves, Move{Key: key, From: "chat-b", To: "chat-a"})
+		}
+	}
+	assert.Len(t, moves, len(owners)-countOwned(owners, "chat-a"))
+	assert.Nil(t, kr.Refresh(), "an unchanged node set moves nothing")
+
+	result, err := kr.SyncRequest("room-1", "state", nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, `"chat-a"`, string(result))
+
+	nodes.set("chat-b", "chat-a")
+	assert.Equal(t, []string{"rpc-chat-a", "rpc-chat-b"}, NodeChannels(nodes, "chat")())
+}
+
+func countOwned(owners map[string]string, node string) int {
+	n := 0
+	for _, owner := range owners {
+		if owner == node {
+			n++
+		}
+	}
+	return n
+}
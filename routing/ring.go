@@ -0,0 +1,102 @@
+// Package routing routes requests about a key to the same service node.
+package routing
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of virtual nodes of every node on a Ring.
+const DefaultReplicas = 160
+
+// Ring is a consistent hash ring. Adding or removing a node only moves the keys it owns,
+// and every Ring of the same nodes maps a key to the same node.
+type Ring struct {
+	replicas int
+	hashes   []uint32
+	owners   map[uint32]string
+	nodes    []string
+}
+
+// Move is a key whose owner changed between two rings. From or To is empty if the key
+// had or has no owner.
+type Move struct {
+	Key  string `json:"key"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// NewRing returns a ring of nodes with replicas virtual nodes each, DefaultReplicas if 0.
+func NewRing(replicas int, nodes ...string) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{replicas: replicas, owners: make(map[uint32]string, replicas*len(nodes))}
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		r.nodes = append(r.nodes, node)
+		for i := 0; i < replicas; i++ {
+			h := hash(strconv.Itoa(i) + "#" + node)
+			// On the rare collision of two virtual nodes the smaller node ID wins, so the
+			// ring does not depend on the order of nodes.
+			if owner, found := r.owners[h]; found && owner < node {
+				continue
+			} else if !found {
+				r.hashes = append(r.hashes, h)
+			}
+			r.owners[h] = node
+		}
+	}
+	sort.Strings(r.nodes)
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func hash(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// Nodes returns the sorted nodes of the ring.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Len returns the number of nodes of the ring.
+func (r *Ring) Len() int {
+	return len(r.nodes)
+}
+
+// Has reports whether node is on the ring.
+func (r *Ring) Has(node string) bool {
+	i := sort.SearchStrings(r.nodes, node)
+	return i < len(r.nodes) && r.nodes[i] == node
+}
+
+// Get returns the node owning key, empty if the ring has no nodes.
+func (r *Ring) Get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// Moved returns the keys whose owner differs on next.
+func (r *Ring) Moved(next *Ring, keys ...string) []Move {
+	var moves []Move
+	for _, key := range keys {
+		if from, to := r.Get(key), next.Get(key); from != to {
+			moves = append(moves, Move{Key: key, From: from, To: to})
+		}
+	}
+	return moves
+}
@@ -0,0 +1,41 @@
+package routing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRing(t *testing.T) {
+	assert.Equal(t, "", NewRing(0).Get("room-1"))
+
+	ring := NewRing(0, "a", "b", "c")
+	assert.Equal(t, []string{"a", "b", "c"}, ring.Nodes())
+	keys := make([]string, 3000)
+	counts := map[string]int{}
+	for i := range keys {
+		keys[i] = fmt.Sprintf("room-%d", i)
+		counts[ring.Get(keys[i])]++
+	}
+	for _, node := range ring.Nodes() {
+		assert.InDelta(t, 1000, counts[node], 250, "keys of %s", node)
+	}
+
+	reordered := NewRing(0, "c", "a", "b", "a")
+	assert.Empty(t, ring.Moved(reordered, keys...), "rings of the same nodes agree")
+
+	grown := NewRing(0, "a", "b", "c", "d")
+	moves := ring.Moved(grown, keys...)
+	require.NotEmpty(t, moves)
+	assert.InDelta(t, 750, len(moves), 250)
+	for _, move := range moves {
+		assert.Equal(t, "d", move.To, "only the keys of the new node move")
+	}
+
+	shrunk := NewRing(0, "a", "c")
+	for _, move := range ring.Moved(shrunk, keys...) {
+		assert.Equal(t, "b", move.From, "only the keys of the removed node move")
+	}
+}
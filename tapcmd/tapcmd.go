@@ -0,0 +1,162 @@
+// Package tapcmd provides the `tap` command recording and replaying the traffic of nprotoo
+// services, apart from nprotoo so the services do not depend on cobra.
+package tapcmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	cobrax "github.com/mj23978/chat-backend-x/cobra"
+)
+
+// NewCommand returns the `tap` command recording the traffic of services to a JSONL
+// file and replaying recordings against another environment.
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tap",
+		Short: "Record and replay the requests, responses and notifications of services",
+	}
+	cmd.PersistentFlags().String("url", nprotoo.DefaultNatsURL, "NATS server URL")
+	cmd.PersistentFlags().String("namespace", "", "Namespace of the subjects, e.g. staging.acme")
+	cmd.AddCommand(newTapRecordCommand(), newTapReplayCommand())
+	return cmd
+}
+
+func newTapRecordCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "record",
+		Short: "Record the messages on subjects, or the records of tapped services on a mirror subject",
+		Example: `  tap record --subject "rpc-*" --subject "rooms.>" --out chat.jsonl
+  tap record --mirror _NPROTOO.tap --duration 10m --out chat.jsonl`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			np, err := connectTap(cmd)
+			if err != nil {
+				return err
+			}
+			defer np.Close()
+			sink, err := openTapOutput(cmd, cobrax.MustGetString(cmd, "out"))
+			if err != nil {
+				return err
+			}
+			defer sink.Close()
+
+			var stop func()
+			if mirror := cobrax.MustGetString(cmd, "mirror"); mirror != "" {
+				stop, err = np.CopyTap(mirror, sink)
+			} else {
+				stop, err = np.TapSubjects(sink, cobrax.MustGetStringSlice(cmd, "subject")...)
+			}
+			if err != nil {
+				return err
+			}
+			defer stop()
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(signals)
+			var timeout <-chan time.Time
+			if d := cobrax.MustGetDuration(cmd, "duration"); d > 0 {
+				timeout = time.After(d)
+			}
+			select {
+			case <-signals:
+			case <-timeout:
+			}
+			return nil
+		},
+	}
+	cmd.Flags().String("out", "-", "JSONL file the records are appended to, - for stdout")
+	cmd.Flags().StringSlice("subject", []string{">"}, "Subjects to record, wildcards allowed")
+	cmd.Flags().String("mirror", "", "Mirror subject of tapped services to record instead of subjects")
+	cmd.Flags().Duration("duration", 0, "Stop recording after this duration, 0 records until interrupted")
+	return cmd
+}
+
+func newTapReplayCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replay <recording.jsonl>",
+		Short: "Send the records of a recording again",
+		Example: `  tap replay chat.jsonl --namespace staging.acme --speed 4
+  tap replay chat.jsonl --kind request --channel "rpc-*" --responses responses.jsonl`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r := cmd.InOrStdin()
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			np, err := connectTap(cmd)
+			if err != nil {
+				return err
+			}
+			defer np.Close()
+
+			opts := nprotoo.TapReplayOptions{
+				Speed:      cobrax.MustGetFloat64(cmd, "speed"),
+				Directions: cobrax.MustGetStringSlice(cmd, "direction"),
+				Kinds:      cobrax.MustGetStringSlice(cmd, "kind"),
+				Channels:   cobrax.MustGetStringSlice(cmd, "channel"),
+				Timeout:    cobrax.MustGetDuration(cmd, "timeout"),
+			}
+			if out := cobrax.MustGetString(cmd, "responses"); out != "" {
+				if opts.Responses, err = openTapOutput(cmd, out); err != nil {
+					return err
+				}
+				defer opts.Responses.Close()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(signals)
+			go func() {
+				select {
+				case <-signals:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			result, err := np.Replay(ctx, r, opts)
+			if err != nil {
+				return err
+			}
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(&result)
+		},
+	}
+	cmd.Flags().Float64("speed", 1, "Speed of the replay relative to the recording, 0 sends every record without delay")
+	cmd.Flags().StringSlice("direction", []string{nprotoo.TapInbound}, "Directions of the records to send")
+	cmd.Flags().StringSlice("kind", []string{nprotoo.TapRequest, nprotoo.TapCancel, nprotoo.TapNotification}, "Kinds of the records to send")
+	cmd.Flags().StringSlice("channel", nil, "Channels of the records to send, wildcards allowed, all if empty")
+	cmd.Flags().String("responses", "", "JSONL file the responses to the replayed requests are appended to, - for stdout")
+	cmd.Flags().Duration("timeout", nprotoo.DefaultTapReplayTimeout, "Wait for the responses after the last record")
+	return cmd
+}
+
+func connectTap(cmd *cobra.Command) (*nprotoo.NatsProtoo, error) {
+	config := nprotoo.NewConfig(cobrax.MustGetString(cmd, "url"))
+	config.Name = "nprotoo tap"
+	config.Namespace = cobrax.MustGetString(cmd, "namespace")
+	return nprotoo.NewNatsProtooWithConfig(config)
+}
+
+func openTapOutput(cmd *cobra.Command, path string) (nprotoo.TapSink, error) {
+	if path == "-" {
+		return nprotoo.NewJSONLTap(cmd.OutOrStdout()), nil
+	}
+	return nprotoo.OpenTapFile(path)
+}
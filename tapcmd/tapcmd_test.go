@@ -0,0 +1,57 @@
+package tapcmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	cobrax "github.com/mj23978/chat-backend-x/cobra"
+)
+
+func newNamespacedProtoo(t *testing.T, s *server.Server, namespace string) *nprotoo.NatsProtoo {
+	config := nprotoo.NewConfig(s.ClientURL())
+	config.Namespace = namespace
+	np, err := nprotoo.NewNatsProtooWithConfig(config)
+	require.NoError(t, err)
+	t.Cleanup(np.Close)
+	return np
+}
+
+func TestTapCommand(t *testing.T) {
+	s, err := server.NewServer(&server.Options{Port: -1})
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Shutdown()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+
+	prod := newNamespacedProtoo(t, s, "prod")
+	var recording bytes.Buffer
+	prod.Tap(nprotoo.NewJSONLTap(&recording))
+	prod.OnRequest("rpc-chat", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		accept(request.Method)
+	})
+	_, rerr := prod.NewRequestor("rpc-chat").SyncRequest("send", map[string]string{"text": "hi"})
+	require.Nil(t, rerr)
+	require.NoError(t, prod.Untap())
+	path := filepath.Join(t.TempDir(), "chat.jsonl")
+	require.NoError(t, ioutil.WriteFile(path, recording.Bytes(), 0644))
+
+	staging := newNamespacedProtoo(t, s, "staging")
+	staging.OnRequest("rpc-chat", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) { accept(nil) })
+
+	out := cobrax.ExecNoErr(t, NewCommand(), "replay", path, "--url", s.ClientURL(), "--namespace", "staging",
+		"--speed", "0", "--kind", nprotoo.TapRequest)
+	var result nprotoo.TapReplayResult
+	require.NoError(t, json.NewDecoder(strings.NewReader(out)).Decode(&result))
+	assert.Equal(t, nprotoo.TapReplayResult{Replayed: 1, Skipped: result.Skipped, Responses: 1}, result)
+	assert.NotZero(t, result.Skipped)
+}
@@ -6,6 +6,15 @@ type Error struct {
 	Reason string
 }
 
+func (e Error) Error() string {
+	return e.Reason
+}
+
+// StatusCode implements StatusCodeCarrier, so ToDetailedError keeps the code of e.
+func (e Error) StatusCode() int {
+	return e.Code
+}
+
 // Future .
 type Future struct {
 	c      chan struct{}
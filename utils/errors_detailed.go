@@ -0,0 +1,201 @@
+package utils
+
+import (
+	stderrors "errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ory/herodot"
+)
+
+// Well-known error codes. They equal the HTTP status a failure surfaces with at the HTTP edge.
+const (
+	CodeBadRequest          = http.StatusBadRequest
+	CodeUnauthorized        = http.StatusUnauthorized
+	CodeForbidden           = http.StatusForbidden
+	CodeNotFound            = http.StatusNotFound
+	CodeConflict            = http.StatusConflict
+	CodeInternalServerError = http.StatusInternalServerError
+	CodeUnavailable         = http.StatusServiceUnavailable
+	CodeTimeout             = http.StatusGatewayTimeout
+)
+
+var (
+	ErrBadRequest          = DetailedError{CodeField: CodeBadRequest, StatusField: http.StatusText(CodeBadRequest), ErrorField: "The request was malformed or contained invalid parameters"}
+	ErrUnauthorized        = DetailedError{CodeField: CodeUnauthorized, StatusField: http.StatusText(CodeUnauthorized), ErrorField: "The request could not be authorized"}
+	ErrForbidden           = DetailedError{CodeField: CodeForbidden, StatusField: http.StatusText(CodeForbidden), ErrorField: "The requested action was forbidden"}
+	ErrNotFound            = DetailedError{CodeField: CodeNotFound, StatusField: http.StatusText(CodeNotFound), ErrorField: "The requested resource could not be found"}
+	ErrConflict            = DetailedError{CodeField: CodeConflict, StatusField: http.StatusText(CodeConflict), ErrorField: "The resource could not be created due to a conflict"}
+	ErrInternalServerError = DetailedError{CodeField: CodeInternalServerError, StatusField: http.StatusText(CodeInternalServerError), ErrorField: "An internal server error occurred, please contact the system administrator"}
+	ErrUnavailable         = DetailedError{CodeField: CodeUnavailable, StatusField: http.StatusText(CodeUnavailable), ErrorField: "The service is currently unavailable"}
+	ErrTimeout             = DetailedError{CodeField: CodeTimeout, StatusField: http.StatusText(CodeTimeout), ErrorField: "The request timed out"}
+)
+
+// DetailedError is an error implementing every carrier of this package. It is the shared
+// error model of RPC responses, HTTP responses and CLI output.
+type DetailedError struct {
+	CodeField    int                    `json:"code,omitempty"`
+	StatusField  string                 `json:"status,omitempty"`
+	RIDField     string                 `json:"request,omitempty"`
+	ReasonField  string                 `json:"reason,omitempty"`
+	DebugField   string                 `json:"debug,omitempty"`
+	DetailsField map[string]interface{} `json:"details,omitempty"`
+	ErrorField   string                 `json:"message"`
+
+	err error
+}
+
+// NewDetailedError returns an error with code and message. The status is the HTTP status
+// text of code, empty if code is not an HTTP status.
+func NewDetailedError(code int, message string) *DetailedError {
+	return &DetailedError{CodeField: code, StatusField: http.StatusText(code), ErrorField: message}
+}
+
+// ToDetailedError converts any error into a *DetailedError, reading every carrier it implements.
+func ToDetailedError(err error) *DetailedError {
+	if err == nil {
+		return nil
+	}
+	if de := (*DetailedError)(nil); stderrors.As(err, &de) {
+		return de
+	}
+
+	de := &DetailedError{
+		CodeField:  CodeInternalServerError,
+		ErrorField: err.Error(),
+		err:        err,
+	}
+	if c := ReasonCarrier(nil); stderrors.As(err, &c) {
+		de.ReasonField = c.Reason()
+	}
+	if c := RequestIDCarrier(nil); stderrors.As(err, &c) {
+		de.RIDField = c.RequestID()
+	}
+	if c := DetailsCarrier(nil); stderrors.As(err, &c) {
+		de.DetailsField = c.Details()
+	}
+	if c := StatusCarrier(nil); stderrors.As(err, &c) {
+		de.StatusField = c.Status()
+	}
+	if c := StatusCodeCarrier(nil); stderrors.As(err, &c) && c.StatusCode() != 0 {
+		de.CodeField = c.StatusCode()
+	}
+	if c := DebugCarrier(nil); stderrors.As(err, &c) {
+		de.DebugField = c.Debug()
+	}
+	if de.StatusField == "" {
+		de.StatusField = http.StatusText(de.CodeField)
+	}
+	return de
+}
+
+func (e DetailedError) Error() string {
+	return e.ErrorField
+}
+
+// StatusCode implements StatusCodeCarrier.
+func (e DetailedError) StatusCode() int {
+	return e.CodeField
+}
+
+// Status implements StatusCarrier.
+func (e DetailedError) Status() string {
+	return e.StatusField
+}
+
+// RequestID implements RequestIDCarrier.
+func (e DetailedError) RequestID() string {
+	return e.RIDField
+}
+
+// Reason implements ReasonCarrier.
+func (e DetailedError) Reason() string {
+	return e.ReasonField
+}
+
+// Debug implements DebugCarrier.
+func (e DetailedError) Debug() string {
+	return e.DebugField
+}
+
+// Details implements DetailsCarrier.
+func (e DetailedError) Details() map[string]interface{} {
+	return e.DetailsField
+}
+
+// Unwrap returns the wrapped error, if any.
+func (e DetailedError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether err is a DetailedError with the same code, status and message.
+func (e DetailedError) Is(err error) bool {
+	switch te := err.(type) {
+	case DetailedError:
+		return e.ErrorField == te.ErrorField && e.StatusField == te.StatusField && e.CodeField == te.CodeField
+	case *DetailedError:
+		return te != nil && e.ErrorField == te.ErrorField && e.StatusField == te.StatusField && e.CodeField == te.CodeField
+	default:
+		return false
+	}
+}
+
+func (e DetailedError) WithWrap(err error) *DetailedError {
+	e.err = err
+	return &e
+}
+
+func (e DetailedError) WithError(message string) *DetailedError {
+	e.ErrorField = message
+	return &e
+}
+
+func (e DetailedError) WithErrorf(message string, args ...interface{}) *DetailedError {
+	return e.WithError(fmt.Sprintf(message, args...))
+}
+
+func (e DetailedError) WithReason(reason string) *DetailedError {
+	e.ReasonField = reason
+	return &e
+}
+
+func (e DetailedError) WithReasonf(reason string, args ...interface{}) *DetailedError {
+	return e.WithReason(fmt.Sprintf(reason, args...))
+}
+
+func (e DetailedError) WithDebug(debug string) *DetailedError {
+	e.DebugField = debug
+	return &e
+}
+
+func (e DetailedError) WithDebugf(debug string, args ...interface{}) *DetailedError {
+	return e.WithDebug(fmt.Sprintf(debug, args...))
+}
+
+func (e DetailedError) WithRequestID(id string) *DetailedError {
+	e.RIDField = id
+	return &e
+}
+
+func (e DetailedError) WithDetail(key string, detail interface{}) *DetailedError {
+	details := make(map[string]interface{}, len(e.DetailsField)+1)
+	for k, v := range e.DetailsField {
+		details[k] = v
+	}
+	details[key] = detail
+	e.DetailsField = details
+	return &e
+}
+
+// ToHerodot converts the error into a herodot error written by herodot.Writer.WriteError.
+func (e DetailedError) ToHerodot() *herodot.DefaultError {
+	return &herodot.DefaultError{
+		CodeField:    e.CodeField,
+		StatusField:  e.StatusField,
+		RIDField:     e.RIDField,
+		ReasonField:  e.ReasonField,
+		DebugField:   e.DebugField,
+		DetailsField: e.DetailsField,
+		ErrorField:   e.ErrorField,
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/ory/herodot"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetailedError(t *testing.T) {
+	err := ErrNotFound.WithReason("room does not exist").WithDetail("room", "lobby").WithRequestID("rid")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.False(t, errors.Is(err, ErrConflict))
+	assert.Equal(t, http.StatusNotFound, err.StatusCode())
+	assert.Nil(t, ErrNotFound.DetailsField, "WithDetail must not modify the well-known error")
+
+	var c interface {
+		StatusCodeCarrier
+		StatusCarrier
+		ReasonCarrier
+		DebugCarrier
+		DetailsCarrier
+		RequestIDCarrier
+	} = err
+	assert.Equal(t, "room does not exist", c.Reason())
+
+	h := err.ToHerodot()
+	assert.Equal(t, err.StatusCode(), h.StatusCode())
+	assert.Equal(t, err.Reason(), h.Reason())
+	assert.Equal(t, err.Details(), h.Details())
+	assert.Equal(t, err.RequestID(), h.RequestID())
+}
+
+func TestNewDetailedError(t *testing.T) {
+	assert.Equal(t, http.StatusText(http.StatusConflict), NewDetailedError(http.StatusConflict, "taken").Status())
+	unknown := NewDetailedError(480, "timeout")
+	assert.Equal(t, 480, unknown.StatusCode())
+	assert.Empty(t, unknown.Status())
+}
+
+func TestToDetailedError(t *testing.T) {
+	assert.Nil(t, ToDetailedError(nil))
+
+	original := ErrConflict.WithReason("already joined")
+	assert.Equal(t, original, ToDetailedError(pkgerrors.WithStack(original)))
+
+	de := ToDetailedError(herodot.ErrForbidden.WithReason("nope").WithDebug("dbg"))
+	assert.Equal(t, http.StatusForbidden, de.StatusCode())
+	assert.Equal(t, "nope", de.Reason())
+	assert.Equal(t, "dbg", de.Debug())
+
+	de = ToDetailedError(&Error{Code: 480, Reason: "timeout"})
+	assert.Equal(t, 480, de.StatusCode())
+	assert.Equal(t, "timeout", de.Error())
+	assert.Empty(t, de.Status())
+
+	de = ToDetailedError(errors.New("boom"))
+	require.Equal(t, http.StatusInternalServerError, de.StatusCode())
+	assert.Equal(t, http.StatusText(http.StatusInternalServerError), de.Status())
+	assert.Equal(t, "boom", de.Error())
+}
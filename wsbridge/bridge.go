@@ -0,0 +1,375 @@
+// Package wsbridge accepts protoo peers over WebSocket and relays their requests and
+// subscriptions through nprotoo.
+package wsbridge
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	"github.com/mj23978/chat-backend-x/jose"
+	logger "github.com/mj23978/chat-backend-x/logger/zerolog"
+	"github.com/mj23978/chat-backend-x/utils"
+)
+
+const (
+	// SubscribeMethod and UnsubscribeMethod are the reserved methods a WebSocket peer
+	// subscribes to and unsubscribes from broadcast channels with. Their data is {"channel": "..."}.
+	SubscribeMethod   = "$subscribe"
+	UnsubscribeMethod = "$unsubscribe"
+
+	// AccessTokenQuery is the query parameter browsers send the bearer token with, as they
+	// can not set headers on WebSocket handshakes.
+	AccessTokenQuery = "access_token"
+
+	// DefaultMaxInflight is the number of requests a peer may have in flight by default.
+	DefaultMaxInflight = 64
+
+	pingPeriod         = 5 * time.Second
+	pongWait           = 2 * pingPeriod
+	writeWait          = 10 * time.Second
+	maxPeerMessageSize = 1 << 20
+	peerSendBuffer     = 256
+)
+
+// ErrTooManyRequests rejects the requests of a peer beyond Bridge.MaxInflight.
+var ErrTooManyRequests = utils.NewDetailedError(http.StatusTooManyRequests, "too many requests in flight")
+
+// Bridge accepts protoo peers over WebSocket. It relays their requests to NATS channels
+// and pushes the notifications of the channels they subscribed to back to them.
+//
+// Peers can not set nprotoo.PeerSubjectMetadata and nprotoo.AuthorizationMetadata
+// themselves, they are stripped from the metadata of their requests whether or not the
+// bridge has a Verifier. Reserved methods, starting with '$', are not relayed.
+type Bridge struct {
+	np *nprotoo.NatsProtoo
+	// Routes maps the method of a peer request to the channel it is relayed to. The "*"
+	// route receives the methods without route.
+	Routes map[string]string
+	// Broadcasts lists the channels peers may subscribe to. Patterns may use the NATS
+	// wildcards '*' and '>', the channels peers subscribe to may not.
+	Broadcasts []string
+	// Verifier authenticates peers with the bearer token of the handshake. Every peer is
+	// accepted if it is nil.
+	Verifier *jose.Verifier
+	// RequestTimeout of relayed requests, nprotoo.DefaultRequestTimeout if 0.
+	RequestTimeout time.Duration
+	// MaxInflight bounds the relayed requests of a peer waiting for their response, the
+	// following ones are rejected with ErrTooManyRequests. Unbounded if 0.
+	MaxInflight int
+	Upgrader    websocket.Upgrader
+}
+
+// NewBridge returns a bridge relaying requests through np according to routes.
+func NewBridge(np *nprotoo.NatsProtoo, routes map[string]string, broadcasts ...string) *Bridge {
+	return &Bridge{
+		np:             np,
+		Routes:         routes,
+		Broadcasts:     broadcasts,
+		RequestTimeout: nprotoo.DefaultRequestTimeout,
+		MaxInflight:    DefaultMaxInflight,
+		Upgrader:       websocket.Upgrader{Subprotocols: []string{"protoo"}},
+	}
+}
+
+// ServeHTTP authenticates the peer and upgrades the connection.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	md := nprotoo.Metadata{}
+	if b.Verifier != nil {
+		token := bearerToken(r)
+		if token == "" {
+			writeHTTPError(w, utils.ErrUnauthorized.WithReason("A bearer token is required"))
+			return
+		}
+		claims, _, err := b.Verifier.Verify(token)
+		if err != nil {
+			writeHTTPError(w, utils.ErrUnauthorized.WithReason("The bearer token is invalid").WithDebug(err.Error()))
+			return
+		}
+		md[nprotoo.AuthorizationMetadata] = "Bearer " + token
+		md[nprotoo.PeerSubjectMetadata] = claims.Subject
+	}
+
+	conn, err := b.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warnf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &peer{
+		bridge:        b,
+		conn:          conn,
+		md:            md,
+		ctx:           ctx,
+		cancel:        cancel,
+		send:          make(chan []byte, peerSendBuffer),
+		subscriptions: make(map[string]nprotoo.BroadCastFunc),
+	}
+	logger.Infof("WebSocket peer connected [%s] %s", md.Get(nprotoo.PeerSubjectMetadata), r.RemoteAddr)
+	go p.writePump()
+	p.readPump()
+}
+
+func bearerToken(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+		return strings.TrimSpace(authorization[len("bearer "):])
+	}
+	return r.URL.Query().Get(AccessTokenQuery)
+}
+
+func writeHTTPError(w http.ResponseWriter, err *utils.DetailedError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode())
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": err})
+}
+
+// allowed reports whether peers may subscribe to channel.
+func (b *Bridge) allowed(channel string) bool {
+	for _, pattern := range b.Broadcasts {
+		if nprotoo.SubjectMatches(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// peer is a WebSocket connection of a protoo peer.
+type peer struct {
+	bridge *Bridge
+	conn   *websocket.Conn
+	md     nprotoo.Metadata
+	// ctx is canceled once the peer disconnected, which cancels its pending requests.
+	ctx           context.Context
+	cancel        context.CancelFunc
+	send          chan []byte
+	mutex         sync.Mutex
+	closed        bool
+	subscriptions map[string]nprotoo.BroadCastFunc
+	inflight      int
+}
+
+func (p *peer) readPump() {
+	defer p.close()
+	p.conn.SetReadLimit(maxPeerMessageSize)
+	p.conn.SetReadDeadline(time.Now().Add(pongWait))
+	p.conn.SetPongHandler(func(string) error {
+		return p.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, message, err := p.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Warnf("WebSocket peer read error: %v", err)
+			}
+			return
+		}
+		p.handleMessage(message)
+	}
+}
+
+func (p *peer) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		p.conn.Close()
+	}()
+	for {
+		select {
+		case message := <-p.send:
+			p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := p.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				logger.Warnf("WebSocket peer write error: %v", err)
+				return
+			}
+		case <-ticker.C:
+			p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := p.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-p.ctx.Done():
+			p.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// close unsubscribes the peer and cancels its pending requests.
+func (p *peer) close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	subscriptions := p.subscriptions
+	p.subscriptions = nil
+	p.mutex.Unlock()
+
+	for channel, listener := range subscriptions {
+		p.bridge.np.OffBroadcast(channel, listener)
+	}
+	p.cancel()
+	logger.Infof("WebSocket peer disconnected [%s]", p.md.Get(nprotoo.PeerSubjectMetadata))
+}
+
+// write queues message for the peer. A peer too slow to keep up is disconnected.
+func (p *peer) write(message interface{}) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		logger.Errorf("Marshal %v", err)
+		return
+	}
+	select {
+	case p.send <- payload:
+	case <-p.ctx.Done():
+	default:
+		logger.Warnf("WebSocket peer [%s] is too slow, disconnecting", p.md.Get(nprotoo.PeerSubjectMetadata))
+		p.close()
+	}
+}
+
+func (p *peer) handleMessage(message []byte) {
+	var msg nprotoo.PeerMsg
+	if err := json.Unmarshal(message, &msg); err != nil || !msg.Request {
+		logger.Warnf("WebSocket peer sent an invalid request: %s", string(message))
+		return
+	}
+	request := msg.ToRequest()
+	switch request.Method {
+	case SubscribeMethod, UnsubscribeMethod:
+		p.handleSubscription(request)
+	default:
+		if strings.HasPrefix(request.Method, "$") {
+			// Reserved methods, e.g. DescribeMethod, are answered by every channel and not meant for peers.
+			p.reject(request.ID, utils.ErrNotFound.WithReasonf("Method %s is reserved", request.Method))
+			return
+		}
+		if !p.acquire() {
+			p.reject(request.ID, ErrTooManyRequests.WithReasonf("At most %d requests may be in flight", p.bridge.MaxInflight))
+			return
+		}
+		go func() {
+			defer p.release()
+			p.relay(request)
+		}()
+	}
+}
+
+// acquire counts a request in flight, unless the peer reached MaxInflight.
+func (p *peer) acquire() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.bridge.MaxInflight > 0 && p.inflight >= p.bridge.MaxInflight {
+		return false
+	}
+	p.inflight++
+	return true
+}
+
+func (p *peer) release() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inflight--
+}
+
+func (p *peer) reply(id int, data interface{}) {
+	response, err := nprotoo.NewResponse(id, data)
+	if err != nil {
+		logger.Errorf("Error building response %v", err)
+		return
+	}
+	p.write(response)
+}
+
+func (p *peer) reject(id int, err error) {
+	p.write(nprotoo.NewResponseErrFromError(id, err))
+}
+
+func (p *peer) handleSubscription(request nprotoo.Request) {
+	var data struct {
+		Channel string `json:"channel"`
+	}
+	if err := json.Unmarshal(request.Data, &data); err != nil || data.Channel == "" {
+		p.reject(request.ID, utils.ErrBadRequest.WithReason("The channel to subscribe to is missing"))
+		return
+	}
+	if nprotoo.HasWildcard(data.Channel) {
+		p.reject(request.ID, utils.ErrBadRequest.WithReasonf("Subscribing to the wildcard channel %s is not supported", data.Channel))
+		return
+	}
+	if !p.bridge.allowed(data.Channel) {
+		p.reject(request.ID, utils.ErrForbidden.WithReasonf("Subscribing to channel %s is not allowed", data.Channel))
+		return
+	}
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	listener, subscribed := p.subscriptions[data.Channel]
+	if request.Method == SubscribeMethod && !subscribed {
+		listener = func(notification nprotoo.Notification, subj string) {
+			notification.Metadata = nprotoo.Metadata{nprotoo.ChannelMetadata: subj}
+			p.write(&notification)
+		}
+		p.subscriptions[data.Channel] = listener
+	} else if request.Method == UnsubscribeMethod && subscribed {
+		delete(p.subscriptions, data.Channel)
+	}
+	p.mutex.Unlock()
+
+	if request.Method == SubscribeMethod && !subscribed {
+		p.bridge.np.OnBroadcast(data.Channel, listener)
+	} else if request.Method == UnsubscribeMethod && subscribed {
+		p.bridge.np.OffBroadcast(data.Channel, listener)
+	}
+	p.reply(request.ID, nil)
+}
+
+// relay sends request to the channel routed to and writes the response to the peer.
+func (p *peer) relay(request nprotoo.Request) {
+	channel, found := p.bridge.Routes[request.Method]
+	if !found {
+		channel, found = p.bridge.Routes["*"]
+	}
+	if !found {
+		p.reject(request.ID, utils.ErrNotFound.WithReasonf("Method %s is not routed", request.Method))
+		return
+	}
+
+	md := nprotoo.Metadata{}
+	for k, v := range request.Metadata {
+		if !reservedPeerMetadata(k) {
+			md[k] = v
+		}
+	}
+	for k, v := range p.md {
+		md[k] = v
+	}
+	requestor := p.bridge.np.NewRequestor(channel)
+	if p.bridge.RequestTimeout > 0 {
+		requestor.SetRequestTimeout(p.bridge.RequestTimeout)
+	}
+	result, err := requestor.SyncRequestContext(nprotoo.NewMetadataContext(p.ctx, md), request.Method, request.Data)
+	if p.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		p.reject(request.ID, err.Detailed())
+		return
+	}
+	p.reply(request.ID, result)
+}
+
+// reservedPeerMetadata reports whether key is set by the bridge only. Keys are compared
+// case-insensitively, as they become NATS headers.
+func reservedPeerMetadata(key string) bool {
+	return strings.EqualFold(key, nprotoo.PeerSubjectMetadata) || strings.EqualFold(key, nprotoo.AuthorizationMetadata)
+}
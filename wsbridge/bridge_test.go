@@ -0,0 +1,211 @@
+package wsbridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jose2 "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	nprotoo "github.com/mj23978/chat-backend-x/broker/nats"
+	"github.com/mj23978/chat-backend-x/jose"
+)
+
+func runProtoo(t *testing.T) *nprotoo.NatsProtoo {
+	s, err := server.NewServer(&server.Options{Port: -1})
+	require.NoError(t, err)
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	require.True(t, s.ReadyForConnections(5*time.Second))
+	np, err := nprotoo.NewNatsProtooWithConfig(nprotoo.NewConfig(s.ClientURL()))
+	require.NoError(t, err)
+	t.Cleanup(np.Close)
+	return np
+}
+
+func TestBridge(t *testing.T) {
+	np := runProtoo(t)
+
+	keys, err := jose.GenerateSigningKeys("key-1", string(jose2.RS256), 2048)
+	require.NoError(t, err)
+	signer, err := jose2.NewSigner(jose2.SigningKey{Algorithm: jose2.RS256, Key: keys.Keys[0]}, (&jose2.SignerOptions{}).WithHeader("kid", "key-1"))
+	require.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{Subject: "user-1", Expiry: jwt.NewNumericDate(time.Now().Add(time.Minute))}).CompactSerialize()
+	require.NoError(t, err)
+
+	np.OnRequest("svc", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		accept(map[string]string{"method": request.Method, "subject": request.Metadata.Get(nprotoo.PeerSubjectMetadata)})
+	})
+
+	bridge := NewBridge(np, map[string]string{"whoami": "svc"}, "room.*")
+	bridge.Verifier = &jose.Verifier{Keys: jose.StaticKeys{Keys: []jose2.JSONWebKey{keys.Keys[0].Public()}}}
+	server := httptest.NewServer(bridge)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, res, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?"+AccessTokenQuery+"="+token, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	request := func(id int, method string, data interface{}) nprotoo.Response {
+		return peerRequest(t, conn, id, method, data, nil)
+	}
+
+	response := request(1, "whoami", nil)
+	require.True(t, response.Ok, response.ErrorReason)
+	assert.JSONEq(t, `{"method":"whoami","subject":"user-1"}`, string(response.Data))
+
+	response = peerRequest(t, conn, 10, "whoami", nil, nprotoo.Metadata{"peer-subject": "admin"})
+	require.True(t, response.Ok, response.ErrorReason)
+	assert.JSONEq(t, `{"method":"whoami","subject":"user-1"}`, string(response.Data))
+
+	response = request(2, "unknown", nil)
+	assert.False(t, response.Ok)
+	assert.Equal(t, http.StatusNotFound, response.ErrorCode)
+
+	response = request(3, SubscribeMethod, map[string]string{"channel": "secret"})
+	assert.False(t, response.Ok)
+	assert.Equal(t, http.StatusForbidden, response.ErrorCode)
+
+	response = request(11, SubscribeMethod, map[string]string{"channel": "room.*"})
+	assert.False(t, response.Ok)
+	assert.Equal(t, http.StatusBadRequest, response.ErrorCode)
+
+	response = request(4, SubscribeMethod, map[string]string{"channel": "room.lobby"})
+	require.True(t, response.Ok, response.ErrorReason)
+
+	np.NewBroadcaster("room.lobby").Say("message", "hello")
+	var msg nprotoo.PeerMsg
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, conn.ReadJSON(&msg))
+	assert.True(t, msg.Notification)
+	assert.Equal(t, "message", msg.Method)
+	assert.Equal(t, "room.lobby", msg.Metadata.Get(nprotoo.ChannelMetadata))
+	assert.JSONEq(t, `"hello"`, string(msg.Data))
+
+	response = request(5, UnsubscribeMethod, map[string]string{"channel": "room.lobby"})
+	require.True(t, response.Ok, response.ErrorReason)
+	np.NewBroadcaster("room.lobby").Say("message", "again")
+	require.NoError(t, conn.WriteJSON(&nprotoo.Request{
+		RequestData: nprotoo.RequestData{Request: true},
+		CommonData:  nprotoo.CommonData{ID: 6, Method: "whoami", Data: nprotoo.RawMessage("null")},
+	}))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, conn.ReadJSON(&msg))
+	assert.True(t, msg.Response, "unsubscribed notifications are not pushed")
+}
+
+func TestBridgeReservedMetadata(t *testing.T) {
+	np := runProtoo(t)
+
+	np.OnRequest("svc", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		accept(map[string]string{
+			"subject":       request.Metadata.Get(nprotoo.PeerSubjectMetadata),
+			"authorization": request.Metadata.Get(nprotoo.AuthorizationMetadata),
+			"locale":        request.Metadata.Get("Locale"),
+		})
+	})
+
+	server := httptest.NewServer(NewBridge(np, map[string]string{"*": "svc"}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	response := peerRequest(t, conn, 1, "whoami", nil, nprotoo.Metadata{
+		nprotoo.PeerSubjectMetadata: "admin",
+		"authorization":             "Bearer forged",
+		"Locale":                    "de",
+	})
+	require.True(t, response.Ok, response.ErrorReason)
+	assert.JSONEq(t, `{"subject":"","authorization":"","locale":"de"}`, string(response.Data))
+}
+
+func TestBridgeReservedMethods(t *testing.T) {
+	np := runProtoo(t)
+	np.OnRequest("svc", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		accept(request.Method)
+	})
+
+	server := httptest.NewServer(NewBridge(np, map[string]string{"*": "svc"}))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for i, method := range []string{nprotoo.DescribeMethod, nprotoo.CapabilitiesMethod, nprotoo.TransferMethod, "$other"} {
+		response := peerRequest(t, conn, i+1, method, nil, nil)
+		assert.False(t, response.Ok, method)
+		assert.Equal(t, http.StatusNotFound, response.ErrorCode, method)
+	}
+	response := peerRequest(t, conn, 10, "echo", nil, nil)
+	require.True(t, response.Ok, response.ErrorReason)
+}
+
+func TestBridgeMaxInflight(t *testing.T) {
+	np := runProtoo(t)
+	release := make(chan struct{})
+	np.OnRequest("svc", func(request nprotoo.Request, accept nprotoo.RespondFunc, reject nprotoo.RejectFunc) {
+		<-release
+		accept(request.Method)
+	})
+
+	bridge := NewBridge(np, map[string]string{"*": "svc"})
+	bridge.MaxInflight = 2
+	server := httptest.NewServer(bridge)
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for id := 1; id <= 2; id++ {
+		require.NoError(t, conn.WriteJSON(&nprotoo.Request{
+			RequestData: nprotoo.RequestData{Request: true},
+			CommonData:  nprotoo.CommonData{ID: id, Method: "slow", Data: nprotoo.RawMessage("null")},
+		}))
+	}
+	response := peerRequest(t, conn, 3, "slow", nil, nil)
+	assert.False(t, response.Ok)
+	assert.Equal(t, http.StatusTooManyRequests, response.ErrorCode)
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		var msg nprotoo.PeerMsg
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, conn.ReadJSON(&msg))
+		assert.True(t, msg.Ok, msg.ErrorReason)
+	}
+	response = peerRequest(t, conn, 4, "fast", nil, nil)
+	assert.True(t, response.Ok, "finished requests are no longer in flight")
+}
+
+// peerRequest sends a request as a WebSocket peer and waits for its response.
+func peerRequest(t *testing.T, conn *websocket.Conn, id int, method string, data interface{}, md nprotoo.Metadata) nprotoo.Response {
+	payload, err := json.Marshal(data)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(&nprotoo.Request{
+		RequestData: nprotoo.RequestData{Request: true},
+		CommonData:  nprotoo.CommonData{ID: id, Method: method, Data: payload, Metadata: md},
+	}))
+	for {
+		var msg nprotoo.PeerMsg
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, conn.ReadJSON(&msg))
+		if msg.Response {
+			require.Equal(t, id, msg.ID)
+			return nprotoo.Response{ResponseData: msg.ResponseData, CommonData: msg.CommonData}
+		}
+	}
+}